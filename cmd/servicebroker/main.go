@@ -27,11 +27,13 @@ import (
 	"github.com/habitat-sh/habitat-service-broker/pkg/broker"
 
 	"github.com/golang/glog"
+	"github.com/gorilla/mux"
 	habclient "github.com/habitat-sh/habitat-operator/pkg/client/clientset/versioned/typed/habitat/v1beta1"
 	"github.com/pmorie/osb-broker-lib/pkg/metrics"
 	"github.com/pmorie/osb-broker-lib/pkg/rest"
 	"github.com/pmorie/osb-broker-lib/pkg/server"
 	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 )
@@ -97,6 +99,14 @@ func runWithContext(ctx context.Context) error {
 		return err
 	}
 
+	if err := brokerLogic.SetupAuditSink(options.AuditSink, options.AuditLogPath); err != nil {
+		return err
+	}
+
+	if err := brokerLogic.SetupCredentialStore(options.CredentialStoreURL, options.CredentialStoreTokenPath); err != nil {
+		return err
+	}
+
 	// Prom. metrics
 	reg := prom.NewRegistry()
 	osbMetrics := metrics.New()
@@ -107,7 +117,28 @@ func runWithContext(ctx context.Context) error {
 		return err
 	}
 
-	s := server.New(api, reg)
+	// The broker's own handlers take precedence over the ones of the
+	// osb-broker-lib, which serves everything else.
+	router := mux.NewRouter()
+	broker.NewAPISurface(brokerLogic, osbMetrics).RegisterHandlers(router)
+	var admin *broker.AdminSurface
+	if options.AdminTokenPath != "" {
+		admin, err = broker.NewAdminSurface(brokerLogic, options.AdminTokenPath)
+		if err != nil {
+			return err
+		}
+		admin.RegisterHandlers(router)
+	}
+	if options.DashboardURL != "" {
+		broker.NewDashboardSurface(brokerLogic, admin).RegisterHandlers(router)
+	}
+	router.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	router.PathPrefix("/").Handler(server.NewHTTPHandler(api))
+
+	s := &server.Server{Router: router}
+
+	go brokerLogic.RunCredentialRotation(ctx)
+	go brokerLogic.RunOwnershipReconciliation(ctx)
 
 	glog.Infof("Starting broker!")
 
@@ -120,7 +151,7 @@ func runWithContext(ctx context.Context) error {
 }
 
 func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
-	term := make(chan os.Signal)
+	term := make(chan os.Signal, 1)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
 
 	for {
@@ -0,0 +1,125 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// AdminSurface serves the operations of the broker which are not part of the
+// Open Service Broker API. All of them require the admin bearer token.
+type AdminSurface struct {
+	Broker *BrokerLogic
+	token  string
+}
+
+// NewAdminSurface returns a new AdminSurface for the given broker, with the
+// admin token read from the file at tokenPath.
+func NewAdminSurface(b *BrokerLogic, tokenPath string) (*AdminSurface, error) {
+	data, err := ioutil.ReadFile(tokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading admin token: %v", err)
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, fmt.Errorf("admin token in %s is empty", tokenPath)
+	}
+
+	return &AdminSurface{
+		Broker: b,
+		token:  token,
+	}, nil
+}
+
+// RegisterHandlers adds the handlers of the AdminSurface to the router.
+func (s *AdminSurface) RegisterHandlers(router *mux.Router) {
+	r := router.PathPrefix("/admin").Subrouter()
+	r.HandleFunc("/service_instances/{instance_id}/rotate_credentials", s.authenticate(s.RotateInstanceCredentialsHandler)).Methods("POST")
+	r.HandleFunc("/service_instances/{instance_id}/service_bindings/{binding_id}/rotate_credentials", s.authenticate(s.RotateBindingCredentialsHandler)).Methods("POST")
+	r.HandleFunc("/service_instances/{instance_id}/snapshots", s.authenticate(s.SnapshotInstanceHandler)).Methods("POST")
+}
+
+// authorized reports whether the request carries the admin token.
+func (s *AdminSurface) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *AdminSurface) authenticate(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			glog.Warningf("Rejected unauthenticated admin request %s %s", r.Method, r.URL.Path)
+			writeError(w, errors.New("invalid admin token"), http.StatusUnauthorized)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// RotateInstanceCredentialsHandler starts a credential rotation of the
+// password of an instance and of every binding of it.
+func (s *AdminSurface) RotateInstanceCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)[osb.VarKeyInstanceID]
+	glog.V(4).Infof("Received credential rotation for instanceID %q", instanceID)
+
+	response, err := s.Broker.RotateInstanceCredentials(instanceID)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, http.StatusAccepted, response)
+}
+
+// RotateBindingCredentialsHandler starts a credential rotation of a binding.
+func (s *AdminSurface) RotateBindingCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	instanceID := vars[osb.VarKeyInstanceID]
+	bindingID := vars[osb.VarKeyBindingID]
+	glog.V(4).Infof("Received credential rotation for instanceID %q, bindingID %q", instanceID, bindingID)
+
+	response, err := s.Broker.RotateBindingCredentials(instanceID, bindingID)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, http.StatusAccepted, response)
+}
+
+// SnapshotInstanceHandler takes a snapshot of the volumes of an instance.
+func (s *AdminSurface) SnapshotInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)[osb.VarKeyInstanceID]
+	glog.V(4).Infof("Received snapshot for instanceID %q", instanceID)
+
+	response, err := s.Broker.SnapshotInstance(instanceID)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, http.StatusAccepted, response)
+}
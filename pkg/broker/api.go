@@ -0,0 +1,354 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"github.com/pmorie/osb-broker-lib/pkg/metrics"
+)
+
+// APISurface serves the parts of the Open Service Broker API which the
+// osb-broker-lib APISurface does not support yet, or not completely. It has
+// to be registered in front of the osb-broker-lib handlers.
+type APISurface struct {
+	Broker  *BrokerLogic
+	Metrics *metrics.OSBMetricsCollector
+}
+
+// NewAPISurface returns a new APISurface for the given broker.
+func NewAPISurface(b *BrokerLogic, m *metrics.OSBMetricsCollector) *APISurface {
+	return &APISurface{
+		Broker:  b,
+		Metrics: m,
+	}
+}
+
+// RegisterHandlers adds the handlers of the APISurface to the router.
+func (s *APISurface) RegisterHandlers(router *mux.Router) {
+	router.HandleFunc("/v2/catalog", s.GetCatalogHandler).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}", s.GetInstanceHandler).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", s.GetBindingHandler).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", s.BindHandler).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", s.UnbindHandler).Methods("DELETE")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}/last_operation", s.BindingLastOperationHandler).Methods("GET")
+}
+
+// GetInstanceResponse is sent as the response to doing a GET on a particular
+// instance.
+type GetInstanceResponse struct {
+	ServiceID    string                 `json:"service_id"`
+	PlanID       string                 `json:"plan_id"`
+	DashboardURL *string                `json:"dashboard_url,omitempty"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+
+	// The package fields extend the Open Service Broker API.
+	PackageIdent       string `json:"package_ident,omitempty"`
+	LatestPackageIdent string `json:"latest_package_ident,omitempty"`
+	UpdateAvailable    bool   `json:"update_available,omitempty"`
+
+	// Backups lists the latest backups of the instance, if it's backed up.
+	Backups []BackupStatus `json:"backups,omitempty"`
+	// Snapshots lists the VolumeSnapshots of the volumes of the instance.
+	Snapshots []SnapshotStatus `json:"snapshots,omitempty"`
+}
+
+// catalogService adds the fields of the catalog which the osb client
+// library does not know about yet.
+type catalogService struct {
+	osb.Service
+	InstancesRetrievable bool `json:"instances_retrievable,omitempty"`
+}
+
+type catalogResponse struct {
+	Services []catalogService `json:"services"`
+}
+
+// GetCatalogHandler serves the catalog of BrokerLogic.GetCatalog, with all
+// services advertising that their instances are retrievable.
+func (s *APISurface) GetCatalogHandler(w http.ResponseWriter, r *http.Request) {
+	s.Metrics.Actions.WithLabelValues("get_catalog").Inc()
+
+	if err := s.Broker.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+		writeError(w, err, http.StatusPreconditionFailed)
+		return
+	}
+
+	c := &broker.RequestContext{
+		Writer:  w,
+		Request: r,
+	}
+
+	catalog, err := s.Broker.GetCatalog(c)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	response := catalogResponse{}
+	for _, svc := range catalog.Services {
+		response.Services = append(response.Services, catalogService{
+			Service:              svc,
+			InstancesRetrievable: true,
+		})
+	}
+
+	writeResponse(w, http.StatusOK, response)
+}
+
+// GetInstanceHandler serves the instance fetch endpoint.
+func (s *APISurface) GetInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	s.Metrics.Actions.WithLabelValues("get_instance").Inc()
+
+	if err := s.Broker.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+		writeError(w, err, http.StatusPreconditionFailed)
+		return
+	}
+
+	instanceID := mux.Vars(r)[osb.VarKeyInstanceID]
+	glog.V(4).Infof("Received GetInstanceRequest for instanceID %q", instanceID)
+
+	response, err := s.Broker.GetInstance(instanceID)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, response)
+}
+
+// GetBindingHandler serves the binding fetch endpoint.
+func (s *APISurface) GetBindingHandler(w http.ResponseWriter, r *http.Request) {
+	s.Metrics.Actions.WithLabelValues("get_binding").Inc()
+
+	if err := s.Broker.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+		writeError(w, err, http.StatusPreconditionFailed)
+		return
+	}
+
+	vars := mux.Vars(r)
+	request := &osb.GetBindingRequest{
+		InstanceID: vars[osb.VarKeyInstanceID],
+		BindingID:  vars[osb.VarKeyBindingID],
+	}
+	glog.V(4).Infof("Received GetBindingRequest for instanceID %q, bindingID %q", request.InstanceID, request.BindingID)
+
+	response, err := s.Broker.GetBinding(request)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, response)
+}
+
+// BindHandler serves the bind endpoint. Unlike the osb-broker-lib handler,
+// it honors the accepts_incomplete query parameter and answers asynchronous
+// bindings with 202 Accepted.
+func (s *APISurface) BindHandler(w http.ResponseWriter, r *http.Request) {
+	s.Metrics.Actions.WithLabelValues("bind").Inc()
+
+	if err := s.Broker.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+		writeError(w, err, http.StatusPreconditionFailed)
+		return
+	}
+
+	request := &osb.BindRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	request.InstanceID = vars[osb.VarKeyInstanceID]
+	request.BindingID = vars[osb.VarKeyBindingID]
+	request.AcceptsIncomplete = acceptsIncomplete(r)
+	request.OriginatingIdentity = originatingIdentity(r)
+
+	glog.V(4).Infof("Received BindRequest for instanceID %q, bindingID %q", request.InstanceID, request.BindingID)
+
+	c := &broker.RequestContext{
+		Writer:  w,
+		Request: r,
+	}
+
+	response, err := s.Broker.Bind(request, c)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusCreated
+	if response.Async {
+		status = http.StatusAccepted
+	} else if response.Exists {
+		status = http.StatusOK
+	}
+
+	writeResponse(w, status, response)
+}
+
+// UnbindHandler serves the unbind endpoint, answering asynchronous unbinds
+// with 202 Accepted.
+func (s *APISurface) UnbindHandler(w http.ResponseWriter, r *http.Request) {
+	s.Metrics.Actions.WithLabelValues("unbind").Inc()
+
+	if err := s.Broker.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+		writeError(w, err, http.StatusPreconditionFailed)
+		return
+	}
+
+	vars := mux.Vars(r)
+	request := &osb.UnbindRequest{
+		InstanceID:          vars[osb.VarKeyInstanceID],
+		BindingID:           vars[osb.VarKeyBindingID],
+		AcceptsIncomplete:   acceptsIncomplete(r),
+		ServiceID:           r.FormValue(osb.VarKeyServiceID),
+		PlanID:              r.FormValue(osb.VarKeyPlanID),
+		OriginatingIdentity: originatingIdentity(r),
+	}
+
+	glog.V(4).Infof("Received UnbindRequest for instanceID %q, bindingID %q", request.InstanceID, request.BindingID)
+
+	c := &broker.RequestContext{
+		Writer:  w,
+		Request: r,
+	}
+
+	response, err := s.Broker.Unbind(request, c)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if response.Async {
+		status = http.StatusAccepted
+	}
+
+	writeResponse(w, status, response)
+}
+
+// BindingLastOperationHandler serves the endpoint polled by platforms while
+// a binding is created or deleted asynchronously.
+func (s *APISurface) BindingLastOperationHandler(w http.ResponseWriter, r *http.Request) {
+	s.Metrics.Actions.WithLabelValues("binding_last_operation").Inc()
+
+	if err := s.Broker.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+		writeError(w, err, http.StatusPreconditionFailed)
+		return
+	}
+
+	vars := mux.Vars(r)
+	request := &osb.BindingLastOperationRequest{
+		InstanceID:          vars[osb.VarKeyInstanceID],
+		BindingID:           vars[osb.VarKeyBindingID],
+		OriginatingIdentity: originatingIdentity(r),
+	}
+	if serviceID := r.FormValue(osb.VarKeyServiceID); serviceID != "" {
+		request.ServiceID = &serviceID
+	}
+	if planID := r.FormValue(osb.VarKeyPlanID); planID != "" {
+		request.PlanID = &planID
+	}
+	if operation := r.FormValue(osb.VarKeyOperation); operation != "" {
+		key := osb.OperationKey(operation)
+		request.OperationKey = &key
+	}
+
+	glog.V(4).Infof("Received BindingLastOperationRequest for instanceID %q, bindingID %q", request.InstanceID, request.BindingID)
+
+	response, err := s.Broker.BindingLastOperation(request)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, response)
+}
+
+func acceptsIncomplete(r *http.Request) bool {
+	return strings.ToLower(r.FormValue(osb.AcceptsIncomplete)) == "true"
+}
+
+// originatingIdentity decodes the originating identity header, which
+// platforms are not required to send.
+func originatingIdentity(r *http.Request) *osb.OriginatingIdentity {
+	header := r.Header.Get(osb.OriginatingIdentityHeader)
+	if header == "" {
+		return nil
+	}
+
+	parts := strings.Split(header, " ")
+	if len(parts) != 2 {
+		glog.Infof("invalid originating identity header %q", header)
+		return nil
+	}
+
+	value, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		glog.Infof("invalid encoding of originating identity header %q", header)
+		return nil
+	}
+
+	return &osb.OriginatingIdentity{
+		Platform: parts[0],
+		Value:    string(value),
+	}
+}
+
+// writeResponse writes the object as JSON with the given status code, the
+// same way the osb-broker-lib does.
+func writeResponse(w http.ResponseWriter, code int, object interface{}) {
+	data, err := json.Marshal(object)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// writeError writes the error in the format of the Open Service Broker API.
+// osb.HTTPStatusCodeErrors carry their own status code, all other errors
+// are written with the default status code.
+func writeError(w http.ResponseWriter, err error, defaultStatusCode int) {
+	type e struct {
+		ErrorMessage *string `json:"error,omitempty"`
+		Description  *string `json:"description,omitempty"`
+	}
+
+	if httpErr, ok := osb.IsHTTPError(err); ok {
+		writeResponse(w, httpErr.StatusCode, &e{
+			ErrorMessage: httpErr.ErrorMessage,
+			Description:  httpErr.Description,
+		})
+		return
+	}
+
+	description := err.Error()
+	writeResponse(w, defaultStatusCode, &e{
+		Description: &description,
+	})
+}
@@ -0,0 +1,351 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	auditSinkStdout = "stdout"
+	auditSinkFile   = "file"
+	auditSinkEvents = "events"
+
+	auditOutcomeSucceeded = "succeeded"
+	auditOutcomeFailed    = "failed"
+
+	auditActionCreated = "created"
+	auditActionUpdated = "updated"
+	auditActionDeleted = "deleted"
+
+	redactedValue = "<redacted>"
+)
+
+var auditEventReasons = map[string]string{
+	operationProvision:   "Provision",
+	operationUpdate:      "Update",
+	operationDeprovision: "Deprovision",
+	operationBind:        "Bind",
+	operationUnbind:      "Unbind",
+
+	operationRotateCredentials: "RotateCredentials",
+	operationRevokeCredentials: "RevokeCredentials",
+}
+
+// sensitiveParameterKeys holds the substrings which mark a parameter as a
+// secret that must not end up in the audit log.
+var sensitiveParameterKeys = []string{
+	"password",
+	"passwd",
+	"secret",
+	"token",
+	"credential",
+	"key",
+	"auth",
+}
+
+// AuditSink is the destination of the audit trail. Implementations must only
+// ever append to the trail.
+type AuditSink interface {
+	Record(entry *AuditEntry) error
+}
+
+// AuditEntry describes a single lifecycle operation performed by the broker.
+type AuditEntry struct {
+	Time       time.Time              `json:"time"`
+	Operation  string                 `json:"operation"`
+	InstanceID string                 `json:"instanceID"`
+	BindingID  string                 `json:"bindingID,omitempty"`
+	ServiceID  string                 `json:"serviceID,omitempty"`
+	PlanID     string                 `json:"planID,omitempty"`
+	Identity   *AuditIdentity         `json:"identity,omitempty"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	Resources  []AuditResource        `json:"resources,omitempty"`
+	Outcome    string                 `json:"outcome"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// AuditIdentity is the originating identity of the user who requested an
+// operation.
+type AuditIdentity struct {
+	Platform string   `json:"platform"`
+	Username string   `json:"username,omitempty"`
+	UID      string   `json:"uid,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+// AuditResource is a Kubernetes resource that was touched by an operation.
+type AuditResource struct {
+	Action    string `json:"action"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+func newAuditEntry(operation, instanceID, serviceID, planID string, identity *osb.OriginatingIdentity, params map[string]interface{}) *AuditEntry {
+	return &AuditEntry{
+		Time:       time.Now().UTC(),
+		Operation:  operation,
+		InstanceID: instanceID,
+		ServiceID:  serviceID,
+		PlanID:     planID,
+		Identity:   auditIdentity(identity),
+		Parameters: redactParameters(params),
+	}
+}
+
+func (e *AuditEntry) created(kind, namespace, name string) {
+	e.addResource(auditActionCreated, kind, namespace, name)
+}
+
+func (e *AuditEntry) updated(kind, namespace, name string) {
+	e.addResource(auditActionUpdated, kind, namespace, name)
+}
+
+func (e *AuditEntry) deleted(kind, namespace, name string) {
+	e.addResource(auditActionDeleted, kind, namespace, name)
+}
+
+func (e *AuditEntry) addResource(action, kind, namespace, name string) {
+	// Helpers are shared with code paths that are not audited, in which
+	// case there is no entry to record the resource in.
+	if e == nil {
+		return
+	}
+
+	e.Resources = append(e.Resources, AuditResource{
+		Action:    action,
+		Kind:      kind,
+		Namespace: namespace,
+		Name:      name,
+	})
+}
+
+// recordAudit completes the entry with the outcome of the operation and
+// hands it over to the configured sink, and to the history the dashboard
+// shows. It is meant to be deferred right after the entry is created.
+// Failures which are not returned as an error, like timed out asynchronous
+// operations, are recorded by setting entry.Error beforehand.
+func (b *BrokerLogic) recordAudit(entry *AuditEntry, err *error) {
+	entry.Outcome = auditOutcomeSucceeded
+	if *err != nil {
+		entry.Error = (*err).Error()
+	}
+	if entry.Error != "" {
+		entry.Outcome = auditOutcomeFailed
+	}
+
+	b.history.add(entry)
+
+	if b.Audit == nil {
+		return
+	}
+
+	if err := b.Audit.Record(entry); err != nil {
+		glog.Errorf("failed to record audit entry for %s of instance %s: %v", entry.Operation, entry.InstanceID, err)
+	}
+}
+
+func auditIdentity(o *osb.OriginatingIdentity) *AuditIdentity {
+	if o == nil {
+		return nil
+	}
+
+	a := &AuditIdentity{Platform: o.Platform}
+
+	identity, err := broker.ParseIdentity(*o)
+	if err != nil {
+		glog.Warningf("could not parse originating identity for platform %q: %v", o.Platform, err)
+		return a
+	}
+
+	switch {
+	case identity.Kubernetes != nil:
+		a.Username = identity.Kubernetes.Username
+		a.UID = identity.Kubernetes.UID
+		a.Groups = identity.Kubernetes.Groups
+	case identity.CloudFoundry != nil:
+		a.UID = identity.CloudFoundry.UserID
+	}
+
+	return a
+}
+
+// redactParameters returns a copy of params in which the values of all
+// secret-looking keys are replaced.
+func redactParameters(params map[string]interface{}) map[string]interface{} {
+	if params == nil {
+		return nil
+	}
+
+	redacted := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		if isSensitiveParameter(k) {
+			redacted[k] = redactedValue
+			continue
+		}
+
+		redacted[k] = redactValue(v)
+	}
+
+	return redacted
+}
+
+func redactValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return redactParameters(t)
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i := range t {
+			l[i] = redactValue(t[i])
+		}
+		return l
+	default:
+		return v
+	}
+}
+
+func isSensitiveParameter(key string) bool {
+	k := strings.ToLower(key)
+	for _, s := range sensitiveParameterKeys {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetupAuditSink configures the sink the audit trail is written to. The
+// events sink attaches the events to BrokerLogic.ConfigMap, so this must be
+// called after GetOrCreateConfigMap.
+func (b *BrokerLogic) SetupAuditSink(kind, path string) error {
+	switch kind {
+	case "":
+		b.Audit = nil
+	case auditSinkStdout:
+		b.Audit = &writerAuditSink{w: os.Stdout}
+	case auditSinkFile:
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return fmt.Errorf("error creating audit log directory: %v", err)
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("error opening audit log: %v", err)
+		}
+		b.Audit = &writerAuditSink{w: f, sync: f.Sync}
+	case auditSinkEvents:
+		if b.ConfigMap == nil {
+			return fmt.Errorf("audit sink %q requires the broker configmap", kind)
+		}
+		b.Audit = &eventAuditSink{
+			client: b.Clients.KubeClient,
+			object: v1.ObjectReference{
+				Kind:            "ConfigMap",
+				APIVersion:      "v1",
+				Namespace:       b.ConfigMap.Namespace,
+				Name:            b.ConfigMap.Name,
+				UID:             b.ConfigMap.UID,
+				ResourceVersion: b.ConfigMap.ResourceVersion,
+			},
+		}
+	default:
+		return fmt.Errorf("audit sink %q is invalid", kind)
+	}
+
+	return nil
+}
+
+// writerAuditSink writes each entry as a single line of JSON.
+type writerAuditSink struct {
+	sync.Mutex
+	w io.Writer
+	// sync flushes the written entry to durable storage, if supported.
+	sync func() error
+}
+
+func (s *writerAuditSink) Record(entry *AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	if s.sync != nil {
+		return s.sync()
+	}
+
+	return nil
+}
+
+// eventAuditSink records each entry as a Kubernetes Event.
+type eventAuditSink struct {
+	client kubernetes.Interface
+	object v1.ObjectReference
+}
+
+func (s *eventAuditSink) Record(entry *AuditEntry) error {
+	message, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	eventType := v1.EventTypeNormal
+	if entry.Outcome != auditOutcomeSucceeded {
+		eventType = v1.EventTypeWarning
+	}
+
+	t := metav1.NewTime(entry.Time)
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: fmt.Sprintf("%s-audit-", s.object.Name),
+			Namespace:    s.object.Namespace,
+		},
+		InvolvedObject: s.object,
+		Reason:         auditEventReasons[entry.Operation],
+		Message:        string(message),
+		Type:           eventType,
+		Source: v1.EventSource{
+			Component: "habitat-service-broker",
+		},
+		FirstTimestamp: t,
+		LastTimestamp:  t,
+		Count:          1,
+	}
+
+	_, err = s.client.CoreV1().Events(s.object.Namespace).Create(event)
+	return err
+}
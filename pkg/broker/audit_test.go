@@ -0,0 +1,120 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedactParameters(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]interface{}
+		want   map[string]interface{}
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name:   "empty",
+			params: map[string]interface{}{},
+			want:   map[string]interface{}{},
+		},
+		{
+			name: "sensitive keys",
+			params: map[string]interface{}{
+				"password":    "hunter2",
+				"AdminPasswd": "hunter2",
+				"clientSecret": map[string]interface{}{
+					"value": "hunter2",
+				},
+				"apiToken":     []interface{}{"hunter2"},
+				"credentials":  "hunter2",
+				"ringKey":      "hunter2",
+				"authMode":     "md5",
+				"count":        float64(3),
+				"topology":     "leader",
+				"channel":      "stable",
+				"snapshotFrom": nil,
+			},
+			want: map[string]interface{}{
+				"password":     redactedValue,
+				"AdminPasswd":  redactedValue,
+				"clientSecret": redactedValue,
+				"apiToken":     redactedValue,
+				"credentials":  redactedValue,
+				"ringKey":      redactedValue,
+				"authMode":     redactedValue,
+				"count":        float64(3),
+				"topology":     "leader",
+				"channel":      "stable",
+				"snapshotFrom": nil,
+			},
+		},
+		{
+			name: "nested objects and lists",
+			params: map[string]interface{}{
+				"config": map[string]interface{}{
+					"maxmemory": "1gb",
+					"master": map[string]interface{}{
+						"masterauth": "hunter2",
+					},
+				},
+				"binds": []interface{}{
+					map[string]interface{}{"name": "db", "password": "hunter2"},
+					"cache",
+				},
+			},
+			want: map[string]interface{}{
+				"config": map[string]interface{}{
+					"maxmemory": "1gb",
+					"master": map[string]interface{}{
+						"masterauth": redactedValue,
+					},
+				},
+				"binds": []interface{}{
+					map[string]interface{}{"name": "db", "password": redactedValue},
+					"cache",
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := redactParameters(tt.params); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: redactParameters() = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRedactParametersCopies(t *testing.T) {
+	params := map[string]interface{}{
+		"password": "hunter2",
+		"config":   map[string]interface{}{"requirepass": "hunter2"},
+		"binds":    []interface{}{map[string]interface{}{"token": "hunter2"}},
+	}
+
+	redactParameters(params)
+
+	want := map[string]interface{}{
+		"password": "hunter2",
+		"config":   map[string]interface{}{"requirepass": "hunter2"},
+		"binds":    []interface{}{map[string]interface{}{"token": "hunter2"}},
+	}
+	if !reflect.DeepEqual(params, want) {
+		t.Errorf("redactParameters() changed its argument to %#v", params)
+	}
+}
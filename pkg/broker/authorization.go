@@ -0,0 +1,84 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"net/http"
+
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// authorizeNamespace verifies that the user who originated the request is
+// allowed to create Habitat objects in the given namespace, as the broker
+// itself acts with a cluster-wide role. It's a no-op unless the broker was
+// started with authorization enabled.
+func (b *BrokerLogic) authorizeNamespace(identity *osb.OriginatingIdentity, namespace string) error {
+	if !b.authorize {
+		return nil
+	}
+
+	if identity == nil {
+		return newHTTPStatusCodeError(http.StatusForbidden, "the request has no originating identity")
+	}
+
+	i, err := broker.ParseIdentity(*identity)
+	if err != nil {
+		return newHTTPStatusCodeError(http.StatusForbidden, fmt.Sprintf("could not parse originating identity: %v", err))
+	}
+
+	if i.Kubernetes == nil {
+		return newHTTPStatusCodeError(http.StatusForbidden, fmt.Sprintf("originating identity of platform %q can not be authorized", i.Platform))
+	}
+
+	extra := make(map[string]authorizationv1.ExtraValue, len(i.Kubernetes.Extra))
+	for k, v := range i.Kubernetes.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      "create",
+				Group:     habv1beta1.SchemeGroupVersion.Group,
+				Resource:  habv1beta1.HabitatResourcePlural,
+			},
+			User:   i.Kubernetes.Username,
+			UID:    i.Kubernetes.UID,
+			Groups: i.Kubernetes.Groups,
+			Extra:  extra,
+		},
+	}
+
+	review, err := b.Clients.KubeClient.AuthorizationV1().SubjectAccessReviews().Create(sar)
+	if err != nil {
+		return fmt.Errorf("error reviewing access of user %q: %v", i.Kubernetes.Username, err)
+	}
+
+	if !review.Status.Allowed {
+		msg := fmt.Sprintf("user %q is not allowed to create %s in namespace %q", i.Kubernetes.Username, habv1beta1.HabitatResourcePlural, namespace)
+		if review.Status.Reason != "" {
+			msg = fmt.Sprintf("%s: %s", msg, review.Status.Reason)
+		}
+
+		return newHTTPStatusCodeError(http.StatusForbidden, msg)
+	}
+
+	return nil
+}
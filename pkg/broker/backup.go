@@ -0,0 +1,691 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// BackupTargetPVC keeps backups on a PersistentVolumeClaim in the
+	// namespace of every instance.
+	BackupTargetPVC = "pvc"
+	// BackupTargetS3 uploads backups to a bucket of an S3-compatible
+	// endpoint.
+	BackupTargetS3 = "s3"
+
+	defaultBackupRetention = 7
+
+	// backupLabel marks the CronJob and Jobs of the backups of an instance,
+	// its value is the name of the CronJob.
+	backupLabel = "habitat-osb-backup"
+	// habitatVolumeName is the name of the volume claim template of the
+	// StatefulSets of the habitat-operator. The claims of the pods are
+	// named <volume>-<StatefulSet>-<ordinal>.
+	habitatVolumeName = "persistent"
+
+	backupModeSchedule = "backup"
+	backupModeFinal    = "final"
+	backupModePurge    = "purge"
+
+	// backupScript archives the data directory of the first member of an
+	// Habitat and prunes all but the newest scheduled backups. Backups are
+	// named after their Job, which CronJobs suffix with the scheduled time,
+	// so they sort by age. Other backups are only deleted by a purge.
+	backupScript = `set -eu
+file="$BACKUP_ID.tar.gz"
+pattern='-[0-9]+\.tar\.gz$'
+[ "$MODE" = purge ] && pattern='\.tar\.gz$'
+case "$TARGET" in
+pvc)
+  dir="/backups/$INSTANCE_ID"
+  mkdir -p "$dir"
+  if [ "$MODE" != purge ]; then
+    tar -czf "$dir/.$file" -C /data .
+    mv "$dir/.$file" "$dir/$file"
+  fi
+  ls -1 "$dir" | grep -E -- "$pattern" | sort -r | tail -n +$((KEEP+1)) | while read -r f; do rm -f "$dir/$f"; done
+  ;;
+s3)
+  mc alias set target "$S3_ENDPOINT" "$S3_ACCESS_KEY" "$S3_SECRET_KEY" >/dev/null
+  dir="target/$S3_BUCKET/$INSTANCE_ID"
+  if [ "$MODE" != purge ]; then
+    tar -czf - -C /data . | mc pipe "$dir/$file"
+  fi
+  mc ls "$dir/" | awk '{print $NF}' | grep -E -- "$pattern" | sort -r | tail -n +$((KEEP+1)) | while read -r f; do mc rm "$dir/$f"; done
+  ;;
+esac
+`
+)
+
+// BackupOptions configures where the backups of instances are kept.
+type BackupOptions struct {
+	// Target is BackupTargetPVC or BackupTargetS3. Backups are disabled if
+	// empty.
+	Target string
+	// Image runs the backups. It needs a shell and tar, and the MinIO
+	// client for BackupTargetS3.
+	Image string
+	// PVC is the claim backups are kept on by BackupTargetPVC. It must
+	// exist in the namespace of every instance which is backed up.
+	PVC string
+	// S3Endpoint and S3CredentialsPath configure BackupTargetS3. The
+	// credentials file gives every namespace whose instances may be backed
+	// up a bucket and keys of its own, see LoadS3Credentials.
+	S3Endpoint        string
+	S3CredentialsPath string
+}
+
+// s3Credentials are the bucket the backups of the instances of a namespace
+// are uploaded to, and the keys they're uploaded with. The keys are copied
+// into the namespace, so they must only give access to the bucket.
+type s3Credentials struct {
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+}
+
+func (o *BackupOptions) validate() error {
+	switch o.Target {
+	case "":
+		return nil
+	case BackupTargetPVC:
+		if o.PVC == "" {
+			return fmt.Errorf("backup target %q requires a PVC", o.Target)
+		}
+	case BackupTargetS3:
+		if o.S3Endpoint == "" || o.S3CredentialsPath == "" {
+			return fmt.Errorf("backup target %q requires an endpoint and credentials", o.Target)
+		}
+	default:
+		return fmt.Errorf("backup target %q is invalid", o.Target)
+	}
+
+	if o.Image == "" {
+		return fmt.Errorf("backups need an image to run")
+	}
+
+	return nil
+}
+
+// LoadS3Credentials reads the buckets and keys backups are uploaded with,
+// keyed by namespace. Keys shared by all namespaces are refused, as the
+// instances of one namespace could read and delete the backups of the others
+// with them.
+func LoadS3Credentials(filename string) (map[string]*s3Credentials, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading S3 credentials: %v", err)
+	}
+
+	var file struct {
+		AccessKey  string                    `json:"accessKey"`
+		Namespaces map[string]*s3Credentials `json:"namespaces"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error parsing S3 credentials: %v", err)
+	}
+
+	if file.AccessKey != "" {
+		return nil, fmt.Errorf("S3 credentials in %s are shared by all namespaces, every namespace needs a bucket and keys of its own under namespaces", filename)
+	}
+
+	for namespace, c := range file.Namespaces {
+		if c == nil || c.Bucket == "" || c.AccessKey == "" || c.SecretKey == "" {
+			return nil, fmt.Errorf("S3 credentials of namespace %s in %s need a bucket, an accessKey and a secretKey", namespace, filename)
+		}
+	}
+
+	return file.Namespaces, nil
+}
+
+// backupParameters is the `backup` parameter of an instance.
+type backupParameters struct {
+	schedule  string
+	retention int
+	keepFinal bool
+}
+
+var cronMacros = map[string]struct{}{
+	"@yearly":   {},
+	"@annually": {},
+	"@monthly":  {},
+	"@weekly":   {},
+	"@daily":    {},
+	"@midnight": {},
+	"@hourly":   {},
+}
+
+// getBackup reads the `backup` parameter. A null parameter disables
+// backups, which is reported as nil, like a missing one.
+func getBackup(params map[string]interface{}) (*backupParameters, error) {
+	v, ok := params["backup"]
+	if !ok || v == nil {
+		return nil, nil
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "backup must be an object")
+	}
+
+	backup := &backupParameters{retention: defaultBackupRetention}
+
+	schedule, ok := m["schedule"].(string)
+	if !ok {
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("backup schedule %v is invalid", m["schedule"]))
+	}
+	if _, macro := cronMacros[schedule]; !macro && len(strings.Fields(schedule)) != 5 {
+		msg := fmt.Sprintf("backup schedule %q is no cron expression of five fields", schedule)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, msg)
+	}
+	backup.schedule = schedule
+
+	if r, ok := m["retention"]; ok {
+		f, ok := r.(float64)
+		if !ok || f < 1 || f != float64(int32(f)) {
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("backup retention %v must be a positive number", r))
+		}
+		backup.retention = int(f)
+	}
+
+	if k, ok := m["keepFinal"]; ok {
+		if backup.keepFinal, ok = k.(bool); !ok {
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("backup keepFinal %v must be a boolean", k))
+		}
+	}
+
+	return backup, nil
+}
+
+// backupName returns the name of the CronJob, and of the secret with the S3
+// bucket and credentials, of the backups of an instance. CronJobs may be named with at
+// most 52 characters, so the ID is always hashed.
+func backupName(instanceID string) string {
+	sum := sha256.Sum256([]byte(instanceID))
+	return "habitat-osb-backup-" + hex.EncodeToString(sum[:])[:idHashLength]
+}
+
+// verifyBackupTarget checks that the instances of the namespace can keep
+// backups in the target.
+func (b *BrokerLogic) verifyBackupTarget(namespace string) error {
+	if b.backup.Target == "" {
+		return newHTTPStatusCodeError(http.StatusBadRequest, "backups are not enabled on this broker")
+	}
+
+	if b.backup.Target == BackupTargetS3 && b.s3Credentials[namespace] == nil {
+		msg := fmt.Sprintf("backups are not enabled for namespace %s, the broker has no S3 bucket for it", namespace)
+		return newHTTPStatusCodeError(http.StatusBadRequest, msg)
+	}
+
+	return nil
+}
+
+// verifyBackupable checks that backups can be taken of the Habitat in the
+// namespace.
+func (b *BrokerLogic) verifyBackupable(hab *habv1beta1.Habitat, namespace string) error {
+	if err := b.verifyBackupTarget(namespace); err != nil {
+		return err
+	}
+
+	if hab.Spec.V1beta2.PersistentStorage == nil {
+		msg := fmt.Sprintf("%s keeps no data on a persistent volume, which could be backed up", hab.Name)
+		return newHTTPStatusCodeError(http.StatusBadRequest, msg)
+	}
+
+	return nil
+}
+
+// backupJobSpec returns the Job which backs up the Habitat of an instance.
+// It mounts the claim of the first member, so it runs on its node.
+func (b *BrokerLogic) backupJobSpec(hab *habv1beta1.Habitat, instanceID, mode string, keep int) batchv1.JobSpec {
+	name := backupName(instanceID)
+	backoffLimit := int32(2)
+
+	env := []v1.EnvVar{
+		{Name: "TARGET", Value: b.backup.Target},
+		{Name: "INSTANCE_ID", Value: instanceID},
+		{Name: "MODE", Value: mode},
+		{Name: "KEEP", Value: strconv.Itoa(keep)},
+		{
+			Name: "BACKUP_ID",
+			ValueFrom: &v1.EnvVarSource{
+				FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.labels['job-name']"},
+			},
+		},
+	}
+
+	volumes := []v1.Volume{
+		{
+			Name: "data",
+			VolumeSource: v1.VolumeSource{
+				PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+					ClaimName: memberClaimName(hab.Name, 0),
+					ReadOnly:  true,
+				},
+			},
+		},
+	}
+	mounts := []v1.VolumeMount{{Name: "data", MountPath: "/data", ReadOnly: true}}
+
+	switch b.backup.Target {
+	case BackupTargetPVC:
+		volumes = append(volumes, v1.Volume{
+			Name: "backups",
+			VolumeSource: v1.VolumeSource{
+				PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: b.backup.PVC},
+			},
+		})
+		mounts = append(mounts, v1.VolumeMount{Name: "backups", MountPath: "/backups"})
+	case BackupTargetS3:
+		env = append(env,
+			v1.EnvVar{Name: "S3_ENDPOINT", Value: b.backup.S3Endpoint},
+			secretEnvVar("S3_BUCKET", name, "bucket"),
+			secretEnvVar("S3_ACCESS_KEY", name, "accessKey"),
+			secretEnvVar("S3_SECRET_KEY", name, "secretKey"),
+		)
+	}
+
+	return batchv1.JobSpec{
+		BackoffLimit: &backoffLimit,
+		Template: v1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: map[string]string{backupLabel: name},
+			},
+			Spec: v1.PodSpec{
+				RestartPolicy: v1.RestartPolicyNever,
+				Containers: []v1.Container{
+					{
+						Name:         "backup",
+						Image:        b.backup.Image,
+						Command:      []string{"/bin/sh", "-c", backupScript},
+						Env:          env,
+						VolumeMounts: mounts,
+					},
+				},
+				Volumes: volumes,
+				// A ReadWriteOnce claim can only be mounted on the node of
+				// the pod which uses it.
+				Affinity: &v1.Affinity{
+					PodAffinity: &v1.PodAffinity{
+						RequiredDuringSchedulingIgnoredDuringExecution: []v1.PodAffinityTerm{
+							{
+								LabelSelector: &metav1.LabelSelector{
+									MatchLabels: map[string]string{"statefulset.kubernetes.io/pod-name": hab.Name + "-0"},
+								},
+								TopologyKey: "kubernetes.io/hostname",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func secretEnvVar(name, secretName, key string) v1.EnvVar {
+	return v1.EnvVar{
+		Name: name,
+		ValueFrom: &v1.EnvVarSource{
+			SecretKeyRef: &v1.SecretKeySelector{
+				LocalObjectReference: v1.LocalObjectReference{Name: secretName},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+// ensureBackups creates or updates the CronJob which backs up an instance
+// on its schedule. It keeps as many Jobs as backups, which are the history
+// of the backups.
+func (b *BrokerLogic) ensureBackups(hab *habv1beta1.Habitat, namespace, instanceID string, backup *backupParameters, entry *AuditEntry) error {
+	name := backupName(instanceID)
+
+	if b.backup.Target == BackupTargetS3 {
+		if err := b.ensureS3Secret(namespace, instanceID, entry); err != nil {
+			return err
+		}
+	}
+
+	retention := int32(backup.retention)
+	failed := int32(1)
+	labels := instanceLabels(instanceID)
+	labels[backupLabel] = name
+
+	cronJob := &batchv1beta1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Spec: batchv1beta1.CronJobSpec{
+			Schedule:                   backup.schedule,
+			ConcurrencyPolicy:          batchv1beta1.ForbidConcurrent,
+			SuccessfulJobsHistoryLimit: &retention,
+			FailedJobsHistoryLimit:     &failed,
+			JobTemplate: batchv1beta1.JobTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       b.backupJobSpec(hab, instanceID, backupModeSchedule, backup.retention),
+			},
+		},
+	}
+
+	cronJobs := b.Clients.KubeClient.BatchV1beta1().CronJobs(namespace)
+	current, err := cronJobs.Get(name, metav1.GetOptions{})
+	if k8sErrors.IsNotFound(err) {
+		if _, err := cronJobs.Create(cronJob); err != nil {
+			return fmt.Errorf("error creating CronJob %s: %v", name, err)
+		}
+		entry.created("CronJob", namespace, name)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error getting CronJob %s: %v", name, err)
+	}
+
+	current.Labels = cronJob.Labels
+	current.Spec = cronJob.Spec
+	if _, err := cronJobs.Update(current); err != nil {
+		return fmt.Errorf("error updating CronJob %s: %v", name, err)
+	}
+	entry.updated("CronJob", namespace, name)
+
+	return nil
+}
+
+// ensureS3Secret writes the secret with the S3 bucket and credentials of the
+// namespace, which the Jobs of an instance run with.
+func (b *BrokerLogic) ensureS3Secret(namespace, instanceID string, entry *AuditEntry) error {
+	c := b.s3Credentials[namespace]
+	if c == nil {
+		return fmt.Errorf("the broker has no S3 bucket for namespace %s", namespace)
+	}
+
+	name := backupName(instanceID)
+	data := map[string][]byte{
+		"bucket":    []byte(c.Bucket),
+		"accessKey": []byte(c.AccessKey),
+		"secretKey": []byte(c.SecretKey),
+	}
+	if _, err := b.createSecret(name, namespace, instanceLabels(instanceID), data); err != nil {
+		return err
+	}
+	entry.updated("Secret", namespace, name)
+
+	return nil
+}
+
+// removeBackups stops backing up an instance. The backups taken so far are
+// left in the target.
+func (b *BrokerLogic) removeBackups(namespace, instanceID string, entry *AuditEntry) error {
+	name := backupName(instanceID)
+	propagation := metav1.DeletePropagationBackground
+
+	err := b.Clients.KubeClient.BatchV1beta1().CronJobs(namespace).Delete(name, &metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err == nil {
+		entry.deleted("CronJob", namespace, name)
+	} else if !k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting CronJob %s: %v", name, err)
+	}
+
+	if err := b.deleteSecret(name, namespace); err == nil {
+		entry.deleted("Secret", namespace, name)
+	} else if !k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting secret: %v", err)
+	}
+
+	return nil
+}
+
+// finalBackupName returns the name of the Job which takes the final backup
+// of an instance, or purges its backups, at deprovision.
+func finalBackupName(instanceID string) string {
+	return backupName(instanceID) + "-" + backupModeFinal
+}
+
+// startFinalBackup starts the Job which runs before an instance with backups
+// is deprovisioned. It takes a last backup and prunes all scheduled ones if
+// the instance keeps its final backup, or else purges all of its backups.
+func (b *BrokerLogic) startFinalBackup(hab *habv1beta1.Habitat, namespace, instanceID string, backup *backupParameters, entry *AuditEntry) error {
+	mode := backupModePurge
+	if backup.keepFinal {
+		mode = backupModeFinal
+	}
+
+	name := finalBackupName(instanceID)
+	labels := instanceLabels(instanceID)
+	labels[backupLabel] = backupName(instanceID)
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Spec: b.backupJobSpec(hab, instanceID, mode, 0),
+	}
+
+	_, err := b.Clients.KubeClient.BatchV1().Jobs(namespace).Create(job)
+	if k8sErrors.IsAlreadyExists(err) {
+		// A previous deprovision failed, its Job is replaced.
+		if err := b.deleteJob(name, namespace, entry); err != nil {
+			return err
+		}
+		_, err = b.Clients.KubeClient.BatchV1().Jobs(namespace).Create(job)
+	}
+	if err != nil {
+		return fmt.Errorf("error creating Job %s: %v", name, err)
+	}
+	entry.created("Job", namespace, name)
+
+	return nil
+}
+
+// BackupStatus is a backup of an instance, as reported by its Job.
+type BackupStatus struct {
+	ID        string     `json:"id"`
+	Location  string     `json:"location"`
+	State     string     `json:"state"`
+	Started   *time.Time `json:"started,omitempty"`
+	Completed *time.Time `json:"completed,omitempty"`
+}
+
+// backupLocation returns where the backup with the given ID of an instance
+// in the namespace is kept.
+func (b *BrokerLogic) backupLocation(namespace, instanceID, backupID string) string {
+	switch b.backup.Target {
+	case BackupTargetPVC:
+		return fmt.Sprintf("pvc://%s/%s/%s.tar.gz", b.backup.PVC, instanceID, backupID)
+	case BackupTargetS3:
+		if c := b.s3Credentials[namespace]; c != nil {
+			return fmt.Sprintf("s3://%s/%s/%s.tar.gz", c.Bucket, instanceID, backupID)
+		}
+	}
+	return ""
+}
+
+// listBackups returns the backups of an instance whose Jobs are kept, the
+// latest first.
+func (b *BrokerLogic) listBackups(namespace, instanceID string) ([]BackupStatus, error) {
+	selector := labels.SelectorFromSet(labels.Set{backupLabel: backupName(instanceID)})
+	jobs, err := b.Clients.KubeClient.BatchV1().Jobs(namespace).List(metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing backup Jobs: %v", err)
+	}
+
+	sort.Slice(jobs.Items, func(i, j int) bool {
+		return jobs.Items[i].CreationTimestamp.After(jobs.Items[j].CreationTimestamp.Time)
+	})
+
+	var backups []BackupStatus
+	for _, job := range jobs.Items {
+		backup := BackupStatus{
+			ID:       job.Name,
+			Location: b.backupLocation(namespace, instanceID, job.Name),
+			State:    string(osb.StateInProgress),
+		}
+		if job.Status.StartTime != nil {
+			started := job.Status.StartTime.Time
+			backup.Started = &started
+		}
+
+		if failed, _ := jobFailed(&job); failed {
+			backup.State = string(osb.StateFailed)
+		} else if job.Status.Succeeded > 0 {
+			backup.State = string(osb.StateSucceeded)
+			if job.Status.CompletionTime != nil {
+				completed := job.Status.CompletionTime.Time
+				backup.Completed = &completed
+			}
+		}
+
+		backups = append(backups, backup)
+	}
+
+	return backups, nil
+}
+
+// jobFailed reports whether the Job failed, and why.
+func jobFailed(job *batchv1.Job) (bool, string) {
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == v1.ConditionTrue {
+			return true, c.Message
+		}
+	}
+	return false, ""
+}
+
+// updateBackups applies the `backup` parameter of an update, which may also
+// stop the backups of an instance.
+func (b *BrokerLogic) updateBackups(instanceID, name, namespace string, params map[string]interface{}, entry *AuditEntry) error {
+	backup, err := getBackup(params)
+	if err != nil {
+		return err
+	}
+
+	if backup == nil {
+		return b.removeBackups(namespace, instanceID, entry)
+	}
+
+	hab, err := b.GetHabitat(name, namespace)
+	if err != nil {
+		return err
+	}
+
+	if err := b.verifyBackupable(hab, namespace); err != nil {
+		return err
+	}
+
+	return b.ensureBackups(hab, namespace, instanceID, backup, entry)
+}
+
+// deprovisionBackedUp starts the deprovision of an instance which is backed
+// up, which the platform polls until the final backup is done. Repeated
+// requests wait for the deprovision which is already in progress.
+func (b *BrokerLogic) deprovisionBackedUp(instanceID string, state *instanceState, backup *backupParameters, entry *AuditEntry) error {
+	if state.Operation != nil && state.Operation.Type == operationDeprovision {
+		return nil
+	}
+
+	name, err := habitatName(state.PlanID, state.Parameters)
+	if err != nil {
+		return err
+	}
+
+	hab, err := b.GetHabitat(name, state.Namespace)
+	if err != nil {
+		return err
+	}
+
+	if err := b.startFinalBackup(hab, state.Namespace, instanceID, backup, entry); err != nil {
+		return err
+	}
+
+	state.Operation = newOperationState(operationDeprovision)
+	return b.setInstanceState(instanceID, state)
+}
+
+// deprovisionLastOperation reports the progress of the final backup of an
+// instance which is being deprovisioned, and deletes the instance once the
+// backup is done. If it fails, the instance is kept, so the deprovision can
+// be retried.
+func (b *BrokerLogic) deprovisionLastOperation(request *osb.LastOperationRequest, state *instanceState) (_ *broker.LastOperationResponse, err error) {
+	response := &broker.LastOperationResponse{}
+	response.State = osb.StateInProgress
+
+	done, failure, err := b.jobDone(finalBackupName(request.InstanceID), state.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if !done && time.Since(state.Operation.Started) < operationTimeout {
+		description := "taking the final backup"
+		response.Description = &description
+		return response, nil
+	}
+
+	entry := newAuditEntry(operationDeprovision, request.InstanceID, state.ServiceID, state.PlanID, request.OriginatingIdentity, nil)
+	defer b.recordAudit(entry, &err)
+
+	if err := b.deleteJob(finalBackupName(request.InstanceID), state.Namespace, entry); err != nil {
+		return nil, err
+	}
+
+	if !done || failure != "" {
+		description := fmt.Sprintf("the final backup failed: %s", failure)
+		if !done {
+			description = fmt.Sprintf("the final backup timed out after %v", operationTimeout)
+		}
+		entry.Error = description
+		response.State = osb.StateFailed
+		response.Description = &description
+
+		state.Operation = nil
+		return response, b.setInstanceState(request.InstanceID, state)
+	}
+
+	reclaiming, err := b.deleteResources(state.PlanID, request.InstanceID, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if reclaiming {
+		description := "deleting volumes, secrets and services"
+		response.Description = &description
+		return response, nil
+	}
+
+	response.State = osb.StateSucceeded
+	return response, nil
+}
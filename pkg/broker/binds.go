@@ -0,0 +1,143 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"net/http"
+
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+)
+
+// bindParameter is an entry of the `binds` parameter. It binds the bind name
+// of the provisioned service to another instance, referenced by its ID or
+// the name of its Habitat.
+type bindParameter struct {
+	name     string
+	instance string
+}
+
+func getBinds(params map[string]interface{}) ([]bindParameter, error) {
+	b, ok := params["binds"]
+	if !ok {
+		return nil, nil
+	}
+
+	list, ok := b.([]interface{})
+	if !ok {
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "binds must be a list")
+	}
+
+	binds := make([]bindParameter, 0, len(list))
+	seen := map[string]struct{}{}
+
+	for i, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("bind %d must be an object", i))
+		}
+
+		name, _ := m["name"].(string)
+		instance, _ := m["instance"].(string)
+		if name == "" || instance == "" {
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("bind %d needs a name and an instance", i))
+		}
+
+		if _, ok := seen[name]; ok {
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("bind %q is given more than once", name))
+		}
+		seen[name] = struct{}{}
+
+		binds = append(binds, bindParameter{
+			name:     name,
+			instance: instance,
+		})
+	}
+
+	return binds, nil
+}
+
+// resolveBinds translates the binds of an instance into Habitat binds. The
+// referenced instances must be managed by the broker and gossip in the same
+// namespace and ring.
+func (b *BrokerLogic) resolveBinds(instanceID, namespace, ring string, binds []bindParameter) ([]habv1beta1.Bind, error) {
+	if len(binds) == 0 {
+		return nil, nil
+	}
+
+	states, err := b.listInstanceStates()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []habv1beta1.Bind
+
+	for _, bind := range binds {
+		// IDs take precedence over Habitat names.
+		foundID := bind.instance
+		found, ok := states[foundID]
+		if !ok {
+			for id, s := range states {
+				name, err := habitatName(s.PlanID, s.Parameters)
+				if err != nil {
+					return nil, err
+				}
+
+				if s.Namespace == namespace && name == bind.instance {
+					foundID, found = id, s
+					break
+				}
+			}
+		}
+
+		if found == nil {
+			msg := fmt.Sprintf("bind %q references instance %q, which does not exist", bind.name, bind.instance)
+			return nil, newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+		}
+
+		if foundID == instanceID {
+			msg := fmt.Sprintf("bind %q references the instance itself", bind.name)
+			return nil, newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+		}
+
+		if found.Namespace != namespace {
+			msg := fmt.Sprintf("bind %q references instance %q in namespace %q, but binds only work within namespace %q", bind.name, bind.instance, found.Namespace, namespace)
+			return nil, newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+		}
+
+		if found.Ring != ring {
+			msg := fmt.Sprintf("bind %q references instance %q, which gossips in another ring", bind.name, bind.instance)
+			return nil, newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+		}
+
+		service, err := habitatName(found.PlanID, found.Parameters)
+		if err != nil {
+			return nil, err
+		}
+
+		group, err := getGroup(found.Parameters)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, habv1beta1.Bind{
+			Name:    bind.name,
+			Service: service,
+			Group:   group,
+		})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// supervisorHTTPPort is the port of the HTTP gateway of the Supervisor.
+	supervisorHTTPPort = 9631
+
+	packageQueryTimeout = 5 * time.Second
+)
+
+// planChannels are the Builder channels the plans follow, unless the
+// `channel` parameter selects another one.
+var planChannels = map[string]string{
+	"002341cf-f895-49f4-ba04-bb70291b895c": "stable",
+	"86064792-7ea2-467b-af93-ac9694d96d5b": "stable",
+	"9d702792-2f55-4b45-83b7-f3ba0c689cd3": "stable",
+	"6d537324-c8b6-489d-b6b9-f4495a87abbd": "stable",
+	"0a5b3c1e-43a2-4c55-9e3b-6f0d2b8e7a14": "stable",
+	"c1d9e0f4-7b26-4f1a-a5d8-3e2b9c4f6d07": "stable",
+	"5e8b1f3a-9c47-4d2e-b6a1-7d0c3f9e2a58": "stable",
+	"b4c2d7e9-1a3f-4b8c-9e5d-2f6a8c0b1d43": "stable",
+}
+
+var channelRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+func getChannel(planID string, params map[string]interface{}) (string, error) {
+	c, ok := params["channel"]
+	if !ok {
+		return planChannels[planID], nil
+	}
+
+	s, ok := c.(string)
+	if !ok || !channelRegexp.MatchString(s) {
+		return "", newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("channel %v is invalid", c))
+	}
+
+	return s, nil
+}
+
+// PackageIdent is the fully qualified identifier of a Habitat package.
+type PackageIdent struct {
+	Origin  string `json:"origin"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Release string `json:"release"`
+}
+
+func parsePackageIdent(s string) (*PackageIdent, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("package ident %q is not fully qualified", s)
+	}
+
+	return &PackageIdent{
+		Origin:  parts[0],
+		Name:    parts[1],
+		Version: parts[2],
+		Release: parts[3],
+	}, nil
+}
+
+func (i *PackageIdent) String() string {
+	return strings.Join([]string{i.Origin, i.Name, i.Version, i.Release}, "/")
+}
+
+// newerThan compares the releases of two builds, which are timestamps of a
+// fixed length.
+func (i *PackageIdent) newerThan(other *PackageIdent) bool {
+	return i.Release > other.Release
+}
+
+// runningPackage asks the Supervisor of a running pod of the Habitat which
+// build of the package it runs.
+func (b *BrokerLogic) runningPackage(name, namespace string) (*PackageIdent, error) {
+	selector := labels.SelectorFromSet(labels.Set{habv1beta1.HabitatNameLabel: name})
+	pods, err := b.Clients.KubeClient.CoreV1().Pods(namespace).List(metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing pods of Habitat %s: %v", name, err)
+	}
+
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != v1.PodRunning || pod.Status.PodIP == "" {
+			continue
+		}
+
+		var services []struct {
+			Pkg struct {
+				Ident string `json:"ident"`
+			} `json:"pkg"`
+		}
+
+		u := fmt.Sprintf("http://%s:%d/services", pod.Status.PodIP, supervisorHTTPPort)
+		if err := getJSON(u, &services); err != nil {
+			return nil, fmt.Errorf("error querying the Supervisor of pod %s: %v", pod.Name, err)
+		}
+
+		for _, s := range services {
+			ident, err := parsePackageIdent(s.Pkg.Ident)
+			if err != nil {
+				return nil, err
+			}
+
+			if ident.Name == name {
+				return ident, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no running Supervisor of Habitat %s runs the package", name)
+}
+
+// latestPackage asks Builder for the latest build of the package in the
+// channel.
+func (b *BrokerLogic) latestPackage(origin, name, channel string) (*PackageIdent, error) {
+	u := fmt.Sprintf("%s/v1/depot/channels/%s/%s/pkgs/%s/latest",
+		b.builderURL, url.PathEscape(origin), url.PathEscape(channel), url.PathEscape(name))
+
+	var pkg struct {
+		Ident PackageIdent `json:"ident"`
+	}
+	if err := getJSON(u, &pkg); err != nil {
+		return nil, fmt.Errorf("error querying Builder: %v", err)
+	}
+
+	return &pkg.Ident, nil
+}
+
+func getJSON(u string, v interface{}) error {
+	client := &http.Client{Timeout: packageQueryTimeout}
+
+	resp, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", u, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// addPackageStatus reports the build of the package an instance runs, and
+// whether a newer one is available in its channel. Failures only leave the
+// fields out, as they don't affect the instance itself.
+func (b *BrokerLogic) addPackageStatus(response *GetInstanceResponse, name, namespace, channel string) {
+	running, err := b.runningPackage(name, namespace)
+	if err != nil {
+		glog.Warningf("error getting package of Habitat %s in namespace %s: %v", name, namespace, err)
+		return
+	}
+	response.PackageIdent = running.String()
+
+	if b.builderURL == "" || channel == "" {
+		return
+	}
+
+	latest, err := b.latestPackage(running.Origin, running.Name, channel)
+	if err != nil {
+		glog.Warningf("error getting latest package of Habitat %s in channel %s: %v", name, channel, err)
+		return
+	}
+	response.LatestPackageIdent = latest.String()
+	response.UpdateAvailable = latest.newerThan(running)
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/habitat-sh/habitat-service-broker/test/standin/builder"
+)
+
+func TestLatestPackage(t *testing.T) {
+	handler, err := builder.NewHandler(map[string][]string{
+		"stable": {
+			"core/redis/4.0.10/20180801002029",
+		},
+		"unstable": {
+			"core/redis/4.0.10/20180801002029",
+			"core/redis/4.0.14/20190319155852",
+			"core/nginx/1.15.6/20181212185120",
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewHandler() error = %v", err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	b := &BrokerLogic{builderURL: server.URL}
+
+	tests := []struct {
+		origin  string
+		name    string
+		channel string
+		want    string
+		wantErr bool
+	}{
+		{origin: "core", name: "redis", channel: "stable", want: "core/redis/4.0.10/20180801002029"},
+		{origin: "core", name: "redis", channel: "unstable", want: "core/redis/4.0.14/20190319155852"},
+		{origin: "core", name: "nginx", channel: "stable", wantErr: true},
+		{origin: "myorigin", name: "redis", channel: "unstable", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := b.latestPackage(tt.origin, tt.name, tt.channel)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("latestPackage(%s, %s, %s) error = %v, want error %v", tt.origin, tt.name, tt.channel, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got.String() != tt.want {
+			t.Errorf("latestPackage(%s, %s, %s) = %s, want %s", tt.origin, tt.name, tt.channel, got, tt.want)
+		}
+	}
+}
+
+func TestPackageIdentNewerThan(t *testing.T) {
+	tests := []struct {
+		ident string
+		other string
+		want  bool
+	}{
+		{ident: "core/redis/4.0.14/20190319155852", other: "core/redis/4.0.10/20180801002029", want: true},
+		{ident: "core/redis/4.0.10/20180801002029", other: "core/redis/4.0.14/20190319155852", want: false},
+		{ident: "core/redis/4.0.10/20180801002029", other: "core/redis/4.0.10/20180801002029", want: false},
+	}
+
+	for _, tt := range tests {
+		ident, err := parsePackageIdent(tt.ident)
+		if err != nil {
+			t.Fatalf("parsePackageIdent(%q) error = %v", tt.ident, err)
+		}
+		other, err := parsePackageIdent(tt.other)
+		if err != nil {
+			t.Fatalf("parsePackageIdent(%q) error = %v", tt.other, err)
+		}
+
+		if got := ident.newerThan(other); got != tt.want {
+			t.Errorf("%s newerThan %s = %v, want %v", tt.ident, tt.other, got, tt.want)
+		}
+	}
+}
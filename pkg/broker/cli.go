@@ -16,12 +16,38 @@ package broker
 
 import (
 	"flag"
+	"time"
 )
 
 // Options holds the options specified by on the command line.
 type Options struct {
-	CatalogPath string
-	Async       bool
+	CatalogPath       string
+	Async             bool
+	AuthorizeRequests bool
+	AuditSink         string
+	AuditLogPath      string
+	PolicyPath        string
+	Platform          PlatformOptions
+	Backup            BackupOptions
+	Snapshot          SnapshotOptions
+	AdminTokenPath    string
+
+	PlanConfigDefaultsPath string
+	PlanEnvAllowlistPath   string
+	PlanReclaimPolicyPath  string
+	DashboardURL           string
+	DashboardKeyPath       string
+	BuilderURL             string
+	HabitatSpec            string
+	PackageOrigins         string
+	PackageImageTemplate   string
+
+	CredentialPolicyPath     string
+	CredentialStoreURL       string
+	CredentialStoreTokenPath string
+
+	CredentialRotationInterval    time.Duration
+	CredentialRotationGracePeriod time.Duration
 }
 
 // AddFlags is a hook called to initialize the CLI flags for the broker options, it
@@ -30,4 +56,34 @@ type Options struct {
 func AddFlags(o *Options) {
 	flag.StringVar(&o.CatalogPath, "catalogPath", "", "The path to the catalog")
 	flag.BoolVar(&o.Async, "async", false, "Indicates whether the broker is handling the requests asynchronously.")
+	flag.BoolVar(&o.AuthorizeRequests, "authorizeRequests", false, "Indicates whether provision requests are authorized against the originating Kubernetes identity.")
+	flag.StringVar(&o.AuditSink, "auditSink", "", "The sink the audit trail of lifecycle operations is written to: \"stdout\", \"file\" or \"events\". Auditing is disabled if empty.")
+	flag.StringVar(&o.AuditLogPath, "auditLogPath", "/var/log/habitat-service-broker/audit.log", "The path to the JSON lines file used by the \"file\" audit sink.")
+	flag.StringVar(&o.PolicyPath, "policyPath", "", "The path to the YAML or JSON file with the namespace and quota policy. Everything is allowed if empty.")
+	flag.StringVar(&o.Platform.NamespaceStrategy, "platformNamespaceStrategy", NamespaceStrategySpace, "How Cloud Foundry contexts are mapped to namespaces: \"space\", \"organization\" or \"fixed\".")
+	flag.StringVar(&o.Platform.Namespace, "platformNamespace", "", "The namespace used by the \"fixed\" strategy and for contexts without a namespace or Cloud Foundry GUIDs.")
+	flag.StringVar(&o.Platform.NamespacePrefix, "platformNamespacePrefix", "cf-", "The prefix of namespaces named after a Cloud Foundry space or organization GUID.")
+	flag.BoolVar(&o.Platform.CreateNamespaces, "createPlatformNamespaces", true, "Indicates whether namespaces of Cloud Foundry spaces or organizations are created if missing.")
+	flag.StringVar(&o.Backup.Target, "backupTarget", "", "Where the backups of instances are kept: \"pvc\" or \"s3\". Backups are disabled if empty.")
+	flag.StringVar(&o.Backup.Image, "backupImage", "minio/mc:latest", "The image backups run in. It needs a shell and tar, and the MinIO client for the \"s3\" target.")
+	flag.StringVar(&o.Backup.PVC, "backupPVC", "habitat-backups", "The PersistentVolumeClaim the \"pvc\" target keeps backups on. It must exist in the namespace of every instance which is backed up.")
+	flag.StringVar(&o.Backup.S3Endpoint, "backupS3Endpoint", "", "The URL of the S3-compatible endpoint of the \"s3\" target.")
+	flag.StringVar(&o.Backup.S3CredentialsPath, "backupS3CredentialsPath", "", "The path to the YAML or JSON file with the bucket, accessKey and secretKey of every namespace, under namespaces, of the \"s3\" target.")
+	flag.StringVar(&o.Snapshot.Class, "snapshotClass", "", "The VolumeSnapshotClass snapshots of instances are taken with. The default class of the cluster is used if empty.")
+	flag.BoolVar(&o.Snapshot.BeforeChanges, "snapshotBeforeChanges", false, "Indicates whether a snapshot of every persistent instance is taken before it's updated or deprovisioned. It's skipped if the cluster serves no VolumeSnapshot API.")
+	flag.StringVar(&o.PlanConfigDefaultsPath, "planConfigDefaultsPath", "", "The path to the YAML or JSON file with the default Habitat config of every plan, keyed by plan ID.")
+	flag.StringVar(&o.PlanEnvAllowlistPath, "planEnvAllowlistPath", "", "The path to the YAML or JSON file with the environment variables every plan may set, keyed by plan ID. Plans which are not listed may set HAB_* variables.")
+	flag.StringVar(&o.PlanReclaimPolicyPath, "planReclaimPolicyPath", "", "The path to the YAML or JSON file with the reclaim policy of every plan, \"retain\" or \"delete\", keyed by plan ID. Plans which are not listed retain the volumes of their instances.")
+	flag.StringVar(&o.DashboardURL, "dashboardURL", "", "The external URL of the broker, under which the status pages of instances are served. The dashboard is disabled if empty.")
+	flag.StringVar(&o.DashboardKeyPath, "dashboardKeyPath", "", "The path to the file with the key the tokens of dashboard URLs are signed with.")
+	flag.StringVar(&o.HabitatSpec, "habitatSpec", "", "The spec of the Habitats the habitat-operator understands, either \"v1beta1\" or \"v1beta2\". It's detected from the CustomResourceDefinition of the habitat-operator if empty.")
+	flag.StringVar(&o.BuilderURL, "builderURL", "", "The URL of the Builder API which is checked for newer builds of the packages of instances, such as https://bldr.habitat.sh. No check is done if empty.")
+	flag.StringVar(&o.PackageOrigins, "packageOrigins", "core", "The comma separated origins whose packages may be provisioned through the habitat-package service. No package may be provisioned if empty.")
+	flag.StringVar(&o.PackageImageTemplate, "packageImageTemplate", DefaultPackageImageTemplate, "The Go template the images of packages provisioned through the habitat-package service are named with. It's given the Origin, Name, Version, Release and Tag of the package.")
+	flag.StringVar(&o.AdminTokenPath, "adminTokenPath", "", "The path to the file with the bearer token of the admin API. The admin API is disabled if empty.")
+	flag.StringVar(&o.CredentialPolicyPath, "credentialPolicyPath", "", "The path to the YAML or JSON file with the length, alphabet and minimum entropy of generated passwords per service.")
+	flag.StringVar(&o.CredentialStoreURL, "credentialStoreURL", "", "The base URL of an HTTP key-value store, like the Consul KV store, generated credentials are copied to.")
+	flag.StringVar(&o.CredentialStoreTokenPath, "credentialStoreTokenPath", "", "The path to the file with the bearer token of the credential store.")
+	flag.DurationVar(&o.CredentialRotationInterval, "credentialRotationInterval", 0, "How often the credentials of bindings are rotated. Credentials are only rotated through the admin API if 0.")
+	flag.DurationVar(&o.CredentialRotationGracePeriod, "credentialRotationGracePeriod", time.Hour, "How long both the old and the new credentials are valid after a rotation.")
 }
@@ -0,0 +1,316 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ghodss/yaml"
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// userTOMLKey holds the composed config, which the Supervisor applies
+	// on top of the default.toml of the package.
+	userTOMLKey = "user.toml"
+	// credentialsTOMLKey holds the credentials layer, so that it survives
+	// re-rendering the composed config.
+	credentialsTOMLKey = "credentials.toml"
+)
+
+// managedConfigKeys are the config keys of every service which the broker
+// sets itself, and which the `config` parameter must not contain. Keys of
+// nested tables are given as dotted paths.
+var managedConfigKeys = map[string][]string{
+	"nginx":      {"upstreams"},
+	"redis":      {"requirepass", "masterauth"},
+	"postgresql": {"superuser", "replication"},
+	"rabbitmq":   {"rabbitmq.default_user", "rabbitmq.default_pass", "erlang_cookie"},
+	"mongodb":    {"admin", "keyfile", "replica_set_name"},
+}
+
+// LoadPlanConfigDefaults reads the default config of every plan, keyed by
+// plan ID, from the YAML or JSON file at the given path.
+func LoadPlanConfigDefaults(path string) (map[string]map[string]interface{}, error) {
+	defaults := map[string]map[string]interface{}{}
+	if path == "" {
+		return defaults, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading plan config defaults: %v", err)
+	}
+
+	if err := yaml.Unmarshal(data, &defaults); err != nil {
+		return nil, fmt.Errorf("error parsing plan config defaults: %v", err)
+	}
+
+	for planID, config := range defaults {
+		config = wholeNumbers(config).(map[string]interface{})
+		defaults[planID] = config
+
+		name := packageServiceName
+		if planID != habitatPackagePlanID {
+			var err error
+			if name, _, err = matchService(planID); err != nil {
+				return nil, fmt.Errorf("plan config defaults of plan %q are invalid: %v", planID, err)
+			}
+		}
+
+		if err := validateConfig(name, config); err != nil {
+			return nil, fmt.Errorf("plan config defaults of plan %q are invalid: %v", planID, err)
+		}
+	}
+
+	return defaults, nil
+}
+
+// getConfig returns the `config` parameter, which is either a JSON object or
+// a string holding TOML.
+func getConfig(service string, params map[string]interface{}) (map[string]interface{}, error) {
+	c, ok := params["config"]
+	if !ok {
+		return nil, nil
+	}
+
+	var config map[string]interface{}
+
+	switch v := c.(type) {
+	case map[string]interface{}:
+		config = wholeNumbers(v).(map[string]interface{})
+	case string:
+		config = map[string]interface{}{}
+		if _, err := toml.Decode(v, &config); err != nil {
+			msg := fmt.Sprintf("config is no valid TOML: %v", err)
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, msg)
+		}
+	default:
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "config must be an object or a TOML string")
+	}
+
+	if err := validateConfig(service, config); err != nil {
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, err.Error())
+	}
+
+	return config, nil
+}
+
+func validateConfig(service string, config map[string]interface{}) error {
+	for _, key := range managedConfigKeys[service] {
+		if hasConfigKey(config, key) {
+			return fmt.Errorf("config key %q of %s is managed by the broker", key, service)
+		}
+	}
+
+	if _, err := encodeConfig(config); err != nil {
+		return fmt.Errorf("config can not be represented as TOML: %v", err)
+	}
+
+	return nil
+}
+
+// hasConfigKey reports whether the config sets the key, given as a dotted
+// path.
+func hasConfigKey(config map[string]interface{}, key string) bool {
+	parts := strings.Split(key, ".")
+	table := config
+
+	for _, p := range parts[:len(parts)-1] {
+		t, ok := table[p].(map[string]interface{})
+		if !ok {
+			return false
+		}
+		table = t
+	}
+
+	_, ok := table[parts[len(parts)-1]]
+	return ok
+}
+
+// wholeNumbers returns a copy of a value decoded from JSON or YAML, in which
+// whole numbers are int64 instead of float64, so that they are encoded as
+// TOML integers. Arrays are only converted if all their numbers are whole,
+// since TOML arrays can't mix integers and floats.
+func wholeNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = wholeNumbers(e)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			if f, ok := e.(float64); ok && !isWholeNumber(f) {
+				copy(a, v)
+				return a
+			}
+			a[i] = wholeNumbers(e)
+		}
+		return a
+	case float64:
+		if isWholeNumber(v) {
+			return int64(v)
+		}
+	}
+
+	return v
+}
+
+func isWholeNumber(f float64) bool {
+	return f == math.Trunc(f) && math.Abs(f) < 1<<53
+}
+
+// mergeConfig merges the tables of src into dst. Values of src win over the
+// ones of dst, except for tables, which are merged recursively.
+func mergeConfig(dst, src map[string]interface{}) {
+	for k, v := range src {
+		srcTable, srcOK := v.(map[string]interface{})
+		dstTable, dstOK := dst[k].(map[string]interface{})
+
+		if srcOK && dstOK {
+			merged := map[string]interface{}{}
+			mergeConfig(merged, dstTable)
+			mergeConfig(merged, srcTable)
+			dst[k] = merged
+			continue
+		}
+
+		dst[k] = v
+	}
+}
+
+func encodeConfig(config map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(config); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// configSecretName returns the name of the config secret of an instance.
+func configSecretName(service, instanceID string) string {
+	return derivedSecretName(fmt.Sprintf("habitat-osb-%s", service), instanceID)
+}
+
+// composeConfig renders the config of an instance from its layers: the plan
+// defaults, the `config` parameter and the credentials of its bindings. The
+// config secret is written and set on the Habitat, unless all layers are
+// empty, in which case the Habitat is set to run without a config secret.
+// The secret itself is left for the caller to delete then, as pods might
+// still use it. It returns the name of the secret and whether the Habitat
+// needs to be updated.
+func (b *BrokerLogic) composeConfig(hab *habv1beta1.Habitat, namespace, instanceID, planID string, config, credentials map[string]interface{}, entry *AuditEntry) (string, bool, error) {
+	composed := map[string]interface{}{}
+	mergeConfig(composed, b.planConfigDefaults[planID])
+	mergeConfig(composed, config)
+	mergeConfig(composed, credentials)
+
+	secretName := configSecretName(hab.Name, instanceID)
+	current := hab.Spec.V1beta2.Service.ConfigSecretName
+
+	if len(composed) == 0 {
+		hab.Spec.V1beta2.Service.ConfigSecretName = nil
+		return secretName, current != nil, nil
+	}
+
+	userTOML, err := encodeConfig(composed)
+	if err != nil {
+		return "", false, fmt.Errorf("error rendering config: %v", err)
+	}
+
+	credentialsTOML, err := encodeConfig(credentials)
+	if err != nil {
+		return "", false, fmt.Errorf("error rendering credentials: %v", err)
+	}
+
+	data := map[string][]byte{
+		userTOMLKey:        []byte(userTOML),
+		credentialsTOMLKey: []byte(credentialsTOML),
+	}
+	if _, err := b.createSecret(secretName, namespace, instanceLabels(instanceID), data); err != nil {
+		return "", false, err
+	}
+	entry.updated("Secret", namespace, secretName)
+
+	hab.Spec.V1beta2.Service.ConfigSecretName = &secretName
+	return secretName, current == nil || *current != secretName, nil
+}
+
+// updateHabitatConfig updates the Habitat after composeConfig changed its
+// config secret.
+func (b *BrokerLogic) updateHabitatConfig(hab *habv1beta1.Habitat, namespace string, entry *AuditEntry) error {
+	hab.Kind = habv1beta1.HabitatKind
+	hab.APIVersion = habv1beta1.SchemeGroupVersion.String()
+
+	if err := b.UpdateHabitat(hab, namespace); err != nil {
+		return err
+	}
+	entry.updated(habv1beta1.HabitatKind, namespace, hab.Name)
+
+	return nil
+}
+
+// instanceConfig returns the `config` parameter the instance was provisioned
+// or last updated with.
+func (b *BrokerLogic) instanceConfig(instanceID, service string) (map[string]interface{}, error) {
+	state, err := b.getInstanceState(instanceID)
+	if err != nil || state == nil {
+		return nil, err
+	}
+
+	return getConfig(service, state.Parameters)
+}
+
+// getConfigCredentials returns the credentials layer of the config secret
+// the Habitat runs with, or nil if there's none. The config secrets of older
+// versions of the broker only hold credentials in their user.toml.
+func (b *BrokerLogic) getConfigCredentials(hab *habv1beta1.Habitat, namespace string) (map[string]interface{}, error) {
+	secretName := hab.Spec.V1beta2.Service.ConfigSecretName
+	if secretName == nil {
+		return nil, nil
+	}
+
+	secret, err := b.Clients.KubeClient.CoreV1().Secrets(namespace).Get(*secretName, metav1.GetOptions{})
+	if k8sErrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := secret.Data[credentialsTOMLKey]
+	if !ok {
+		data = secret.Data[userTOMLKey]
+	}
+
+	credentials := map[string]interface{}{}
+	if _, err := toml.Decode(string(data), &credentials); err != nil {
+		return nil, fmt.Errorf("error decoding credentials of secret %s: %v", *secretName, err)
+	}
+
+	return credentials, nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetConfigIntegers(t *testing.T) {
+	tests := []struct {
+		name   string
+		params string
+		want   string
+	}{
+		{
+			name:   "integer",
+			params: `{"config": {"port": 6380}}`,
+			want:   "port = 6380\n",
+		},
+		{
+			name:   "float",
+			params: `{"config": {"ratio": 0.5}}`,
+			want:   "ratio = 0.5\n",
+		},
+		{
+			name:   "nested table",
+			params: `{"config": {"limits": {"maxclients": 100}}}`,
+			want:   "[limits]\n  maxclients = 100\n",
+		},
+		{
+			name:   "integer array",
+			params: `{"config": {"ports": [6380, 6381]}}`,
+			want:   "ports = [6380, 6381]\n",
+		},
+		{
+			name:   "mixed array",
+			params: `{"config": {"weights": [1, 0.5]}}`,
+			want:   "weights = [1.0, 0.5]\n",
+		},
+		{
+			name:   "TOML string",
+			params: `{"config": "port = 6380\nratio = 1.0"}`,
+			want:   "port = 6380\nratio = 1.0\n",
+		},
+	}
+
+	for _, tt := range tests {
+		var params map[string]interface{}
+		if err := json.Unmarshal([]byte(tt.params), &params); err != nil {
+			t.Fatalf("%s: json.Unmarshal() error = %v", tt.name, err)
+		}
+
+		config, err := getConfig("redis", params)
+		if err != nil {
+			t.Errorf("%s: getConfig() error = %v", tt.name, err)
+			continue
+		}
+
+		got, err := encodeConfig(config)
+		if err != nil {
+			t.Errorf("%s: encodeConfig() error = %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: encodeConfig() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadPlanConfigDefaultsIntegers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plan-config-defaults")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "defaults.yaml")
+	data := "002341cf-f895-49f4-ba04-bb70291b895c:\n  tcp-keepalive: 60\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	defaults, err := LoadPlanConfigDefaults(path)
+	if err != nil {
+		t.Fatalf("LoadPlanConfigDefaults() error = %v", err)
+	}
+
+	got, err := encodeConfig(defaults["002341cf-f895-49f4-ba04-bb70291b895c"])
+	if err != nil {
+		t.Fatalf("encodeConfig() error = %v", err)
+	}
+	if want := "tcp-keepalive = 60\n"; got != want {
+		t.Errorf("encodeConfig() = %q, want %q", got, want)
+	}
+}
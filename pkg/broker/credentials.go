@@ -0,0 +1,295 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	alphanumeric = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	// idHashLength is the number of hex digits of the ID hash used in
+	// names, for IDs which can't be used as they are.
+	idHashLength = 32
+
+	// maxIdentifierLength is the length of the longest names of users and
+	// databases all database servers support.
+	maxIdentifierLength = 63
+)
+
+var bindingIdentifierRegexp = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// CredentialPolicy describes the passwords generated for a service.
+type CredentialPolicy struct {
+	// Length is the number of characters.
+	Length int `json:"length"`
+	// Alphabet holds the characters passwords are made of.
+	Alphabet string `json:"alphabet"`
+	// MinEntropyBits is the entropy passwords must at least have, based on
+	// their length and alphabet.
+	MinEntropyBits float64 `json:"minEntropyBits"`
+}
+
+// defaultCredentialPolicies are used for services without a configured
+// policy.
+var defaultCredentialPolicies = map[string]CredentialPolicy{
+	"redis": {
+		Length:         32,
+		Alphabet:       alphanumeric,
+		MinEntropyBits: 128,
+	},
+	"postgresql": {
+		Length:         32,
+		Alphabet:       alphanumeric,
+		MinEntropyBits: 128,
+	},
+	"rabbitmq": {
+		Length:         32,
+		Alphabet:       alphanumeric,
+		MinEntropyBits: 128,
+	},
+	"mongodb": {
+		Length:         32,
+		Alphabet:       alphanumeric,
+		MinEntropyBits: 128,
+	},
+}
+
+func (p *CredentialPolicy) entropyBits() float64 {
+	return float64(p.Length) * math.Log2(float64(len(p.Alphabet)))
+}
+
+func (p *CredentialPolicy) validate() error {
+	seen := map[rune]struct{}{}
+	for _, r := range p.Alphabet {
+		if r > unicode.MaxASCII {
+			return fmt.Errorf("alphabet %q has non-ASCII characters", p.Alphabet)
+		}
+		if _, ok := seen[r]; ok {
+			return fmt.Errorf("alphabet %q has duplicate characters", p.Alphabet)
+		}
+		seen[r] = struct{}{}
+	}
+
+	if len(p.Alphabet) < 2 {
+		return fmt.Errorf("alphabet %q needs at least 2 characters", p.Alphabet)
+	}
+
+	if p.Length <= 0 {
+		return fmt.Errorf("length %d is invalid", p.Length)
+	}
+
+	if bits := p.entropyBits(); bits < p.MinEntropyBits {
+		return fmt.Errorf("%d characters of alphabet %q have %.1f bits of entropy, less than the minimum of %.1f", p.Length, p.Alphabet, bits, p.MinEntropyBits)
+	}
+
+	return nil
+}
+
+// generate returns a new password, with every character drawn uniformly
+// from the alphabet using crypto/rand.
+func (p *CredentialPolicy) generate() (string, error) {
+	max := big.NewInt(int64(len(p.Alphabet)))
+	buffer := make([]byte, p.Length)
+
+	for i := range buffer {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("error generating password: %v", err)
+		}
+		buffer[i] = p.Alphabet[n.Int64()]
+	}
+
+	return string(buffer), nil
+}
+
+// LoadCredentialPolicies reads the policies, keyed by service name, from the
+// YAML or JSON file at the given path. Services missing from the file keep
+// their default policy.
+func LoadCredentialPolicies(path string) (map[string]CredentialPolicy, error) {
+	policies := map[string]CredentialPolicy{}
+	for name, p := range defaultCredentialPolicies {
+		policies[name] = p
+	}
+
+	if path == "" {
+		return policies, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading credential policies: %v", err)
+	}
+
+	configured := map[string]CredentialPolicy{}
+	if err := yaml.Unmarshal(data, &configured); err != nil {
+		return nil, fmt.Errorf("error parsing credential policies: %v", err)
+	}
+
+	for name, p := range configured {
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("credential policy of %q is invalid: %v", name, err)
+		}
+		policies[name] = p
+	}
+
+	return policies, nil
+}
+
+// generatePassword returns a new password according to the policy of the
+// given service.
+func (b *BrokerLogic) generatePassword(service string) (string, error) {
+	p, ok := b.credentialPolicies[service]
+	if !ok {
+		return "", fmt.Errorf("there's no credential policy for %q", service)
+	}
+
+	return p.generate()
+}
+
+// derivedSecretName derives the name of a secret from the ID of the
+// instance or binding it belongs to. IDs which are no valid DNS label, or
+// too long, are hashed.
+func derivedSecretName(prefix, id string) string {
+	lower := strings.ToLower(id)
+	name := fmt.Sprintf("%s-%s", prefix, lower)
+
+	if len(validation.IsDNS1123Label(lower)) > 0 || len(name) > validation.DNS1123SubdomainMaxLength {
+		sum := sha256.Sum256([]byte(id))
+		name = fmt.Sprintf("%s-%s", prefix, hex.EncodeToString(sum[:])[:idHashLength])
+	}
+
+	return name
+}
+
+// bindingIdentifier returns the name of the user and database of a binding
+// in a database server. IDs which are no valid identifier, or too long, are
+// hashed.
+func bindingIdentifier(bindingID string) string {
+	name := "binding_" + strings.Replace(strings.ToLower(bindingID), "-", "_", -1)
+
+	if !bindingIdentifierRegexp.MatchString(name) || len(name) > maxIdentifierLength {
+		sum := sha256.Sum256([]byte(bindingID))
+		name = "binding_" + hex.EncodeToString(sum[:])[:idHashLength]
+	}
+
+	return name
+}
+
+// CredentialStore keeps a copy of the generated credentials outside of the
+// cluster.
+type CredentialStore interface {
+	Put(key, value string) error
+	Delete(key string) error
+}
+
+// httpCredentialStore writes credentials to a key-value store with an HTTP
+// API in which keys are paths below a base URL, like the Consul KV store.
+type httpCredentialStore struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (s *httpCredentialStore) Put(key, value string) error {
+	return s.do("PUT", key, []byte(value))
+}
+
+func (s *httpCredentialStore) Delete(key string) error {
+	return s.do("DELETE", key, nil)
+}
+
+func (s *httpCredentialStore) do(method, key string, body []byte) error {
+	req, err := http.NewRequest(method, s.url+"/"+key, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error storing credentials: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("error storing credentials: %s %s returned %s", method, key, resp.Status)
+	}
+
+	return nil
+}
+
+// SetupCredentialStore configures the external store generated credentials
+// are copied to. Credentials are only kept in the cluster if url is empty.
+func (b *BrokerLogic) SetupCredentialStore(url, tokenPath string) error {
+	if url == "" {
+		return nil
+	}
+
+	s := &httpCredentialStore{
+		url:    strings.TrimSuffix(url, "/"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if tokenPath != "" {
+		data, err := ioutil.ReadFile(tokenPath)
+		if err != nil {
+			return fmt.Errorf("error reading credential store token: %v", err)
+		}
+		s.token = strings.TrimSpace(string(data))
+	}
+
+	b.CredentialStore = s
+	return nil
+}
+
+func credentialKey(instanceID, bindingID string) string {
+	return fmt.Sprintf("%s/%s/password", instanceID, bindingID)
+}
+
+func (b *BrokerLogic) storeCredential(instanceID, bindingID, password string) error {
+	if b.CredentialStore == nil {
+		return nil
+	}
+
+	return b.CredentialStore.Put(credentialKey(instanceID, bindingID), password)
+}
+
+func (b *BrokerLogic) deleteCredential(instanceID, bindingID string) error {
+	if b.CredentialStore == nil {
+		return nil
+	}
+
+	return b.CredentialStore.Delete(credentialKey(instanceID, bindingID))
+}
@@ -0,0 +1,350 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// operationHistoryLength is the number of operations kept per instance.
+const operationHistoryLength = 10
+
+// operationHistory keeps the latest audited operations of every instance
+// since the broker started.
+type operationHistory struct {
+	sync.Mutex
+	entries map[string][]*AuditEntry
+}
+
+func (h *operationHistory) add(entry *AuditEntry) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.entries == nil {
+		h.entries = map[string][]*AuditEntry{}
+	}
+
+	if entry.Operation == operationDeprovision && entry.Outcome == auditOutcomeSucceeded {
+		delete(h.entries, entry.InstanceID)
+		return
+	}
+
+	entries := append(h.entries[entry.InstanceID], entry)
+	if len(entries) > operationHistoryLength {
+		entries = entries[len(entries)-operationHistoryLength:]
+	}
+	h.entries[entry.InstanceID] = entries
+}
+
+// list returns the operations of an instance, the latest first.
+func (h *operationHistory) list(instanceID string) []*AuditEntry {
+	h.Lock()
+	defer h.Unlock()
+
+	entries := h.entries[instanceID]
+	result := make([]*AuditEntry, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		result = append(result, entries[i])
+	}
+
+	return result
+}
+
+// InstanceStatus is what the dashboard shows about an instance.
+type InstanceStatus struct {
+	InstanceID string        `json:"instanceID"`
+	ServiceID  string        `json:"serviceID"`
+	PlanID     string        `json:"planID"`
+	Namespace  string        `json:"namespace"`
+	Habitat    HabitatStatus `json:"habitat"`
+	Pods       []PodStatus   `json:"pods"`
+	Endpoints  []string      `json:"endpoints"`
+	Bindings   int           `json:"bindings"`
+	Operations []*AuditEntry `json:"operations"`
+}
+
+// HabitatStatus is the status the habitat-operator reports for a Habitat.
+type HabitatStatus struct {
+	Name    string `json:"name"`
+	State   string `json:"state,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// PodStatus is the status of a pod of the StatefulSet of a Habitat.
+type PodStatus struct {
+	Name     string `json:"name"`
+	Phase    string `json:"phase"`
+	Ready    bool   `json:"ready"`
+	IP       string `json:"ip,omitempty"`
+	Restarts int32  `json:"restarts"`
+}
+
+// LoadDashboardKey reads the key dashboard tokens are signed with.
+func LoadDashboardKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading dashboard key: %v", err)
+	}
+
+	key := []byte(strings.TrimSpace(string(data)))
+	if len(key) == 0 {
+		return nil, fmt.Errorf("dashboard key in %s is empty", path)
+	}
+
+	return key, nil
+}
+
+// dashboardToken signs the ID of an instance, which grants access to its
+// dashboard.
+func (b *BrokerLogic) dashboardToken(instanceID string) string {
+	mac := hmac.New(sha256.New, b.dashboardKey)
+	mac.Write([]byte(instanceID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (b *BrokerLogic) validDashboardToken(instanceID, token string) bool {
+	return hmac.Equal([]byte(token), []byte(b.dashboardToken(instanceID)))
+}
+
+// dashboardURL returns the URL of the dashboard of an instance, or nil if
+// the dashboard is disabled.
+func (b *BrokerLogic) dashboardURL(instanceID string) *string {
+	if b.dashboardBaseURL == "" {
+		return nil
+	}
+
+	u := fmt.Sprintf("%s/dashboard/service_instances/%s?token=%s",
+		b.dashboardBaseURL, url.PathEscape(instanceID), b.dashboardToken(instanceID))
+	return &u
+}
+
+// InstanceStatus collects the status of an instance from its Habitat, pods
+// and Service, and the state of the broker.
+func (b *BrokerLogic) InstanceStatus(instanceID string) (*InstanceStatus, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	state, err := b.getInstanceState(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if state == nil {
+		msg := fmt.Sprintf("could not find state of instance %s in configmap %s", instanceID, b.ConfigMap.Name)
+		return nil, newHTTPStatusCodeError(http.StatusNotFound, msg)
+	}
+
+	name, err := habitatName(state.PlanID, state.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &InstanceStatus{
+		InstanceID: instanceID,
+		ServiceID:  state.ServiceID,
+		PlanID:     state.PlanID,
+		Namespace:  state.Namespace,
+		Habitat:    HabitatStatus{Name: name},
+		Operations: b.history.list(instanceID),
+	}
+
+	hab, err := b.GetHabitat(name, state.Namespace)
+	if err != nil && !k8sErrors.IsNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		status.Habitat.State = string(hab.Status.State)
+		status.Habitat.Message = hab.Status.Message
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{habv1beta1.HabitatNameLabel: name})
+	pods, err := b.Clients.KubeClient.CoreV1().Pods(state.Namespace).List(metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing pods of Habitat %s: %v", name, err)
+	}
+
+	for _, pod := range pods.Items {
+		p := PodStatus{
+			Name:  pod.Name,
+			Phase: string(pod.Status.Phase),
+			IP:    pod.Status.PodIP,
+		}
+		for _, c := range pod.Status.Conditions {
+			if c.Type == v1.PodReady {
+				p.Ready = c.Status == v1.ConditionTrue
+			}
+		}
+		for _, c := range pod.Status.ContainerStatuses {
+			p.Restarts += c.RestartCount
+		}
+		status.Pods = append(status.Pods, p)
+	}
+
+	if status.Endpoints, err = b.serviceEndpoints(name, state.Namespace); err != nil {
+		return nil, err
+	}
+
+	bindings, err := b.listBindingStates()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range bindings {
+		if s.InstanceID == instanceID {
+			status.Bindings++
+		}
+	}
+
+	return status, nil
+}
+
+// serviceEndpoints returns the ready addresses of the Services which select
+// the pods of a Habitat.
+func (b *BrokerLogic) serviceEndpoints(name, namespace string) ([]string, error) {
+	services, err := b.Clients.KubeClient.CoreV1().Services(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing services in namespace %s: %v", namespace, err)
+	}
+
+	var endpoints []string
+
+	for _, svc := range services.Items {
+		if svc.Spec.Selector[habv1beta1.HabitatNameLabel] != name {
+			continue
+		}
+
+		e, err := b.Clients.KubeClient.CoreV1().Endpoints(namespace).Get(svc.Name, metav1.GetOptions{})
+		if k8sErrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error getting endpoints of service %s: %v", svc.Name, err)
+		}
+
+		for _, subset := range e.Subsets {
+			for _, a := range subset.Addresses {
+				for _, p := range subset.Ports {
+					endpoints = append(endpoints, fmt.Sprintf("%s:%d", a.IP, p.Port))
+				}
+			}
+		}
+	}
+
+	return endpoints, nil
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Habitat.Name}} ({{.InstanceID}})</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{.Habitat.Name}}</h1>
+<table>
+<tr><th>Instance</th><td>{{.InstanceID}}</td></tr>
+<tr><th>Namespace</th><td>{{.Namespace}}</td></tr>
+<tr><th>Habitat state</th><td>{{.Habitat.State}} {{.Habitat.Message}}</td></tr>
+<tr><th>Bindings</th><td>{{.Bindings}}</td></tr>
+<tr><th>Endpoints</th><td>{{range .Endpoints}}{{.}}<br>{{end}}</td></tr>
+</table>
+<h2>Pods</h2>
+<table>
+<tr><th>Name</th><th>Phase</th><th>Ready</th><th>IP</th><th>Restarts</th></tr>
+{{range .Pods}}<tr><td>{{.Name}}</td><td>{{.Phase}}</td><td>{{.Ready}}</td><td>{{.IP}}</td><td>{{.Restarts}}</td></tr>
+{{end}}</table>
+<h2>Recent operations</h2>
+<table>
+<tr><th>Time</th><th>Operation</th><th>Binding</th><th>Outcome</th><th>Error</th></tr>
+{{range .Operations}}<tr><td>{{.Time.Format "2006-01-02 15:04:05 MST"}}</td><td>{{.Operation}}</td><td>{{.BindingID}}</td><td>{{.Outcome}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// DashboardSurface serves the status page of every instance, as HTML or as
+// JSON. Access requires the token of the dashboard URL, or the admin token.
+type DashboardSurface struct {
+	Broker *BrokerLogic
+	Admin  *AdminSurface
+}
+
+// NewDashboardSurface returns a new DashboardSurface for the given broker.
+// Admin may be nil if the admin API is disabled.
+func NewDashboardSurface(b *BrokerLogic, admin *AdminSurface) *DashboardSurface {
+	return &DashboardSurface{
+		Broker: b,
+		Admin:  admin,
+	}
+}
+
+// RegisterHandlers adds the handlers of the DashboardSurface to the router.
+func (s *DashboardSurface) RegisterHandlers(router *mux.Router) {
+	router.HandleFunc("/dashboard/service_instances/{instance_id}", s.InstanceHandler).Methods("GET")
+}
+
+// InstanceHandler serves the status page of an instance. It's JSON if the
+// request accepts it, and HTML otherwise.
+func (s *DashboardSurface) InstanceHandler(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)[osb.VarKeyInstanceID]
+
+	token := r.URL.Query().Get("token")
+	if !s.Broker.validDashboardToken(instanceID, token) && (s.Admin == nil || !s.Admin.authorized(r)) {
+		glog.Warningf("Rejected unauthenticated dashboard request for instanceID %q", instanceID)
+		writeError(w, errors.New("invalid dashboard token"), http.StatusUnauthorized)
+		return
+	}
+
+	status, err := s.Broker.InstanceStatus(instanceID)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeResponse(w, http.StatusOK, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, status); err != nil {
+		glog.Errorf("error rendering dashboard of instance %s: %v", instanceID, err)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// defaultEnvAllowlist lets all plans set the variables the Supervisor and
+// the packages read their settings from.
+var defaultEnvAllowlist = []string{"HAB_*"}
+
+// LoadPlanEnvAllowlists reads the environment variables every plan may set,
+// keyed by plan ID, from the YAML or JSON file at the given path. Variables
+// are given as names or shell patterns. Plans missing from the file keep the
+// default allowlist.
+func LoadPlanEnvAllowlists(filename string) (map[string][]string, error) {
+	allowlists := map[string][]string{}
+	if filename == "" {
+		return allowlists, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading plan env allowlists: %v", err)
+	}
+
+	if err := yaml.Unmarshal(data, &allowlists); err != nil {
+		return nil, fmt.Errorf("error parsing plan env allowlists: %v", err)
+	}
+
+	for planID, patterns := range allowlists {
+		if _, _, err := matchService(planID); err != nil && planID != habitatPackagePlanID {
+			return nil, fmt.Errorf("env allowlist of plan %q is invalid: %v", planID, err)
+		}
+
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("env allowlist of plan %q is invalid: pattern %q: %v", planID, p, err)
+			}
+		}
+	}
+
+	return allowlists, nil
+}
+
+// envAllowed reports whether the plan may set the environment variable.
+func (b *BrokerLogic) envAllowed(planID, name string) bool {
+	patterns, ok := b.planEnvAllowlists[planID]
+	if !ok {
+		patterns = defaultEnvAllowlist
+	}
+
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getEnv returns the `env` parameter. It's a list of environment variables
+// in the format of Kubernetes, which either have a value or reference a key
+// of a Secret or ConfigMap.
+func (b *BrokerLogic) getEnv(planID string, params map[string]interface{}) ([]v1.EnvVar, error) {
+	e, ok := params["env"]
+	if !ok {
+		return nil, nil
+	}
+
+	list, ok := e.([]interface{})
+	if !ok {
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "env must be a list")
+	}
+
+	// The parameters are decoded from JSON, so they can be encoded again.
+	data, _ := json.Marshal(list)
+
+	var env []v1.EnvVar
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("env is invalid: %v", err))
+	}
+
+	seen := map[string]struct{}{}
+
+	for i, v := range env {
+		if errs := validation.IsEnvVarName(v.Name); len(errs) > 0 {
+			msg := fmt.Sprintf("env variable %d has an invalid name %q: %s", i, v.Name, strings.Join(errs, ", "))
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, msg)
+		}
+
+		if _, ok := seen[v.Name]; ok {
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("env variable %s is given more than once", v.Name))
+		}
+		seen[v.Name] = struct{}{}
+
+		if !b.envAllowed(planID, v.Name) {
+			msg := fmt.Sprintf("env variable %s is not allowed by the plan", v.Name)
+			return nil, newHTTPStatusCodeError(http.StatusForbidden, msg)
+		}
+
+		if v.ValueFrom == nil {
+			continue
+		}
+
+		from := v.ValueFrom
+		if v.Value != "" || from.FieldRef != nil || from.ResourceFieldRef != nil || (from.SecretKeyRef == nil) == (from.ConfigMapKeyRef == nil) {
+			msg := fmt.Sprintf("env variable %s needs either a value, a secretKeyRef or a configMapKeyRef", v.Name)
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, msg)
+		}
+	}
+
+	return env, nil
+}
+
+// verifyEnvRefs checks that the Secrets and ConfigMaps referenced by the
+// environment variables exist in the namespace of the instance, unless the
+// references are optional.
+func (b *BrokerLogic) verifyEnvRefs(env []v1.EnvVar, namespace string) error {
+	for _, v := range env {
+		if v.ValueFrom == nil {
+			continue
+		}
+
+		var kind, name, key string
+		var optional *bool
+		var found bool
+		var err error
+
+		if ref := v.ValueFrom.SecretKeyRef; ref != nil {
+			kind, name, key, optional = "Secret", ref.Name, ref.Key, ref.Optional
+
+			var s *v1.Secret
+			if s, err = b.Clients.KubeClient.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{}); err == nil {
+				_, found = s.Data[key]
+			}
+		} else {
+			ref := v.ValueFrom.ConfigMapKeyRef
+			kind, name, key, optional = "ConfigMap", ref.Name, ref.Key, ref.Optional
+
+			var cm *v1.ConfigMap
+			if cm, err = b.Clients.KubeClient.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{}); err == nil {
+				_, found = cm.Data[key]
+			}
+		}
+
+		if optional != nil && *optional {
+			continue
+		}
+
+		if k8sErrors.IsNotFound(err) {
+			msg := fmt.Sprintf("env variable %s references %s %s, which does not exist in namespace %s", v.Name, kind, name, namespace)
+			return newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+		}
+		if err != nil {
+			return fmt.Errorf("error getting %s %s: %v", kind, name, err)
+		}
+
+		if !found {
+			msg := fmt.Sprintf("env variable %s references key %q, which %s %s does not have", v.Name, key, kind, name)
+			return newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+		}
+	}
+
+	return nil
+}
+
+// HabitatEnvRolledOut checks whether all pods of a Habitat run with the
+// given environment variables. If the rollout is not finished, a description
+// of its progress is returned.
+func (b *BrokerLogic) HabitatEnvRolledOut(name, namespace string, env []v1.EnvVar) (bool, string, error) {
+	return b.habitatRolledOut(name, namespace, func(sts *appsv1.StatefulSet) bool {
+		containers := sts.Spec.Template.Spec.Containers
+		if len(containers) == 0 {
+			return false
+		}
+
+		current := containers[0].Env
+		if len(current) == 0 && len(env) == 0 {
+			return true
+		}
+
+		return equality.Semantic.DeepEqual(current, env)
+	})
+}
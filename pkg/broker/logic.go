@@ -18,9 +18,14 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/golang/glog"
 	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
 	habclient "github.com/habitat-sh/habitat-operator/pkg/client/clientset/versioned/typed/habitat/v1beta1"
@@ -34,22 +39,176 @@ import (
 
 // NewBrokerLogic is a hook that is called with the Options the program is run with.
 func NewBrokerLogic(o *Options, clients *Clients) (*BrokerLogic, error) {
-	return &BrokerLogic{
-		async:   o.Async,
+	if err := o.Platform.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := o.Backup.validate(); err != nil {
+		return nil, err
+	}
+
+	if o.CredentialRotationGracePeriod <= 0 {
+		return nil, fmt.Errorf("credential rotation grace period %v is invalid", o.CredentialRotationGracePeriod)
+	}
+
+	b := &BrokerLogic{
+		async:     o.Async,
+		authorize: o.AuthorizeRequests,
+		platform:  o.Platform,
+		backup:    o.Backup,
+		snapshot:  o.Snapshot,
+
+		rotationInterval:    o.CredentialRotationInterval,
+		rotationGracePeriod: o.CredentialRotationGracePeriod,
+
+		builderURL: strings.TrimSuffix(o.BuilderURL, "/"),
+
 		Clients: clients,
-	}, nil
+	}
+
+	for _, origin := range strings.Split(o.PackageOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			b.packageOrigins = append(b.packageOrigins, origin)
+		}
+	}
+
+	if o.Backup.Target == BackupTargetS3 {
+		credentials, err := LoadS3Credentials(o.Backup.S3CredentialsPath)
+		if err != nil {
+			return nil, err
+		}
+		b.s3Credentials = credentials
+	}
+
+	imageTemplate, err := parsePackageImageTemplate(o.PackageImageTemplate)
+	if err != nil {
+		return nil, err
+	}
+	b.packageImageTemplate = imageTemplate
+
+	spec, err := detectHabitatSpec(clients.KubeClient, o.HabitatSpec)
+	if err != nil {
+		return nil, err
+	}
+	b.habitatSpec = spec
+	glog.Infof("Creating Habitats of the %s spec", spec)
+
+	b.snapshotAPI = detectSnapshotAPI(clients.KubeClient)
+	if b.snapshotAPI == "" {
+		glog.Infof("The cluster serves no VolumeSnapshot API, snapshots of instances are disabled")
+	}
+
+	policies, err := LoadCredentialPolicies(o.CredentialPolicyPath)
+	if err != nil {
+		return nil, err
+	}
+	b.credentialPolicies = policies
+
+	defaults, err := LoadPlanConfigDefaults(o.PlanConfigDefaultsPath)
+	if err != nil {
+		return nil, err
+	}
+	b.planConfigDefaults = defaults
+
+	if o.DashboardURL != "" {
+		if o.DashboardKeyPath == "" {
+			return nil, fmt.Errorf("the dashboard needs a key to sign its tokens with")
+		}
+
+		key, err := LoadDashboardKey(o.DashboardKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		b.dashboardBaseURL = strings.TrimSuffix(o.DashboardURL, "/")
+		b.dashboardKey = key
+	}
+
+	allowlists, err := LoadPlanEnvAllowlists(o.PlanEnvAllowlistPath)
+	if err != nil {
+		return nil, err
+	}
+	b.planEnvAllowlists = allowlists
+
+	reclaimPolicies, err := LoadPlanReclaimPolicies(o.PlanReclaimPolicyPath)
+	if err != nil {
+		return nil, err
+	}
+	b.planReclaimPolicies = reclaimPolicies
+
+	if o.PolicyPath != "" {
+		p, err := LoadPolicy(o.PolicyPath)
+		if err != nil {
+			return nil, err
+		}
+		b.Policy = p
+	}
+
+	return b, nil
 }
 
 // BrokerLogic provides an implementation of the broker.BrokerLogic interface.
 type BrokerLogic struct {
 	// Indicates if the broker should handle the requests asynchronously.
 	async bool
+	// Indicates if the originating identity of a request must be allowed
+	// to create Habitat objects in the target namespace.
+	authorize bool
+	// Maps requests from platforms other than Kubernetes to namespaces.
+	platform PlatformOptions
+	// Where the backups of instances are kept.
+	backup BackupOptions
+	// The buckets and keys the backups of the instances of each namespace
+	// are uploaded with to an S3 target.
+	s3Credentials map[string]*s3Credentials
+	// How the volumes of instances are snapshotted.
+	snapshot SnapshotOptions
+	// The VolumeSnapshot API the cluster serves, snapshots are disabled if
+	// empty.
+	snapshotAPI string
+	// How often binding credentials are rotated, never if 0.
+	rotationInterval time.Duration
+	// How long both the old and the new credentials are valid.
+	rotationGracePeriod time.Duration
+	// How passwords are generated, keyed by service name.
+	credentialPolicies map[string]CredentialPolicy
+	// The spec of the Habitats the habitat-operator understands.
+	habitatSpec string
+	// The Builder API checked for newer builds of packages, no check is
+	// done if empty.
+	builderURL string
+	// The origins whose packages may be provisioned through the
+	// habitat-package service.
+	packageOrigins []string
+	// The template the images of those packages are named with.
+	packageImageTemplate *template.Template
+	// The lowest layer of the config of every instance, keyed by plan ID.
+	planConfigDefaults map[string]map[string]interface{}
+	// The environment variables every plan may set, keyed by plan ID.
+	planEnvAllowlists map[string][]string
+	// Whether the resources of instances are deleted with them, keyed by
+	// plan ID.
+	planReclaimPolicies map[string]string
+	// The URL the dashboard is reached at, it's disabled if empty.
+	dashboardBaseURL string
+	// The key dashboard tokens are signed with.
+	dashboardKey []byte
+	// The latest operations of every instance, shown by the dashboard.
+	history operationHistory
 	// Synchronize go routines.
 	sync.RWMutex
 	Clients *Clients
 
 	ConfigNamespace *v1.Namespace
 	ConfigMap       *v1.ConfigMap
+
+	// Audit records every lifecycle operation. Auditing is disabled if nil.
+	Audit AuditSink
+	// CredentialStore receives a copy of all generated credentials.
+	// Credentials are only kept in secrets if nil.
+	CredentialStore CredentialStore
+	// Policy restricts where and how many instances can be provisioned.
+	// Everything is allowed if nil.
+	Policy *Policy
 }
 
 // Clients stores all the information specfic to Kubernetes.
@@ -115,21 +274,25 @@ func (b *BrokerLogic) GetOrCreateConfigMap(name, namespace string) error {
 }
 
 func (b *BrokerLogic) addToConfigMap(key, value string) error {
-	if b.ConfigMap.Data != nil {
-		b.ConfigMap.Data[key] = value
-	} else {
-		b.ConfigMap.Data = map[string]string{
-			key: value,
-		}
+	if b.ConfigMap.Data == nil {
+		b.ConfigMap.Data = map[string]string{}
 	}
 
+	previous, existed := b.ConfigMap.Data[key]
+	b.ConfigMap.Data[key] = value
+
 	cm, err := b.Clients.KubeClient.
 		CoreV1().
 		ConfigMaps(b.ConfigMap.ObjectMeta.Namespace).
 		Update(b.ConfigMap)
 	if err != nil {
-		// Restore ConfigMap.Data to original state
-		delete(b.ConfigMap.Data, key)
+		// Restore ConfigMap.Data to original state, which keeps records
+		// that were overwritten.
+		if existed {
+			b.ConfigMap.Data[key] = previous
+		} else {
+			delete(b.ConfigMap.Data, key)
+		}
 		return err
 	}
 
@@ -169,6 +332,10 @@ func (b *BrokerLogic) GetCatalog(c *broker.RequestContext) (*broker.CatalogRespo
 			Services: []osb.Service{
 				nginxService(),
 				redisService(),
+				postgresqlService(),
+				rabbitmqService(),
+				mongodbService(),
+				habitatPackageService(),
 			},
 		},
 	}
@@ -176,17 +343,20 @@ func (b *BrokerLogic) GetCatalog(c *broker.RequestContext) (*broker.CatalogRespo
 	return response, nil
 }
 
-func (b *BrokerLogic) Provision(request *osb.ProvisionRequest, c *broker.RequestContext) (*broker.ProvisionResponse, error) {
+func (b *BrokerLogic) Provision(request *osb.ProvisionRequest, c *broker.RequestContext) (_ *broker.ProvisionResponse, err error) {
 	b.Lock()
 	defer b.Unlock()
 
+	entry := newAuditEntry(operationProvision, request.InstanceID, request.ServiceID, request.PlanID, request.OriginatingIdentity, request.Parameters)
+	defer b.recordAudit(entry, &err)
+
 	response := broker.ProvisionResponse{}
 
 	if request.AcceptsIncomplete {
 		response.Async = b.async
 	}
 
-	topology, err := getTopology(request.Parameters)
+	topology, err := getTopology(request.PlanID, request.Parameters)
 	if err != nil {
 		return nil, err
 	}
@@ -196,7 +366,7 @@ func (b *BrokerLogic) Provision(request *osb.ProvisionRequest, c *broker.Request
 		return nil, err
 	}
 
-	count, err := getCount(request.Parameters)
+	count, err := getCount(topology, request.Parameters)
 	if err != nil {
 		return nil, err
 	}
@@ -205,306 +375,1639 @@ func (b *BrokerLogic) Provision(request *osb.ProvisionRequest, c *broker.Request
 		group:    group,
 		topology: topology,
 		count:    count,
+		// The v1beta1 spec lacks persistent storage, so the instances of
+		// older habitat-operators keep their data in their pods.
+		persistent: b.habitatSpec != HabitatSpecV1beta1,
 	}
 
-	hab, err := generateHabitatObject(request.PlanID, params)
+	hab, err := b.generateHabitatObject(request.PlanID, request.Parameters, params)
 	if err != nil {
 		return nil, err
 	}
+	markHabitat(hab, request.InstanceID)
 
-	ns, err := getNamespace(request.Context)
+	config, err := getConfig(configService(request.PlanID, hab.Name), request.Parameters)
 	if err != nil {
 		return nil, err
 	}
 
-	err = b.createHabitatResource(hab, ns, request.InstanceID)
+	binds, err := getBinds(request.Parameters)
 	if err != nil {
 		return nil, err
 	}
 
-	return &response, nil
-}
-
-func (b *BrokerLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.RequestContext) (*broker.DeprovisionResponse, error) {
-	b.Lock()
-	defer b.Unlock()
+	backup, err := getBackup(request.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.getReclaimPolicy(request.PlanID, request.Parameters); err != nil {
+		return nil, err
+	}
 
-	response := broker.DeprovisionResponse{}
+	restore, err := b.getRestoreSource(request.ServiceID, request.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if restore != nil && !request.AcceptsIncomplete {
+		// The Habitat is only created once its volume is restored.
+		msg := osb.AsyncErrorMessage
+		description := "instances which are restored are provisioned asynchronously"
+		return nil, osb.HTTPStatusCodeError{
+			StatusCode:   http.StatusUnprocessableEntity,
+			ErrorMessage: &msg,
+			Description:  &description,
+		}
+	}
 
-	if request.AcceptsIncomplete {
-		response.Async = b.async
+	snapshot, err := b.getSnapshotSource(request.Parameters)
+	if err != nil {
+		return nil, err
 	}
 
-	err := b.deleteResources(request.PlanID, request.InstanceID)
+	ring, err := getRing(request.Parameters)
 	if err != nil {
 		return nil, err
 	}
 
-	return &response, nil
-}
+	channel, err := getChannel(request.PlanID, request.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if channel != "" {
+		hab.Spec.V1beta2.Service.Channel = &channel
+	}
 
-func (b *BrokerLogic) LastOperation(request *osb.LastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
-	return nil, nil
-}
+	if err := b.verifyHabitatSpec(hab.Spec.V1beta2.PersistentStorage, channel); err != nil {
+		return nil, err
+	}
 
-func (b *BrokerLogic) Bind(request *osb.BindRequest, c *broker.RequestContext) (*broker.BindResponse, error) {
-	b.Lock()
-	defer b.Unlock()
+	env, err := b.getEnv(request.PlanID, request.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	hab.Spec.V1beta2.Env = env
 
-	response := broker.BindResponse{}
+	ns, missing, err := b.resolveNamespace(request.Context, request.OrganizationGUID, request.SpaceGUID)
+	if err != nil {
+		return nil, err
+	}
 
-	if request.AcceptsIncomplete {
-		response.Async = b.async
+	if err := b.authorizeNamespace(request.OriginatingIdentity, ns); err != nil {
+		return nil, err
 	}
 
-	err := b.createBinding(request)
-	if err != nil {
+	if err := b.enforcePolicy(request.InstanceID, request.ServiceID, request.PlanID, ns, missing, count); err != nil {
 		return nil, err
 	}
 
-	response.Exists = true
-	return &response, nil
-}
+	if backup != nil {
+		if err := b.verifyBackupable(hab, ns); err != nil {
+			return nil, err
+		}
+	}
 
-func (b *BrokerLogic) Unbind(request *osb.UnbindRequest, c *broker.RequestContext) (*broker.UnbindResponse, error) {
-	b.Lock()
-	defer b.Unlock()
+	if restore != nil {
+		if err := b.verifyBackupTarget(ns); err != nil {
+			return nil, err
+		}
+		if err := b.verifyRestoreSource(request.OriginatingIdentity, restore, ns, hab.Name); err != nil {
+			return nil, err
+		}
+	}
 
-	response := broker.UnbindResponse{}
+	if err := b.verifyEnvRefs(env, ns); err != nil {
+		return nil, err
+	}
 
-	if request.AcceptsIncomplete {
-		response.Async = b.async
+	if err := b.verifyHabitatNameFree(hab.Name, ns); err != nil {
+		return nil, err
+	}
+
+	ring = ringName(ring, request.InstanceID)
+	if hab.Spec.V1beta2.Service.Bind, err = b.resolveBinds(request.InstanceID, ns, ring, binds); err != nil {
+		return nil, err
+	}
+
+	if missing != nil {
+		if err := b.createPlatformNamespace(missing); err != nil {
+			return nil, err
+		}
 	}
 
-	err := b.deleteBinding(request)
+	ringSecretName, err := b.ensureRingKey(ring, ns, entry)
 	if err != nil {
-		glog.Warningf("Error in unbind: %q", err)
 		return nil, err
 	}
+	hab.Spec.V1beta2.Service.RingSecretName = &ringSecretName
 
-	return &response, nil
-}
+	var credentials map[string]interface{}
+	if request.PlanID != habitatPackagePlanID {
+		if credentials, err = b.instanceCredentialsLayer(hab); err != nil {
+			return nil, err
+		}
+	}
 
-func (b *BrokerLogic) Update(request *osb.UpdateInstanceRequest, c *broker.RequestContext) (*broker.UpdateInstanceResponse, error) {
-	response := broker.UpdateInstanceResponse{}
-	if request.AcceptsIncomplete {
-		response.Async = b.async
+	if _, _, err := b.composeConfig(hab, ns, request.InstanceID, request.PlanID, config, credentials, entry); err != nil {
+		return nil, err
 	}
 
-	return &response, nil
-}
+	state := &instanceState{
+		ServiceID:  request.ServiceID,
+		PlanID:     request.PlanID,
+		Namespace:  ns,
+		Count:      count,
+		Parameters: request.Parameters,
+		Ring:       ring,
+	}
 
-func (b *BrokerLogic) ValidateBrokerAPIVersion(version string) error {
-	return nil
-}
+	if restore != nil {
+		if state.Restore, err = b.startRestore(hab, ns, request.InstanceID, restore, entry); err != nil {
+			return nil, err
+		}
+		state.Operation = newOperationState(operationProvision)
 
-var topologySet = map[habv1beta1.Topology]struct{}{
-	habv1beta1.TopologyStandalone: {},
-	habv1beta1.TopologyLeader:     {},
-}
+		if err := b.addToConfigMap(getNamespaceConfigMapKey(request.InstanceID), ns); err != nil {
+			return nil, err
+		}
+		if err := b.setInstanceState(request.InstanceID, state); err != nil {
+			return nil, err
+		}
 
-type habitatParameters struct {
-	group    string
-	topology habv1beta1.Topology
-	count    int
-}
+		key := osb.OperationKey(operationProvision)
+		response.Async = true
+		response.OperationKey = &key
+	} else {
+		if snapshot != "" {
+			if err := b.provisionFromSnapshot(hab, ns, snapshot, entry); err != nil {
+				return nil, err
+			}
+		}
 
-func getTopology(params map[string]interface{}) (habv1beta1.Topology, error) {
-	t, ok := params["topology"]
-	if !ok {
-		return habv1beta1.TopologyStandalone, nil
+		err = b.createHabitatResource(hab, request.InstanceID, state)
+		if err != nil {
+			return nil, err
+		}
+		entry.created(habv1beta1.HabitatKind, ns, hab.Name)
 	}
 
-	s, ok := t.(string)
-	if !ok {
-		return habv1beta1.Topology(""), fmt.Errorf("topology %q is invalid", t)
+	if backup != nil {
+		if err := b.ensureBackups(hab, ns, request.InstanceID, backup, entry); err != nil {
+			return nil, err
+		}
 	}
 
-	topology := habv1beta1.Topology(s)
-	_, ok = topologySet[topology]
-	if !ok {
-		return habv1beta1.Topology(""), fmt.Errorf("topology %q is invalid", t)
+	if restore == nil {
+		b.adoptResources(request.InstanceID, state)
 	}
 
-	return topology, nil
+	response.DashboardURL = b.dashboardURL(request.InstanceID)
+	return &response, nil
 }
 
-func getGroup(params map[string]interface{}) (string, error) {
-	g, ok := params["group"]
-	if !ok {
-		return "default", nil
-	}
+func (b *BrokerLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.RequestContext) (_ *broker.DeprovisionResponse, err error) {
+	b.Lock()
+	defer b.Unlock()
 
-	s, ok := g.(string)
-	if !ok {
-		return "", fmt.Errorf("group %q is invalid", g)
-	}
+	entry := newAuditEntry(operationDeprovision, request.InstanceID, request.ServiceID, request.PlanID, request.OriginatingIdentity, nil)
+	defer b.recordAudit(entry, &err)
 
-	return s, nil
-}
+	response := broker.DeprovisionResponse{}
 
-func getCount(params map[string]interface{}) (int, error) {
-	c, ok := params["count"]
-	if !ok {
-		return 1, nil
+	if request.AcceptsIncomplete {
+		response.Async = b.async
 	}
 
-	// The `count` is passed down as a float64. We type assert before being
-	// able to play around with it.
-	f, ok := c.(float64)
-	if !ok {
-		return 0, fmt.Errorf("type assertion of count as float64 failed: %q", c)
+	state, err := b.getInstanceState(request.InstanceID)
+	if err != nil {
+		return nil, err
 	}
 
-	signed := int(f)
-	if signed < 1 {
-		// fail, because f is either negative or zero, and zero count does not make sense
-		// if f was something like 0.5 then go being "smart" elsewhere
-		return 0, fmt.Errorf("count must be greater than 0, was %q", signed)
+	if state != nil {
+		if err := b.snapshotBeforeChange(request.InstanceID, state, entry); err != nil {
+			return nil, err
+		}
 	}
 
-	return signed, nil
-}
+	if state != nil {
+		policy, err := b.getReclaimPolicy(state.PlanID, state.Parameters)
+		if err != nil {
+			return nil, err
+		}
 
-func getNamespace(context map[string]interface{}) (string, error) {
-	namespaceInterface := context["namespace"]
-	ns, ok := namespaceInterface.(string)
-	if !ok {
-		return "", fmt.Errorf(`key "namespace" in context is not a string`)
+		// The instance is only deleted once its resources are gone.
+		if policy == ReclaimPolicyDelete && !request.AcceptsIncomplete {
+			msg := osb.AsyncErrorMessage
+			description := "instances whose resources are deleted are deprovisioned asynchronously"
+			return nil, osb.HTTPStatusCodeError{
+				StatusCode:   http.StatusUnprocessableEntity,
+				ErrorMessage: &msg,
+				Description:  &description,
+			}
+		}
 	}
 
-	return ns, nil
-}
+	// Instances whose restore failed have nothing to back up, and those
+	// whose resources are being deleted were backed up already.
+	if state != nil && state.Restore == nil && !state.Reclaim && b.backup.Target != "" {
+		backup, err := getBackup(state.Parameters)
+		if err != nil {
+			return nil, err
+		}
 
-func getNamespaceConfigMapKey(name string) string {
-	return fmt.Sprintf("%s.namespace", name)
-}
+		if backup != nil {
+			// The instance is only deleted once its final backup is done.
+			if !request.AcceptsIncomplete {
+				msg := osb.AsyncErrorMessage
+				description := "instances which are backed up are deprovisioned asynchronously"
+				return nil, osb.HTTPStatusCodeError{
+					StatusCode:   http.StatusUnprocessableEntity,
+					ErrorMessage: &msg,
+					Description:  &description,
+				}
+			}
 
-func generateHabitatObject(planID string, params habitatParameters) (*habv1beta1.Habitat, error) {
-	n, i, err := matchService(planID)
+			if err := b.deprovisionBackedUp(request.InstanceID, state, backup, entry); err != nil {
+				return nil, err
+			}
+
+			key := osb.OperationKey(operationDeprovision)
+			response.Async = true
+			response.OperationKey = &key
+			return &response, nil
+		}
+	}
+
+	reclaiming, err := b.deleteResources(request.PlanID, request.InstanceID, entry)
 	if err != nil {
 		return nil, err
 	}
 
-	// Generate Habitat object based on service.
-	hab := NewHabitat(n, i, params)
+	if reclaiming {
+		key := osb.OperationKey(operationDeprovision)
+		response.Async = true
+		response.OperationKey = &key
+	}
 
-	return hab, nil
+	return &response, nil
 }
 
-func (b *BrokerLogic) deleteResources(planID, instanceID string) error {
-	name, _, err := matchService(planID)
+func (b *BrokerLogic) LastOperation(request *osb.LastOperationRequest, c *broker.RequestContext) (_ *broker.LastOperationResponse, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	state, err := b.getInstanceState(request.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if state == nil {
+		// The instance is gone, which is what the platform is waiting for
+		// after a deprovision.
+		msg := fmt.Sprintf("could not find state of instance %s in configmap %s", request.InstanceID, b.ConfigMap.Name)
+		return nil, newHTTPStatusCodeError(http.StatusGone, msg)
+	}
+
+	response := &broker.LastOperationResponse{}
+	response.State = osb.StateSucceeded
+
+	op := state.Operation
+	if op == nil {
+		return response, nil
+	}
+
+	if op.Type == operationDeprovision && state.Reclaim {
+		return b.reclaimLastOperation(request, state)
+	}
+	if op.Type == operationDeprovision {
+		return b.deprovisionLastOperation(request, state)
+	}
+
+	if state.Restore != nil {
+		return b.restoreLastOperation(request, state)
+	}
+
+	name, err := habitatName(state.PlanID, state.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := b.getEnv(state.PlanID, state.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	done, description, err := b.HabitatEnvRolledOut(name, state.Namespace, env)
+	if err != nil {
+		return nil, err
+	}
+
+	if !done && time.Since(op.Started) < operationTimeout {
+		response.State = osb.StateInProgress
+		response.Description = &description
+		return response, nil
+	}
+
+	entry := newAuditEntry(op.Type, request.InstanceID, state.ServiceID, state.PlanID, request.OriginatingIdentity, nil)
+	defer b.recordAudit(entry, &err)
+
+	if !done {
+		description = fmt.Sprintf("timed out after %v: %s", operationTimeout, description)
+		entry.Error = description
+		response.State = osb.StateFailed
+		response.Description = &description
+	}
+
+	state.Operation = nil
+	return response, b.setInstanceState(request.InstanceID, state)
+}
+
+func (b *BrokerLogic) Bind(request *osb.BindRequest, c *broker.RequestContext) (_ *broker.BindResponse, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	entry := newAuditEntry(operationBind, request.InstanceID, request.ServiceID, request.PlanID, request.OriginatingIdentity, request.Parameters)
+	entry.BindingID = request.BindingID
+	defer b.recordAudit(entry, &err)
+
+	response := broker.BindResponse{}
+
+	if request.AcceptsIncomplete {
+		response.Async = b.async
+	}
+
+	credentials, async, err := b.createBinding(request, response.Async, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if state, err := b.getInstanceState(request.InstanceID); err == nil && state != nil {
+		b.adoptResources(request.InstanceID, state)
+	}
+
+	response.Async = async
+	if response.Async {
+		// The credentials are fetched by the platform once the binding
+		// last operation succeeded.
+		key := osb.OperationKey(operationBind)
+		response.OperationKey = &key
+		return &response, nil
+	}
+
+	response.Credentials = credentials
+	response.Exists = true
+	return &response, nil
+}
+
+func (b *BrokerLogic) Unbind(request *osb.UnbindRequest, c *broker.RequestContext) (_ *broker.UnbindResponse, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	entry := newAuditEntry(operationUnbind, request.InstanceID, request.ServiceID, request.PlanID, request.OriginatingIdentity, nil)
+	entry.BindingID = request.BindingID
+	defer b.recordAudit(entry, &err)
+
+	response := broker.UnbindResponse{}
+
+	if request.AcceptsIncomplete {
+		response.Async = b.async
+	}
+
+	response.Async, err = b.deleteBinding(request, response.Async, entry)
+	if err != nil {
+		glog.Warningf("Error in unbind: %q", err)
+		return nil, err
+	}
+
+	if response.Async {
+		key := osb.OperationKey(operationUnbind)
+		response.OperationKey = &key
+	}
+
+	return &response, nil
+}
+
+// BindingLastOperation reports the progress of an asynchronous bind or
+// unbind. The operation succeeds once all pods of the Habitat have been
+// restarted with, or without, the config secret of the binding. Unbinding
+// deletes the config secret only then. Binds which wait for the pods to
+// create the user of the binding succeed once it's created. Binds which time
+// out are rolled back.
+func (b *BrokerLogic) BindingLastOperation(request *osb.BindingLastOperationRequest) (_ *broker.LastOperationResponse, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	state, err := b.getBindingState(request.BindingID)
+	if err != nil {
+		return nil, err
+	}
+
+	if state == nil || state.InstanceID != request.InstanceID {
+		// The binding is gone, which is what the platform is waiting
+		// for after an unbind.
+		msg := fmt.Sprintf("could not find state of binding %s of instance %s in configmap %s", request.BindingID, request.InstanceID, b.ConfigMap.Name)
+		return nil, newHTTPStatusCodeError(http.StatusGone, msg)
+	}
+
+	response := &broker.LastOperationResponse{}
+	response.State = osb.StateSucceeded
+
+	op := state.Operation
+	if op == nil {
+		return response, nil
+	}
+
+	name, _, err := matchService(state.PlanID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The outcome of the operation is audited separately from the request
+	// which started it, once it's finished.
+	entry := newAuditEntry(op.Type, request.InstanceID, "", state.PlanID, request.OriginatingIdentity, nil)
+	entry.BindingID = request.BindingID
+
+	var done bool
+	var description string
+	if pendingUser(name, state) {
+		done, description, err = b.createPendingUser(request.BindingID, name, state, entry)
+	} else {
+		done, description, err = b.HabitatRolledOut(name, state.Namespace, state.SecretName, op.Type == operationBind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !done && time.Since(op.Started) < operationTimeout {
+		response.State = osb.StateInProgress
+		response.Description = &description
+		return response, nil
+	}
+
+	defer b.recordAudit(entry, &err)
+
+	if !done {
+		description = fmt.Sprintf("timed out after %v: %s", operationTimeout, description)
+		entry.Error = description
+		response.State = osb.StateFailed
+		response.Description = &description
+
+		if op.Type == operationBind {
+			// The credentials are taken out of the config again and the
+			// binding is forgotten, so that a retry starts from scratch.
+			unbind := &osb.UnbindRequest{
+				InstanceID: request.InstanceID,
+				BindingID:  request.BindingID,
+				PlanID:     state.PlanID,
+			}
+			if _, err := b.deleteBinding(unbind, false, entry); err != nil {
+				return nil, fmt.Errorf("error rolling back binding %s: %v", request.BindingID, err)
+			}
+			return response, nil
+		}
+
+		// The pods may still use the config secret, which a retry of the
+		// unbind deletes.
+		state.Operation = nil
+		return response, b.setBindingState(request.BindingID, state)
+	}
+
+	switch op.Type {
+	case operationBind:
+		state.Operation = nil
+		if err := b.setBindingState(request.BindingID, state); err != nil {
+			return nil, err
+		}
+	case operationUnbind:
+		if err := b.deleteSecret(state.SecretName, state.Namespace); err != nil && !k8sErrors.IsNotFound(err) {
+			return nil, fmt.Errorf("error deleting secret: %v", err)
+		}
+		entry.deleted("Secret", state.Namespace, state.SecretName)
+
+		if err := b.deleteCredential(request.InstanceID, request.BindingID); err != nil {
+			return nil, err
+		}
+
+		if err := b.removeBindingState(request.BindingID); err != nil {
+			return nil, err
+		}
+	}
+
+	return response, nil
+}
+
+func (b *BrokerLogic) Update(request *osb.UpdateInstanceRequest, c *broker.RequestContext) (_ *broker.UpdateInstanceResponse, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	planID := ""
+	if request.PlanID != nil {
+		planID = *request.PlanID
+	}
+	entry := newAuditEntry(operationUpdate, request.InstanceID, request.ServiceID, planID, request.OriginatingIdentity, request.Parameters)
+	defer b.recordAudit(entry, &err)
+
+	response := broker.UpdateInstanceResponse{}
+	if request.AcceptsIncomplete {
+		response.Async = b.async
+	}
+
+	response.Async, err = b.updateInstance(request, response.Async, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Async {
+		key := osb.OperationKey(operationUpdate)
+		response.OperationKey = &key
+	}
+
+	return &response, nil
+}
+
+// GetInstance returns the service, plan and parameters of an instance from
+// the broker state.
+func (b *BrokerLogic) GetInstance(instanceID string) (*GetInstanceResponse, error) {
+	// The state is read under the lock, the pods, Builder and the backups
+	// are queried without it, as they may take their time to answer.
+	b.RLock()
+	state, err := b.getInstanceState(instanceID)
+	b.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if state == nil {
+		msg := fmt.Sprintf("could not find state of instance %s in configmap %s", instanceID, b.ConfigMap.Name)
+		return nil, newHTTPStatusCodeError(http.StatusNotFound, msg)
+	}
+
+	name, err := habitatName(state.PlanID, state.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := getChannel(state.PlanID, state.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &GetInstanceResponse{
+		ServiceID:    state.ServiceID,
+		PlanID:       state.PlanID,
+		DashboardURL: b.dashboardURL(instanceID),
+		Parameters:   state.Parameters,
+	}
+	b.addPackageStatus(response, name, state.Namespace, channel)
+
+	if b.backup.Target != "" {
+		if response.Backups, err = b.listBackups(state.Namespace, instanceID); err != nil {
+			glog.Warningf("error listing backups of instance %s: %v", instanceID, err)
+		}
+	}
+
+	if b.snapshotAPI != "" {
+		if response.Snapshots, err = b.listSnapshots(state.Namespace, instanceID); err != nil {
+			glog.Warningf("error listing snapshots of instance %s: %v", instanceID, err)
+		}
+	}
+
+	return response, nil
+}
+
+// GetBinding returns the parameters and the current credentials of a
+// binding.
+func (b *BrokerLogic) GetBinding(request *osb.GetBindingRequest) (*osb.GetBindingResponse, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	state, err := b.getBindingState(request.BindingID)
+	if err != nil {
+		return nil, err
+	}
+
+	if state == nil || state.InstanceID != request.InstanceID {
+		msg := fmt.Sprintf("could not find state of binding %s of instance %s in configmap %s", request.BindingID, request.InstanceID, b.ConfigMap.Name)
+		return nil, newHTTPStatusCodeError(http.StatusNotFound, msg)
+	}
+
+	if state.Operation != nil && state.Operation.Type == operationBind {
+		msg := fmt.Sprintf("binding %s of instance %s is still being created", request.BindingID, request.InstanceID)
+		return nil, newHTTPStatusCodeError(http.StatusNotFound, msg)
+	}
+
+	credentials, err := b.bindingCredentials(request.BindingID, state)
+	if err != nil {
+		return nil, err
+	}
+
+	return &osb.GetBindingResponse{
+		Credentials: credentials,
+		Parameters:  state.Parameters,
+	}, nil
+}
+
+// bindingCredentials returns the current credentials of a binding.
+func (b *BrokerLogic) bindingCredentials(bindingID string, state *bindingState) (map[string]interface{}, error) {
+	name, _, err := matchService(state.PlanID)
+	if err != nil {
+		return nil, err
+	}
+
+	var credentials map[string]interface{}
+
+	switch name {
+	case "redis":
+		if !hasRedisUser(bindingID, state) {
+			password, err := b.getRedisPassword(state.SecretName, state.Namespace)
+			if err != nil {
+				return nil, err
+			}
+
+			credentials = b.redisCredentials(name, state.Namespace, "", password)
+			break
+		}
+
+		var password string
+		if state.Rotation != nil {
+			// Both passwords are valid during the grace period, consumers
+			// pick up the new one.
+			password, err = b.getRotationPassword(state)
+		} else {
+			password, err = b.getBindingPassword(state.SecretName, state.Namespace)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		credentials = b.redisCredentials(name, state.Namespace, bindingIdentifier(bindingID), password)
+	case "postgresql":
+		password, err := b.getBindingPassword(state.SecretName, state.Namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		params, err := getPostgresqlBindingParameters(state.Parameters)
+		if err != nil {
+			return nil, err
+		}
+
+		credentials = b.postgresqlCredentials(name, state.Namespace, bindingIdentifier(bindingID), password, postgresqlDatabase(bindingID, params), params.readOnly)
+	case "rabbitmq":
+		password, err := b.getBindingPassword(state.SecretName, state.Namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		credentials = b.rabbitmqCredentials(name, state.Namespace, rabbitmqName(bindingID), password)
+	case "mongodb":
+		password, err := b.getBindingPassword(state.SecretName, state.Namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		hab, err := b.GetHabitat(name, state.Namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		if credentials, err = b.mongodbCredentials(hab, state.Namespace, bindingIdentifier(bindingID), password); err != nil {
+			return nil, err
+		}
+	case "nginx":
+		upstream, err := getNginxUpstream(state.Parameters)
+		if err != nil {
+			return nil, err
+		}
+
+		credentials = b.nginxCredentials(name, state.Namespace, upstream)
+	default:
+		return nil, fmt.Errorf("fetching bindings of %q is not implemented", name)
+	}
+
+	return credentials, nil
+}
+
+func (b *BrokerLogic) ValidateBrokerAPIVersion(version string) error {
+	return nil
+}
+
+const (
+	redisPort = 6379
+
+	// operationTimeout is the time asynchronous operations have to roll out
+	// to all pods.
+	operationTimeout = 10 * time.Minute
+)
+
+// The lifecycle operations of the broker. They double as the operation keys
+// of asynchronous operations.
+const (
+	operationProvision   = "provision"
+	operationUpdate      = "update"
+	operationDeprovision = "deprovision"
+	operationBind        = "bind"
+	operationUnbind      = "unbind"
+
+	// Credential rotations are started by an admin or on schedule, and
+	// finished once their grace period ends.
+	operationRotateCredentials = "rotate_credentials"
+	operationRevokeCredentials = "revoke_credentials"
+
+	// Snapshots are taken on demand by an admin.
+	operationSnapshot = "snapshot"
+
+	// Instances whose Habitat is deleted out of band are forgotten.
+	operationForget = "forget"
+)
+
+var topologySet = map[habv1beta1.Topology]struct{}{
+	habv1beta1.TopologyStandalone: {},
+	habv1beta1.TopologyLeader:     {},
+}
+
+// planTopologies are the topologies plans are fixed to. Other plans run the
+// topology of the `topology` parameter.
+var planTopologies = map[string]habv1beta1.Topology{
+	"6d537324-c8b6-489d-b6b9-f4495a87abbd": habv1beta1.TopologyLeader,
+	"0a5b3c1e-43a2-4c55-9e3b-6f0d2b8e7a14": habv1beta1.TopologyStandalone,
+	"c1d9e0f4-7b26-4f1a-a5d8-3e2b9c4f6d07": habv1beta1.TopologyLeader,
+	"5e8b1f3a-9c47-4d2e-b6a1-7d0c3f9e2a58": habv1beta1.TopologyStandalone,
+	"b4c2d7e9-1a3f-4b8c-9e5d-2f6a8c0b1d43": habv1beta1.TopologyLeader,
+}
+
+type habitatParameters struct {
+	group    string
+	topology habv1beta1.Topology
+	count    int
+	// persistent is set if services which keep data get a persistent
+	// volume for it.
+	persistent bool
+}
+
+func getTopology(planID string, params map[string]interface{}) (habv1beta1.Topology, error) {
+	fixed, isFixed := planTopologies[planID]
+
+	t, ok := params["topology"]
+	if !ok {
+		if isFixed {
+			return fixed, nil
+		}
+		return habv1beta1.TopologyStandalone, nil
+	}
+
+	s, ok := t.(string)
+	if !ok {
+		return habv1beta1.Topology(""), fmt.Errorf("topology %q is invalid", t)
+	}
+
+	topology := habv1beta1.Topology(s)
+	_, ok = topologySet[topology]
+	if !ok {
+		return habv1beta1.Topology(""), fmt.Errorf("topology %q is invalid", t)
+	}
+
+	if isFixed && topology != fixed {
+		msg := fmt.Sprintf("topology %q conflicts with the plan, which runs the %q topology", topology, fixed)
+		return habv1beta1.Topology(""), newHTTPStatusCodeError(http.StatusBadRequest, msg)
+	}
+
+	return topology, nil
+}
+
+func getGroup(params map[string]interface{}) (string, error) {
+	g, ok := params["group"]
+	if !ok {
+		return "default", nil
+	}
+
+	s, ok := g.(string)
+	if !ok {
+		return "", fmt.Errorf("group %q is invalid", g)
+	}
+
+	return s, nil
+}
+
+// leaderMinCount is the smallest number of members the Supervisors of the
+// leader topology elect a leader with.
+const leaderMinCount = 3
+
+func getCount(topology habv1beta1.Topology, params map[string]interface{}) (int, error) {
+	c, ok := params["count"]
+	if !ok {
+		if topology == habv1beta1.TopologyLeader {
+			return leaderMinCount, nil
+		}
+		return 1, nil
+	}
+
+	// The `count` is passed down as a float64. We type assert before being
+	// able to play around with it.
+	f, ok := c.(float64)
+	if !ok {
+		return 0, fmt.Errorf("type assertion of count as float64 failed: %q", c)
+	}
+
+	signed := int(f)
+	if signed < 1 {
+		// fail, because f is either negative or zero, and zero count does not make sense
+		// if f was something like 0.5 then go being "smart" elsewhere
+		return 0, fmt.Errorf("count must be greater than 0, was %d", signed)
+	}
+
+	if topology == habv1beta1.TopologyLeader && signed < leaderMinCount {
+		msg := fmt.Sprintf("count must be at least %d for the %q topology, was %d", leaderMinCount, topology, signed)
+		return 0, newHTTPStatusCodeError(http.StatusBadRequest, msg)
+	}
+
+	return signed, nil
+}
+
+func getNamespace(context map[string]interface{}) (string, error) {
+	namespaceInterface := context["namespace"]
+	ns, ok := namespaceInterface.(string)
+	if !ok {
+		return "", fmt.Errorf(`key "namespace" in context is not a string`)
+	}
+
+	return ns, nil
+}
+
+func newHTTPStatusCodeError(statusCode int, msg string) error {
+	return osb.HTTPStatusCodeError{
+		StatusCode:   statusCode,
+		ErrorMessage: &msg,
+	}
+}
+
+func getNamespaceConfigMapKey(name string) string {
+	return fmt.Sprintf("%s.namespace", name)
+}
+
+func (b *BrokerLogic) generateHabitatObject(planID string, parameters map[string]interface{}, params habitatParameters) (*habv1beta1.Habitat, error) {
+	if planID == habitatPackagePlanID {
+		return b.newPackageHabitat(parameters, params)
+	}
+
+	n, i, err := matchService(planID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate Habitat object based on service.
+	hab := NewHabitat(n, i, params)
+
+	if _, ok := dataMountPaths[n]; ok && !params.persistent {
+		glog.Warningf("%s keeps its data in its pods, the habitat-operator understands the %s spec of Habitats, which lacks persistent storage", n, b.habitatSpec)
+	}
+
+	return hab, nil
+}
+
+// deleteResources deletes the Habitat of an instance and the resources the
+// broker created for it. It reports whether the volumes, secrets and
+// services of the instance are being deleted, in which case the instance is
+// only forgotten once they're gone.
+func (b *BrokerLogic) deleteResources(planID, instanceID string, entry *AuditEntry) (bool, error) {
+	state, err := b.getInstanceState(instanceID)
+	if err != nil {
+		return false, err
+	}
+
+	var params map[string]interface{}
+	if state != nil {
+		params = state.Parameters
+	}
+
+	name, err := habitatName(planID, params)
+	if err != nil {
+		return false, err
+	}
+
+	key := getNamespaceConfigMapKey(instanceID)
+	// TODO: Should we fetch from the API instead?
+	ns, ok := b.ConfigMap.Data[key]
+	if !ok {
+		msg := fmt.Sprintf("could not find namespace for instance %s in configmap %s", instanceID, b.ConfigMap.Name)
+		return false, osb.HTTPStatusCodeError{
+			StatusCode:   http.StatusNotFound,
+			ErrorMessage: &msg,
+		}
+	}
+
+	// Instances whose restore failed have no Habitat.
+	if err := b.DeleteHabitat(name, ns); err == nil {
+		entry.deleted(habv1beta1.HabitatKind, ns, name)
+	} else if !k8sErrors.IsNotFound(err) {
+		return false, err
+	}
+
+	if err := b.deleteJob(restoreJobName(instanceID), ns, entry); err != nil {
+		return false, err
+	}
+
+	if state != nil {
+		if err := b.deleteRingKeys(state.Ring, ns, instanceID, entry); err != nil {
+			return false, err
+		}
+	}
+
+	if err := b.removeBackups(ns, instanceID, entry); err != nil {
+		return false, err
+	}
+
+	secretName := configSecretName(name, instanceID)
+	if err := b.deleteSecret(secretName, ns); err == nil {
+		entry.deleted("Secret", ns, secretName)
+	} else if !k8sErrors.IsNotFound(err) {
+		return false, fmt.Errorf("error deleting secret: %v", err)
+	}
+
+	// Instances provisioned by older versions of the broker have no state
+	// to wait for their resources in, so they're retained.
+	if state != nil {
+		policy, err := b.getReclaimPolicy(state.PlanID, state.Parameters)
+		if err != nil {
+			return false, err
+		}
+
+		if policy == ReclaimPolicyDelete {
+			if err := b.reclaim(name, ns, instanceID, entry); err != nil {
+				return false, err
+			}
+
+			if !state.Reclaim || state.Operation == nil {
+				state.Operation = newOperationState(operationDeprovision)
+			}
+			state.Reclaim = true
+			return true, b.setInstanceState(instanceID, state)
+		}
+	}
+
+	return false, b.forgetInstance(instanceID)
+}
+
+// forgetInstance removes the state of an instance from the configmap.
+func (b *BrokerLogic) forgetInstance(instanceID string) error {
+	if _, ok := b.ConfigMap.Data[getInstanceConfigMapKey(instanceID)]; ok {
+		if err := b.removeFromConfigMap(getInstanceConfigMapKey(instanceID)); err != nil {
+			return err
+		}
+	}
+
+	return b.removeFromConfigMap(getNamespaceConfigMapKey(instanceID))
+}
+
+func matchService(planID string) (string, string, error) {
+	name := ""
+	image := ""
+
+	switch planID {
+	case "002341cf-f895-49f4-ba04-bb70291b895c":
+		name = "redis"
+		image = "kinvolk/osb-redis:latest" // TODO: find a better way than latest!
+	case "86064792-7ea2-467b-af93-ac9694d96d5b":
+		name = "nginx"
+		image = "kinvolk/osb-nginx:latest" // TODO: find a better way than latest!
+	case "9d702792-2f55-4b45-83b7-f3ba0c689cd3", "6d537324-c8b6-489d-b6b9-f4495a87abbd":
+		name = "postgresql"
+		image = "kinvolk/osb-postgresql:11.2"
+	case "0a5b3c1e-43a2-4c55-9e3b-6f0d2b8e7a14", "c1d9e0f4-7b26-4f1a-a5d8-3e2b9c4f6d07":
+		name = "rabbitmq"
+		image = "kinvolk/osb-rabbitmq:3.7.14"
+	case "5e8b1f3a-9c47-4d2e-b6a1-7d0c3f9e2a58", "b4c2d7e9-1a3f-4b8c-9e5d-2f6a8c0b1d43":
+		name = "mongodb"
+		image = "kinvolk/osb-mongodb:4.0.9"
+	case "":
+		return name, image, fmt.Errorf("PlanID could not be matched. PlanID was empty.")
+	default:
+		return name, image, fmt.Errorf("PlanID could not be matched. PlanID did not match existing PlanID.")
+	}
+
+	return name, image, nil
+}
+
+func (b *BrokerLogic) createHabitatResource(hab *habv1beta1.Habitat, instanceID string, state *instanceState) error {
+	if err := b.CreateHabitat(hab, state.Namespace); err != nil {
+		return err
+	}
+
+	key := getNamespaceConfigMapKey(instanceID)
+	if err := b.addToConfigMap(key, state.Namespace); err != nil {
+		return err
+	}
+
+	return b.setInstanceState(instanceID, state)
+}
+
+// updatableParameters are the parameters an update applies. The others,
+// like the topology or the binds, only take effect when an instance is
+// provisioned, so an update may only repeat them as they were provisioned.
+var updatableParameters = map[string]bool{
+	"count":         true,
+	"config":        true,
+	"channel":       true,
+	"env":           true,
+	"backup":        true,
+	"reclaimPolicy": true,
+	"rotateRingKey": true,
+}
+
+// updateInstance applies the update to the Habitat of an instance. Changes
+// to the environment restart all pods, so if async is set, it returns true to
+// make the platform poll the rollout.
+func (b *BrokerLogic) updateInstance(request *osb.UpdateInstanceRequest, async bool, entry *AuditEntry) (bool, error) {
+	state, err := b.getInstanceState(request.InstanceID)
+	if err != nil {
+		return false, err
+	}
+
+	if state == nil {
+		if state, err = b.legacyInstanceState(request); err != nil {
+			return false, err
+		}
+	}
+
+	if state == nil {
+		msg := fmt.Sprintf("could not find state of instance %s in configmap %s", request.InstanceID, b.ConfigMap.Name)
+		return false, newHTTPStatusCodeError(http.StatusNotFound, msg)
+	}
+
+	name, err := habitatName(state.PlanID, state.Parameters)
+	if err != nil {
+		return false, err
+	}
+
+	for key, value := range request.Parameters {
+		// Platforms may send all parameters of the instance along with the
+		// ones which change.
+		if provisioned, ok := state.Parameters[key]; !updatableParameters[key] && (!ok || !reflect.DeepEqual(value, provisioned)) {
+			msg := fmt.Sprintf("the %s of an instance can not be changed, it must be provisioned again", key)
+			return false, newHTTPStatusCodeError(http.StatusBadRequest, msg)
+		}
+	}
+
+	rotate, err := getRotateRingKey(request.Parameters)
+	if err != nil {
+		return false, err
+	}
+
+	_, rechannel := request.Parameters["channel"]
+	channel, err := getChannel(state.PlanID, request.Parameters)
+	if err != nil {
+		return false, err
+	}
+	if rechannel {
+		if err := b.verifyHabitatSpec(nil, channel); err != nil {
+			return false, err
+		}
+	}
+
+	_, reenv := request.Parameters["env"]
+	env, err := b.getEnv(state.PlanID, request.Parameters)
+	if err != nil {
+		return false, err
+	}
+	if err := b.verifyEnvRefs(env, state.Namespace); err != nil {
+		return false, err
+	}
+	async = async && reenv
+
+	_, reconfigure := request.Parameters["config"]
+	config, err := getConfig(configService(state.PlanID, name), request.Parameters)
+	if err != nil {
+		return false, err
+	}
+
+	count := state.Count
+	if _, ok := request.Parameters["count"]; ok {
+		topology, err := getTopology(state.PlanID, state.Parameters)
+		if err != nil {
+			return false, err
+		}
+		if count, err = getCount(topology, request.Parameters); err != nil {
+			return false, err
+		}
+	}
+
+	if err := b.enforcePolicy(request.InstanceID, state.ServiceID, state.PlanID, state.Namespace, nil, count); err != nil {
+		return false, err
+	}
+
+	if err := b.snapshotBeforeChange(request.InstanceID, state, entry); err != nil {
+		return false, err
+	}
+
+	if _, ok := request.Parameters["reclaimPolicy"]; ok {
+		if _, err := b.getReclaimPolicy(state.PlanID, request.Parameters); err != nil {
+			return false, err
+		}
+	}
+
+	if _, rebackup := request.Parameters["backup"]; rebackup {
+		if err := b.updateBackups(request.InstanceID, name, state.Namespace, request.Parameters, entry); err != nil {
+			return false, err
+		}
+	}
+
+	if count != state.Count || reconfigure || rechannel || reenv {
+		hab, err := b.GetHabitat(name, state.Namespace)
+		if err != nil {
+			return false, err
+		}
+
+		changed := count != state.Count || rechannel || reenv
+		hab.Spec.V1beta2.Count = count
+		if reenv {
+			hab.Spec.V1beta2.Env = env
+		}
+		if rechannel {
+			hab.Spec.V1beta2.Service.Channel = &channel
+		}
+
+		previous := hab.Spec.V1beta2.Service.ConfigSecretName
+		if reconfigure {
+			credentials, err := b.getConfigCredentials(hab, state.Namespace)
+			if err != nil {
+				return false, err
+			}
+
+			_, updated, err := b.composeConfig(hab, state.Namespace, request.InstanceID, state.PlanID, config, credentials, entry)
+			if err != nil {
+				return false, err
+			}
+			changed = changed || updated
+		}
+
+		if changed {
+			if err := b.updateHabitatConfig(hab, state.Namespace, entry); err != nil {
+				return false, err
+			}
+		}
+
+		if current := hab.Spec.V1beta2.Service.ConfigSecretName; previous != nil && (current == nil || *current != *previous) {
+			if err := b.deleteSecret(*previous, state.Namespace); err != nil && !k8sErrors.IsNotFound(err) {
+				return false, fmt.Errorf("error deleting secret: %v", err)
+			}
+			entry.deleted("Secret", state.Namespace, *previous)
+		}
+	}
+
+	if state.Parameters == nil {
+		state.Parameters = map[string]interface{}{}
+	}
+	for k, v := range request.Parameters {
+		if !updatableParameters[k] || k == "rotateRingKey" {
+			continue
+		}
+		state.Parameters[k] = v
+	}
+	state.Count = count
+	b.adoptResources(request.InstanceID, state)
+
+	if async {
+		state.Operation = newOperationState(operationUpdate)
+	}
+
+	if rotate {
+		if state.Ring == "" {
+			// The instance has gossiped in cleartext so far.
+			state.Ring = sharedRingName
+		}
+		if err := b.setInstanceState(request.InstanceID, state); err != nil {
+			return false, err
+		}
+
+		_, err := b.rotateRingKey(state.Ring, state.Namespace, entry)
+		return async, err
+	}
+
+	return async, b.setInstanceState(request.InstanceID, state)
+}
+
+// createBinding creates a binding. Redis, PostgreSQL, RabbitMQ and MongoDB
+// bindings get a user of their own, which is ready once it's created. If
+// async is set and the pods of the instance aren't ready, the binding is
+// created asynchronously, and gets its user once they're ready, see
+// prepareUserBinding. Nginx bindings which register an upstream add it to
+// the config of the instance, and unless async is set, wait for the config
+// secret to become visible. It returns whether the binding indeed happens
+// asynchronously.
+func (b *BrokerLogic) createBinding(request *osb.BindRequest, async bool, entry *AuditEntry) (map[string]interface{}, bool, error) {
+	if request.PlanID == habitatPackagePlanID {
+		return nil, false, newHTTPStatusCodeError(http.StatusBadRequest, "instances of the habitat-package service are not bindable")
+	}
+
+	name, _, err := matchService(request.PlanID)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
-	key := getNamespaceConfigMapKey(instanceID)
-	// TODO: Should we fetch from the API instead?
+	key := getNamespaceConfigMapKey(request.InstanceID)
 	ns, ok := b.ConfigMap.Data[key]
 	if !ok {
-		msg := fmt.Sprintf("could not find namespace for instance %s in configmap %s", instanceID, b.ConfigMap.Name)
-		return osb.HTTPStatusCodeError{
+		msg := fmt.Sprintf("could not find namespace for instance %s in configmap %s", request.InstanceID, b.ConfigMap.Name)
+		return nil, false, osb.HTTPStatusCodeError{
 			StatusCode:   http.StatusNotFound,
 			ErrorMessage: &msg,
 		}
 	}
 
-	err = b.DeleteHabitat(name, ns)
+	existing, err := b.getBindingState(request.BindingID)
 	if err != nil {
-		return err
+		return nil, false, err
+	}
+	if existing != nil {
+		return b.repeatBinding(request, existing, async)
 	}
 
-	return b.removeFromConfigMap(key)
-}
+	state := &bindingState{
+		InstanceID:        request.InstanceID,
+		PlanID:            request.PlanID,
+		Namespace:         ns,
+		Parameters:        request.Parameters,
+		CredentialsIssued: time.Now().UTC(),
+	}
 
-func matchService(planID string) (string, string, error) {
-	name := ""
-	image := ""
+	var credentials map[string]interface{}
 
-	switch planID {
-	case "002341cf-f895-49f4-ba04-bb70291b895c":
-		name = "redis"
-		image = "kinvolk/osb-redis:latest" // TODO: find a better way than latest!
-	case "86064792-7ea2-467b-af93-ac9694d96d5b":
-		name = "nginx"
-		image = "kinvolk/osb-nginx:latest" // TODO: find a better way than latest!
-	case "":
-		return name, image, fmt.Errorf("PlanID could not be matched. PlanID was empty.")
+	switch name {
+	case "redis", "postgresql", "rabbitmq", "mongodb":
+		waiting, err := b.prepareUserBinding(name, request, ns, async, entry)
+		if err != nil {
+			return nil, false, err
+		}
+		if waiting {
+			// The user is created once the pods are ready.
+			break
+		}
+
+		async = false
+		if credentials, err = b.createBindingUser(name, request, state, entry); err != nil {
+			return nil, false, err
+		}
+	case "nginx":
+		upstream, err := getNginxUpstream(request.Parameters)
+		if err != nil {
+			return nil, false, err
+		}
+
+		// Only bindings which register an upstream change the config.
+		async = async && upstream != nil
+		if upstream != nil {
+			hab, err := b.GetHabitat(name, ns)
+			if err != nil {
+				return nil, false, err
+			}
+
+			layer, err := b.registerNginxUpstream(hab, ns, request.BindingID, upstream)
+			if err != nil {
+				return nil, false, err
+			}
+
+			if state.SecretName, err = b.applyBindingConfig(hab, ns, request.InstanceID, request.PlanID, layer, async, entry); err != nil {
+				return nil, false, err
+			}
+		}
+
+		credentials = b.nginxCredentials(name, ns, upstream)
 	default:
-		return name, image, fmt.Errorf("PlanID could not be matched. PlanID did not match existing PlanID.")
+		return nil, false, fmt.Errorf("Binding for %q is not implemented.", name)
 	}
 
-	return name, image, nil
-}
+	if async {
+		state.Operation = newOperationState(operationBind)
+	}
 
-func (b *BrokerLogic) createHabitatResource(hab *habv1beta1.Habitat, namespace, instanceID string) error {
-	if err := b.CreateHabitat(hab, namespace); err != nil {
-		return err
+	if err := b.setBindingState(request.BindingID, state); err != nil {
+		return nil, false, err
 	}
 
-	key := getNamespaceConfigMapKey(instanceID)
-	return b.addToConfigMap(key, namespace)
+	return credentials, async, nil
 }
 
-func (b *BrokerLogic) createBinding(request *osb.BindRequest) error {
-	name, _, err := matchService(request.PlanID)
+// repeatBinding answers a bind of a binding which exists already. A bind with
+// the same attributes gets the credentials of the binding, or is told to keep
+// polling if the binding is still being created. Binds with other attributes
+// conflict with the binding.
+func (b *BrokerLogic) repeatBinding(request *osb.BindRequest, existing *bindingState, async bool) (map[string]interface{}, bool, error) {
+	if !sameBinding(request, existing) {
+		msg := fmt.Sprintf("binding %s already exists for instance %s with other attributes", request.BindingID, existing.InstanceID)
+		return nil, false, newHTTPStatusCodeError(http.StatusConflict, msg)
+	}
+
+	if op := existing.Operation; op != nil {
+		if op.Type == operationBind && async {
+			return nil, true, nil
+		}
+
+		msg := fmt.Sprintf("binding %s is busy with operation %q", request.BindingID, op.Type)
+		return nil, false, newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+	}
+
+	credentials, err := b.bindingCredentials(request.BindingID, existing)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
-	key := getNamespaceConfigMapKey(request.InstanceID)
-	ns, ok := b.ConfigMap.Data[key]
-	if !ok {
-		msg := fmt.Sprintf("could not find namespace for instance %s in configmap %s", request.InstanceID, b.ConfigMap.Name)
-		return osb.HTTPStatusCodeError{
-			StatusCode:   http.StatusNotFound,
-			ErrorMessage: &msg,
+	return credentials, false, nil
+}
+
+// sameBinding reports whether the bind asks for the binding as it exists.
+func sameBinding(request *osb.BindRequest, existing *bindingState) bool {
+	if request.InstanceID != existing.InstanceID || request.PlanID != existing.PlanID {
+		return false
+	}
+
+	// Parameters don't survive the state as empty objects.
+	if len(request.Parameters) == 0 && len(existing.Parameters) == 0 {
+		return true
+	}
+
+	return reflect.DeepEqual(request.Parameters, existing.Parameters)
+}
+
+// prepareUserBinding returns whether the bind of a binding with a user of its
+// own waits for the pods of the instance, which create the user once
+// they're all ready and run with the current config, see createPendingUser.
+// Asynchronous binds wait while they're not, others create the user right
+// away. Redis instances which restart with a password always wait.
+func (b *BrokerLogic) prepareUserBinding(name string, request *osb.BindRequest, namespace string, async bool, entry *AuditEntry) (bool, error) {
+	switch name {
+	case "redis":
+		restarting, err := b.prepareRedisBinding(request, namespace, async, entry)
+		if err != nil || restarting {
+			return restarting, err
+		}
+	case "postgresql":
+		// The parameters are checked before the bind waits.
+		if _, err := getPostgresqlBindingParameters(request.Parameters); err != nil {
+			return false, err
 		}
 	}
 
+	if !async {
+		return false, nil
+	}
+
+	hab, err := b.GetHabitat(name, namespace)
+	if err != nil {
+		return false, err
+	}
+
+	ready, _, err := b.habitatReady(hab, namespace)
+	return !ready, err
+}
+
+// createBindingUser creates the user of a binding on the servers of the
+// instance, and returns the credentials of the binding.
+func (b *BrokerLogic) createBindingUser(name string, request *osb.BindRequest, state *bindingState, entry *AuditEntry) (map[string]interface{}, error) {
 	switch name {
 	case "redis":
-		password := randSeq(10)
-		dataString := fmt.Sprintf("requirepass = %q", password)
+		return b.createRedisBinding(request, state, entry)
+	case "postgresql":
+		return b.createPostgresqlBinding(request, state, entry)
+	case "rabbitmq":
+		return b.createRabbitmqBinding(request, state, entry)
+	case "mongodb":
+		return b.createMongodbBinding(request, state, entry)
+	}
 
-		hab, err := b.GetHabitat(name, ns)
-		if err != nil {
-			return err
+	return nil, fmt.Errorf("users of %q bindings are not implemented", name)
+}
+
+// pendingUser reports whether the bind of a binding waits for the pods of the
+// instance to create its user.
+func pendingUser(name string, state *bindingState) bool {
+	if state == nil || state.SecretName != "" || state.Operation == nil || state.Operation.Type != operationBind {
+		return false
+	}
+
+	switch name {
+	case "redis", "postgresql", "rabbitmq", "mongodb":
+		return true
+	}
+
+	return false
+}
+
+// createPendingUser creates the user of a binding whose bind waits for the
+// pods of the instance, once all of them are ready and run with its current
+// config. Failures are retried by the next poll, until the bind times out.
+func (b *BrokerLogic) createPendingUser(bindingID, name string, state *bindingState, entry *AuditEntry) (bool, string, error) {
+	hab, err := b.GetHabitat(name, state.Namespace)
+	if err != nil {
+		return false, "", err
+	}
+
+	ready, description, err := b.habitatReady(hab, state.Namespace)
+	if err != nil || !ready {
+		return false, description, err
+	}
+
+	request := &osb.BindRequest{
+		InstanceID: state.InstanceID,
+		BindingID:  bindingID,
+		PlanID:     state.PlanID,
+		Parameters: state.Parameters,
+	}
+	if _, err := b.createBindingUser(name, request, state, entry); err != nil {
+		return false, fmt.Sprintf("error creating the user of the binding: %v", err), nil
+	}
+
+	return true, "", nil
+}
+
+// forgetPendingBinding deletes a binding whose user was never created. Users
+// which were created on some servers are taken over by a retry of the bind.
+func (b *BrokerLogic) forgetPendingBinding(request *osb.UnbindRequest, name, namespace string, entry *AuditEntry) error {
+	secretName := derivedSecretName(fmt.Sprintf("habitat-osb-%s-binding", name), request.BindingID)
+	if err := b.deleteSecret(secretName, namespace); err == nil {
+		entry.deleted("Secret", namespace, secretName)
+	} else if !k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting secret %s: %v", secretName, err)
+	}
+
+	if err := b.deleteCredential(request.InstanceID, request.BindingID); err != nil {
+		return err
+	}
+
+	return b.removeBindingState(request.BindingID)
+}
+
+// applyBindingConfig composes the config of an instance with the credentials
+// layer of a binding, and updates the Habitat if its config secret changed.
+// Unless async is set, it waits for the config secret to become visible. It
+// returns the name of the config secret.
+func (b *BrokerLogic) applyBindingConfig(hab *habv1beta1.Habitat, namespace, instanceID, planID string, credentials map[string]interface{}, async bool, entry *AuditEntry) (string, error) {
+	name, _, err := matchService(planID)
+	if err != nil {
+		return "", err
+	}
+
+	config, err := b.instanceConfig(instanceID, name)
+	if err != nil {
+		return "", err
+	}
+
+	secretName, changed, err := b.composeConfig(hab, namespace, instanceID, planID, config, credentials, entry)
+	if err != nil {
+		return "", err
+	}
+
+	if !async {
+		if err := b.verifySecretExists(secretName, namespace); err != nil {
+			return "", err
 		}
+	}
 
-		if hab.Spec.V1beta2.Service.Topology == habv1beta1.TopologyLeader {
-			dataString = fmt.Sprintf("%s\nmasterauth = %q", dataString, password)
+	if changed {
+		if err := b.updateHabitatConfig(hab, namespace, entry); err != nil {
+			return "", err
 		}
+	}
 
-		secret, err := b.createSecret("habitat-osb-redis", "user.toml", dataString, ns)
+	return secretName, nil
+}
+
+// instanceCredentialsLayer returns the config layer with the credentials a
+// new instance of the service runs with.
+func (b *BrokerLogic) instanceCredentialsLayer(hab *habv1beta1.Habitat) (map[string]interface{}, error) {
+	switch hab.Name {
+	case "redis":
+		password, err := b.generatePassword("redis")
 		if err != nil {
-			return err
+			return nil, err
 		}
+		return redisCredentialsLayer(hab, password), nil
+	case "postgresql":
+		return b.postgresqlCredentialsLayer()
+	case "rabbitmq":
+		return b.rabbitmqCredentialsLayer()
+	case "mongodb":
+		return b.mongodbCredentialsLayer(hab)
+	}
 
-		err = b.verifySecretExists(secret.Name, ns)
-		if err != nil {
-			return err
+	return nil, nil
+}
+
+// redisCredentialsLayer returns the config layer with the password of the
+// default user of a redis instance, which only the broker uses. Replicas
+// authenticate with the same password.
+func redisCredentialsLayer(hab *habv1beta1.Habitat, password string) map[string]interface{} {
+	layer := map[string]interface{}{
+		"requirepass": password,
+	}
+
+	if hab.Spec.V1beta2.Service.Topology == habv1beta1.TopologyLeader {
+		layer["masterauth"] = password
+	}
+
+	return layer
+}
+
+// redisCredentials returns the credentials of a redis binding. Bindings of
+// older versions of the broker have no user. The host is only known if the
+// user created a Service for the Habitat pods.
+func (b *BrokerLogic) redisCredentials(name, namespace, user, password string) map[string]interface{} {
+	credentials := map[string]interface{}{
+		"password": password,
+		"port":     redisPort,
+	}
+	if user != "" {
+		credentials["username"] = user
+	}
+
+	if host := b.findServiceHost(name, namespace); host != "" {
+		credentials["host"] = host
+		uri := url.URL{
+			Scheme: "redis",
+			User:   url.UserPassword(user, password),
+			Host:   fmt.Sprintf("%s:%d", host, redisPort),
 		}
+		credentials["uri"] = uri.String()
+	}
 
-		hab.Kind = habv1beta1.HabitatKind
-		hab.APIVersion = habv1beta1.SchemeGroupVersion.String()
-		hab.Spec.V1beta2.Service.ConfigSecretName = &secret.Name
+	return credentials
+}
 
-		err = b.UpdateHabitat(hab, ns)
-		if err != nil {
-			return err
+// getRedisPassword reads the password from the user.toml in the given
+// secret.
+func (b *BrokerLogic) getRedisPassword(secretName, namespace string) (string, error) {
+	secret, err := b.Clients.KubeClient.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	config := map[string]interface{}{}
+	if _, err := toml.Decode(string(secret.Data["user.toml"]), &config); err != nil {
+		return "", fmt.Errorf("error decoding user.toml of secret %s: %v", secretName, err)
+	}
+
+	password, ok := config["requirepass"].(string)
+	if !ok {
+		return "", fmt.Errorf("secret %s has no redis password", secretName)
+	}
+
+	return password, nil
+}
+
+// getBindingPassword reads the password of a binding with a user of its own
+// from the secret of the binding.
+func (b *BrokerLogic) getBindingPassword(secretName, namespace string) (string, error) {
+	secret, err := b.Clients.KubeClient.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	password, ok := secret.Data["password"]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no password", secretName)
+	}
+
+	return string(password), nil
+}
+
+// findService returns the first Service which selects the pods of the given
+// Habitat, or nil if there's none.
+func (b *BrokerLogic) findService(name, namespace string) *v1.Service {
+	services, err := b.Clients.KubeClient.CoreV1().Services(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		glog.Warningf("error listing services in namespace %s: %v", namespace, err)
+		return nil
+	}
+
+	for i, svc := range services.Items {
+		if svc.Spec.Selector[habv1beta1.HabitatNameLabel] == name {
+			return &services.Items[i]
 		}
-	default:
-		return fmt.Errorf("Binding for %q is not implemented.", name)
 	}
 
 	return nil
 }
 
-func (b *BrokerLogic) deleteBinding(request *osb.UnbindRequest) error {
+// findServiceHost returns the cluster DNS name of the first Service which
+// selects the pods of the given Habitat, or an empty string if there's none.
+func (b *BrokerLogic) findServiceHost(name, namespace string) string {
+	svc := b.findService(name, namespace)
+	if svc == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%s.%s.svc.cluster.local", svc.Name, namespace)
+}
+
+// deleteBinding deletes the user of a binding, or removes the upstream of an
+// nginx binding from the config. Redis instances get a new password once the
+// last binding of an older version of the broker, which shared it, is
+// deleted. If the Habitat is left without a config secret and async is set,
+// the secret is only deleted once all pods have been restarted without it,
+// see BindingLastOperation. It returns whether the unbinding indeed happens
+// asynchronously.
+func (b *BrokerLogic) deleteBinding(request *osb.UnbindRequest, async bool, entry *AuditEntry) (bool, error) {
 	name, _, err := matchService(request.PlanID)
 	if err != nil {
-		return fmt.Errorf("error matching service: %v", err)
+		return false, fmt.Errorf("error matching service: %v", err)
 	}
 
 	key := getNamespaceConfigMapKey(request.InstanceID)
@@ -512,90 +2015,198 @@ func (b *BrokerLogic) deleteBinding(request *osb.UnbindRequest) error {
 	ns, ok := b.ConfigMap.Data[key]
 	if !ok {
 		msg := fmt.Sprintf("could not find namespace for instance %s in configmap %s", request.InstanceID, b.ConfigMap.Name)
-		return osb.HTTPStatusCodeError{
+		return false, osb.HTTPStatusCodeError{
 			StatusCode:   http.StatusNotFound,
 			ErrorMessage: &msg,
 		}
 	}
 
+	state, err := b.getBindingState(request.BindingID)
+	if err != nil {
+		return false, err
+	}
+
+	if pendingUser(name, state) {
+		return false, b.forgetPendingBinding(request, name, ns, entry)
+	}
+
+	if err := b.abortRotation(state, entry); err != nil {
+		return false, err
+	}
+
 	hab, err := b.GetHabitat(name, ns)
 	if err != nil {
-		return fmt.Errorf("error getting Habitat service: %v", err)
+		return false, fmt.Errorf("error getting Habitat service: %v", err)
 	}
 
 	switch name {
 	case "redis":
-		secretName := hab.Spec.V1beta2.Service.ConfigSecretName
-		if secretName == nil {
-			return fmt.Errorf("unbinding failed for %q as %q is nil", name, "configSecretName")
+		if hasRedisUser(request.BindingID, state) {
+			if err := b.deleteRedisBinding(request, state, entry); err != nil {
+				return false, err
+			}
+		} else {
+			shared, err := b.sharesAdminPassword(request.InstanceID, request.BindingID)
+			if err != nil {
+				return false, err
+			}
+
+			if !shared {
+				started, err := b.rekeyRedis(request, hab, ns, state, async, entry)
+				if err != nil || started {
+					return started, err
+				}
+			}
+		}
+
+		if err := b.deleteCredential(request.InstanceID, request.BindingID); err != nil {
+			return false, err
 		}
 
-		hab.Kind = habv1beta1.HabitatKind
-		hab.APIVersion = habv1beta1.SchemeGroupVersion.String()
-		hab.Spec.V1beta2.Service.ConfigSecretName = nil
+		if err := b.removeBindingState(request.BindingID); err != nil {
+			return false, err
+		}
+	case "nginx":
+		var upstream *nginxUpstream
+		if state != nil {
+			if upstream, err = getNginxUpstream(state.Parameters); err != nil {
+				return false, err
+			}
+		}
+
+		if upstream != nil {
+			layer, err := b.getConfigCredentials(hab, ns)
+			if err != nil {
+				return false, err
+			}
+
+			upstreams := nginxUpstreamsLayer(layer)
+			delete(upstreams, request.BindingID)
+
+			started, err := b.releaseBindingConfig(request, hab, ns, state, nginxCredentialsLayer(upstreams), async, entry)
+			if err != nil || started {
+				return started, err
+			}
+		}
 
-		if err := b.UpdateHabitat(hab, ns); err != nil {
-			return fmt.Errorf("error updating habitat: %v", err)
+		if err := b.removeBindingState(request.BindingID); err != nil {
+			return false, err
+		}
+	case "postgresql", "rabbitmq", "mongodb":
+		if state == nil {
+			msg := fmt.Sprintf("could not find state of binding %s in configmap %s", request.BindingID, b.ConfigMap.Name)
+			return false, newHTTPStatusCodeError(http.StatusGone, msg)
 		}
 
-		err := b.deleteSecret(*secretName, ns)
+		switch name {
+		case "postgresql":
+			err = b.deletePostgresqlBinding(request, state, entry)
+		case "rabbitmq":
+			err = b.deleteRabbitmqBinding(request, state, entry)
+		case "mongodb":
+			err = b.deleteMongodbBinding(request, state, entry)
+		}
 		if err != nil {
-			return fmt.Errorf("error deleting secret: %v", err)
+			return false, err
+		}
+
+		if err := b.deleteCredential(request.InstanceID, request.BindingID); err != nil {
+			return false, err
+		}
+
+		if err := b.removeBindingState(request.BindingID); err != nil {
+			return false, err
 		}
 	default:
-		return fmt.Errorf("unbinding for %q is not implemented.", name)
+		return false, fmt.Errorf("unbinding for %q is not implemented.", name)
 	}
 
-	return nil
+	return false, nil
 }
 
-func (b *BrokerLogic) createSecret(secretPrefix, dataKey, dataString, namespace string) (*v1.Secret, error) {
-	s := &v1.Secret{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "Secret",
-			APIVersion: "v1",
-		},
-		Type: v1.SecretTypeOpaque,
+// releaseBindingConfig composes the config of an instance with the
+// credentials layer which is left once a binding is deleted. If the Habitat
+// is left without a config secret and async is set, the secret is only
+// deleted once all pods have been restarted without it, see
+// BindingLastOperation. It returns whether such an asynchronous unbinding was
+// started.
+func (b *BrokerLogic) releaseBindingConfig(request *osb.UnbindRequest, hab *habv1beta1.Habitat, namespace string, state *bindingState, credentials map[string]interface{}, async bool, entry *AuditEntry) (bool, error) {
+	previous := hab.Spec.V1beta2.Service.ConfigSecretName
+	if previous == nil && state != nil && state.SecretName != "" {
+		// A previous asynchronous unbind which timed out has already
+		// taken the secret away.
+		previous = &state.SecretName
 	}
 
-	timer := time.NewTimer(15 * time.Second)
-	defer timer.Stop()
+	config, err := b.instanceConfig(request.InstanceID, hab.Name)
+	if err != nil {
+		return false, err
+	}
 
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+	secretName, changed, err := b.composeConfig(hab, namespace, request.InstanceID, request.PlanID, config, credentials, entry)
+	if err != nil {
+		return false, err
+	}
 
-	for {
-		select {
-		case <-timer.C:
-			return nil, errors.New("max retries exceeded: secret not created")
-		default:
+	if changed {
+		if err := b.updateHabitatConfig(hab, namespace, entry); err != nil {
+			return false, fmt.Errorf("error updating habitat: %v", err)
 		}
+	}
 
-		secretName := fmt.Sprintf("%s-%s", secretPrefix, randSeq(5))
-		s.ObjectMeta = metav1.ObjectMeta{Name: secretName}
-		s.Data = map[string][]byte{dataKey: []byte(dataString)}
-
-		secret, err := b.Clients.KubeClient.CoreV1().Secrets(namespace).Create(s)
-		if err == nil {
-			return secret, nil
+	// The Habitat either runs without a config secret now, or with the
+	// config secret of an older version of the broker replaced.
+	if previous != nil && (hab.Spec.V1beta2.Service.ConfigSecretName == nil || *previous != secretName) {
+		if async && state != nil {
+			state.SecretName = *previous
+			state.Operation = newOperationState(operationUnbind)
+			return true, b.setBindingState(request.BindingID, state)
 		}
 
-		switch e := err.(type) {
-		case *k8sErrors.StatusError:
-			// We will only retry if there's a clash in the secret's name
-			// or else let the caller of this method handle the error.
-			if e.ErrStatus.Reason != metav1.StatusReasonAlreadyExists {
-				return nil, err
-			}
-		default:
-			// We will not handle any other kind of error.
-			return nil, err
+		if err := b.deleteSecret(*previous, namespace); err != nil && !k8sErrors.IsNotFound(err) {
+			return false, fmt.Errorf("error deleting secret: %v", err)
 		}
+		entry.deleted("Secret", namespace, *previous)
+	}
 
-		glog.Warningf("secret with name %s already exists. Trying again with a different name...", secretName)
+	return false, nil
+}
 
-		<-ticker.C
+// createSecret creates the secret with the given name. Names are derived
+// from instance and binding IDs, so a secret which already exists belongs to
+// the same instance or binding and has its data replaced, and its labels set.
+func (b *BrokerLogic) createSecret(name, namespace string, labels map[string]string, data map[string][]byte) (*v1.Secret, error) {
+	s := &v1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Secret",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: data,
+	}
+
+	secret, err := b.Clients.KubeClient.CoreV1().Secrets(namespace).Create(s)
+	if !k8sErrors.IsAlreadyExists(err) {
+		return secret, err
+	}
+
+	secret, err = b.Clients.KubeClient.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	secret.Data = data
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
 	}
+	for k, v := range s.Labels {
+		secret.Labels[k] = v
+	}
+
+	return b.Clients.KubeClient.CoreV1().Secrets(namespace).Update(secret)
 }
 
 func (b *BrokerLogic) verifySecretExists(name, namespace string) error {
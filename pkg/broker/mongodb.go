@@ -0,0 +1,291 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	mongodbPort = 27017
+
+	// mongodbAdmin is the name of the user administrator the broker manages
+	// the users of bindings with. It's a user of the admin database.
+	mongodbAdmin   = "admin"
+	mongodbAdminDB = "admin"
+
+	// mongodbReplicaSet is the name of the replica set of instances of the
+	// leader plan.
+	mongodbReplicaSet = "rs0"
+
+	// mongodbKeyfileBytes is the number of random bytes of a keyfile, which
+	// are base64 encoded to 1024 characters, the most MongoDB accepts.
+	mongodbKeyfileBytes = 768
+)
+
+// mongodbCredentialsLayer returns the config layer with a new password of
+// the user administrator of a MongoDB instance. Replica sets get their name
+// and a new keyfile their members authenticate each other with.
+func (b *BrokerLogic) mongodbCredentialsLayer(hab *habv1beta1.Habitat) (map[string]interface{}, error) {
+	password, err := b.generatePassword("mongodb")
+	if err != nil {
+		return nil, err
+	}
+
+	layer := map[string]interface{}{
+		"admin": map[string]interface{}{
+			"name":     mongodbAdmin,
+			"password": password,
+		},
+	}
+
+	if hab.Spec.V1beta2.Service.Topology == habv1beta1.TopologyLeader {
+		key := make([]byte, mongodbKeyfileBytes)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("error generating keyfile: %v", err)
+		}
+
+		layer["replica_set_name"] = mongodbReplicaSet
+		layer["keyfile"] = base64.StdEncoding.EncodeToString(key)
+	}
+
+	return layer, nil
+}
+
+// mongodbAdminPassword reads the password of the user administrator from the
+// config secret of the instance.
+func (b *BrokerLogic) mongodbAdminPassword(hab *habv1beta1.Habitat, namespace string) (string, error) {
+	layer, err := b.getConfigCredentials(hab, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	admin, _ := layer["admin"].(map[string]interface{})
+	password, _ := admin["password"].(string)
+	if password == "" {
+		return "", fmt.Errorf("the config of Habitat %s has no administrator password", hab.Name)
+	}
+
+	return password, nil
+}
+
+// mongodbPrimary connects to the member of the Habitat which accepts writes,
+// which is the primary of a replica set.
+func (b *BrokerLogic) mongodbPrimary(name, namespace, password string) (*mongoConn, error) {
+	selector := labels.SelectorFromSet(labels.Set{habv1beta1.HabitatNameLabel: name})
+	pods, err := b.Clients.KubeClient.CoreV1().Pods(namespace).List(metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing pods of Habitat %s: %v", name, err)
+	}
+
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != v1.PodRunning || pod.Status.PodIP == "" {
+			continue
+		}
+
+		addr := net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(mongodbPort))
+		conn, err := mongoConnect(addr, mongodbAdmin, password, mongodbAdminDB)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to MongoDB server of pod %s: %v", pod.Name, err)
+		}
+
+		reply, err := conn.run(mongodbAdminDB, bsonDoc{{"isMaster", 1}})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error querying MongoDB server of pod %s: %v", pod.Name, err)
+		}
+
+		if primary, _ := reply.get("ismaster").(bool); primary {
+			return conn, nil
+		}
+		conn.Close()
+	}
+
+	return nil, newHTTPStatusCodeError(http.StatusServiceUnavailable, fmt.Sprintf("no MongoDB server of Habitat %s accepts writes yet", name))
+}
+
+// createMongodbBinding creates the user of a binding, which may read and
+// write the database of the binding.
+func (b *BrokerLogic) createMongodbBinding(request *osb.BindRequest, state *bindingState, entry *AuditEntry) (map[string]interface{}, error) {
+	name := "mongodb"
+	ns := state.Namespace
+
+	hab, err := b.GetHabitat(name, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	admin, err := b.mongodbAdminPassword(hab, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := b.mongodbPrimary(name, ns, admin)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	password, err := b.generatePassword(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The user is created in the database of the binding, which is its
+	// authentication database then. Databases are created with their
+	// first write.
+	user := bindingIdentifier(request.BindingID)
+	roles := []interface{}{bsonDoc{{"role", "readWrite"}, {"db", user}}}
+
+	_, err = conn.run(user, bsonDoc{{"createUser", user}, {"pwd", password}, {"roles", roles}})
+	if isMongoError(err, mongoErrorUserExists) {
+		// Users of failed binds are taken over by their retry.
+		_, err = conn.run(user, bsonDoc{{"updateUser", user}, {"pwd", password}, {"roles", roles}})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating user %s: %v", user, err)
+	}
+
+	secretName := derivedSecretName("habitat-osb-mongodb-binding", request.BindingID)
+	if _, err := b.createSecret(secretName, ns, bindingLabels(request.InstanceID, request.BindingID), map[string][]byte{"password": []byte(password)}); err != nil {
+		return nil, err
+	}
+	entry.created("Secret", ns, secretName)
+
+	if err := b.storeCredential(request.InstanceID, request.BindingID, password); err != nil {
+		return nil, err
+	}
+
+	state.SecretName = secretName
+	return b.mongodbCredentials(hab, ns, user, password)
+}
+
+// deleteMongodbBinding drops the user and the database of a binding.
+func (b *BrokerLogic) deleteMongodbBinding(request *osb.UnbindRequest, state *bindingState, entry *AuditEntry) error {
+	name := "mongodb"
+	ns := state.Namespace
+
+	hab, err := b.GetHabitat(name, ns)
+	if err != nil {
+		return err
+	}
+
+	admin, err := b.mongodbAdminPassword(hab, ns)
+	if err != nil {
+		return err
+	}
+
+	conn, err := b.mongodbPrimary(name, ns, admin)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	user := bindingIdentifier(request.BindingID)
+
+	if _, err := conn.run(user, bsonDoc{{"dropUser", user}}); err != nil && !isMongoError(err, mongoErrorUserNotFound) {
+		return fmt.Errorf("error dropping user %s: %v", user, err)
+	}
+
+	if _, err := conn.run(user, bsonDoc{{"dropDatabase", 1}}); err != nil {
+		return fmt.Errorf("error dropping database %s: %v", user, err)
+	}
+
+	if state.SecretName != "" {
+		if err := b.deleteSecret(state.SecretName, ns); err != nil && !k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("error deleting secret: %v", err)
+		}
+		entry.deleted("Secret", ns, state.SecretName)
+	}
+
+	return nil
+}
+
+// mongodbHosts returns the addresses of all members of the Habitat, which
+// are the DNS names the governing Service of its StatefulSet gives the pods.
+func (b *BrokerLogic) mongodbHosts(hab *habv1beta1.Habitat, namespace string) ([]string, error) {
+	sts, err := b.Clients.KubeClient.AppsV1().StatefulSets(namespace).Get(hab.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting StatefulSet of Habitat %s: %v", hab.Name, err)
+	}
+
+	if sts.Spec.ServiceName == "" {
+		// Without a governing Service, pods have no DNS names.
+		if host := b.findServiceHost(hab.Name, namespace); host != "" {
+			return []string{net.JoinHostPort(host, strconv.Itoa(mongodbPort))}, nil
+		}
+		return nil, nil
+	}
+
+	replicas := hab.Spec.V1beta2.Count
+	if sts.Spec.Replicas != nil {
+		replicas = int(*sts.Spec.Replicas)
+	}
+
+	hosts := make([]string, 0, replicas)
+	for i := 0; i < replicas; i++ {
+		host := fmt.Sprintf("%s-%d.%s.%s.svc.cluster.local", sts.Name, i, sts.Spec.ServiceName, namespace)
+		hosts = append(hosts, net.JoinHostPort(host, strconv.Itoa(mongodbPort)))
+	}
+
+	return hosts, nil
+}
+
+// mongodbCredentials returns the credentials of a MongoDB binding.
+func (b *BrokerLogic) mongodbCredentials(hab *habv1beta1.Habitat, namespace, user, password string) (map[string]interface{}, error) {
+	credentials := map[string]interface{}{
+		"username": user,
+		"password": password,
+		"database": user,
+		"port":     mongodbPort,
+	}
+
+	hosts, err := b.mongodbHosts(hab, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return credentials, nil
+	}
+	credentials["hosts"] = hosts
+
+	query := url.Values{"authSource": {user}}
+	if hab.Spec.V1beta2.Service.Topology == habv1beta1.TopologyLeader {
+		query.Set("replicaSet", mongodbReplicaSet)
+		credentials["replicaSet"] = mongodbReplicaSet
+	}
+
+	// url.URL can't hold several hosts.
+	credentials["uri"] = fmt.Sprintf("mongodb://%s@%s/%s?%s",
+		url.UserPassword(user, password), strings.Join(hosts, ","), user, query.Encode())
+
+	return credentials, nil
+}
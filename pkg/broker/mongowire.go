@@ -0,0 +1,469 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+const (
+	mongoOpMsg   = 2013
+	mongoTimeout = 30 * time.Second
+
+	// mongoMaxMessageSize is the largest message MongoDB sends by default.
+	mongoMaxMessageSize = 48 * 1000 * 1000
+
+	mongoSCRAMSHA256 = "SCRAM-SHA-256"
+)
+
+// BSON element types.
+const (
+	bsonDouble    = 0x01
+	bsonString    = 0x02
+	bsonDocument  = 0x03
+	bsonArray     = 0x04
+	bsonBinary    = 0x05
+	bsonUndefined = 0x06
+	bsonObjectID  = 0x07
+	bsonBool      = 0x08
+	bsonDateTime  = 0x09
+	bsonNull      = 0x0A
+	bsonRegex     = 0x0B
+	bsonInt32     = 0x10
+	bsonTimestamp = 0x11
+	bsonInt64     = 0x12
+	bsonDecimal   = 0x13
+	bsonMinKey    = 0xFF
+	bsonMaxKey    = 0x7F
+)
+
+// bsonElement is a key and value of a BSON document.
+type bsonElement struct {
+	Key   string
+	Value interface{}
+}
+
+// bsonDoc is a BSON document. Commands are documents whose first key is the
+// name of the command, so the order of the keys is kept.
+//
+// Values are encoded from and decoded to strings, int32s, int64s, float64s,
+// bools, []bytes for binary data, bsonDocs, []interface{}s for arrays and
+// nil. Other types of the server are skipped when decoding.
+type bsonDoc []bsonElement
+
+// get returns the value of the key, or nil if it's missing.
+func (d bsonDoc) get(key string) interface{} {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value
+		}
+	}
+
+	return nil
+}
+
+func (d bsonDoc) encode(buf *bytes.Buffer) error {
+	var body bytes.Buffer
+	for _, e := range d {
+		if err := encodeBSONElement(&body, e.Key, e.Value); err != nil {
+			return err
+		}
+	}
+	body.WriteByte(0)
+
+	binary.Write(buf, binary.LittleEndian, int32(4+body.Len()))
+	buf.Write(body.Bytes())
+	return nil
+}
+
+func encodeBSONElement(buf *bytes.Buffer, key string, value interface{}) error {
+	writeKey := func(t byte) {
+		buf.WriteByte(t)
+		buf.Write(cstring(key))
+	}
+
+	switch v := value.(type) {
+	case nil:
+		writeKey(bsonNull)
+	case string:
+		writeKey(bsonString)
+		binary.Write(buf, binary.LittleEndian, int32(len(v)+1))
+		buf.Write(cstring(v))
+	case bool:
+		writeKey(bsonBool)
+		if v {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case int:
+		writeKey(bsonInt32)
+		binary.Write(buf, binary.LittleEndian, int32(v))
+	case int32:
+		writeKey(bsonInt32)
+		binary.Write(buf, binary.LittleEndian, v)
+	case int64:
+		writeKey(bsonInt64)
+		binary.Write(buf, binary.LittleEndian, v)
+	case float64:
+		writeKey(bsonDouble)
+		binary.Write(buf, binary.LittleEndian, math.Float64bits(v))
+	case []byte:
+		writeKey(bsonBinary)
+		binary.Write(buf, binary.LittleEndian, int32(len(v)))
+		buf.WriteByte(0)
+		buf.Write(v)
+	case bsonDoc:
+		writeKey(bsonDocument)
+		return v.encode(buf)
+	case []interface{}:
+		writeKey(bsonArray)
+		array := make(bsonDoc, len(v))
+		for i, item := range v {
+			array[i] = bsonElement{Key: fmt.Sprint(i), Value: item}
+		}
+		return array.encode(buf)
+	default:
+		return fmt.Errorf("BSON encoding of %T is not supported", value)
+	}
+
+	return nil
+}
+
+// bsonReader decodes BSON documents from a buffer.
+type bsonReader struct {
+	data []byte
+	err  error
+}
+
+func (r *bsonReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = errors.New("malformed BSON document")
+		return nil
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *bsonReader) int32() int32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.LittleEndian.Uint32(b))
+}
+
+func (r *bsonReader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+
+	i := bytes.IndexByte(r.data, 0)
+	if i < 0 {
+		r.err = errors.New("malformed BSON string")
+		return ""
+	}
+
+	s := string(r.data[:i])
+	r.data = r.data[i+1:]
+	return s
+}
+
+func (r *bsonReader) document() bsonDoc {
+	length := int(r.int32())
+	body := r.next(length - 4)
+	if body == nil || len(body) == 0 || body[len(body)-1] != 0 {
+		if r.err == nil {
+			r.err = errors.New("malformed BSON document")
+		}
+		return nil
+	}
+
+	inner := &bsonReader{data: body[:len(body)-1]}
+	doc := bsonDoc{}
+
+	for len(inner.data) > 0 && inner.err == nil {
+		t := inner.next(1)
+		if t == nil {
+			break
+		}
+		key := inner.cstring()
+
+		value, ok := inner.value(t[0])
+		if ok {
+			doc = append(doc, bsonElement{Key: key, Value: value})
+		}
+	}
+
+	if inner.err != nil {
+		r.err = inner.err
+	}
+
+	return doc
+}
+
+// value decodes a value of the given type. It reports false for values of
+// types which are skipped.
+func (r *bsonReader) value(t byte) (interface{}, bool) {
+	switch t {
+	case bsonDouble:
+		b := r.next(8)
+		if b == nil {
+			return nil, false
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), true
+	case bsonString:
+		length := int(r.int32())
+		b := r.next(length)
+		if b == nil || length < 1 {
+			return nil, false
+		}
+		return string(b[:length-1]), true
+	case bsonDocument:
+		return r.document(), true
+	case bsonArray:
+		doc := r.document()
+		array := make([]interface{}, len(doc))
+		for i, e := range doc {
+			array[i] = e.Value
+		}
+		return array, true
+	case bsonBinary:
+		length := int(r.int32())
+		r.next(1)
+		return r.next(length), true
+	case bsonBool:
+		b := r.next(1)
+		return b != nil && b[0] == 1, true
+	case bsonNull:
+		return nil, true
+	case bsonInt32:
+		return r.int32(), true
+	case bsonInt64:
+		b := r.next(8)
+		if b == nil {
+			return nil, false
+		}
+		return int64(binary.LittleEndian.Uint64(b)), true
+	case bsonUndefined, bsonMinKey, bsonMaxKey:
+	case bsonObjectID:
+		r.next(12)
+	case bsonDateTime, bsonTimestamp:
+		r.next(8)
+	case bsonDecimal:
+		r.next(16)
+	case bsonRegex:
+		r.cstring()
+		r.cstring()
+	default:
+		r.err = fmt.Errorf("BSON type 0x%x is not supported", t)
+	}
+
+	return nil, false
+}
+
+// mongoError is the error of a failed command.
+type mongoError struct {
+	Code    int32
+	Message string
+}
+
+func (e *mongoError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// Codes of mongoErrors the broker handles.
+const (
+	mongoErrorUserNotFound = 11
+	mongoErrorUserExists   = 51003
+)
+
+func isMongoError(err error, code int32) bool {
+	e, ok := err.(*mongoError)
+	return ok && e.Code == code
+}
+
+// mongoConn is a minimal client of the MongoDB wire protocol. It runs
+// commands with OP_MSG, which needs MongoDB 3.6 or newer, and authenticates
+// with SCRAM-SHA-256, which needs MongoDB 4.0 or newer.
+type mongoConn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	requestID int32
+}
+
+// mongoConnect opens a connection to the server and authenticates as the
+// user of the given authentication database.
+func mongoConnect(addr, user, password, authDB string) (*mongoConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, mongoTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(mongoTimeout))
+
+	c := &mongoConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+
+	if err := c.authenticate(user, password, authDB); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error authenticating as %s: %v", user, err)
+	}
+
+	return c, nil
+}
+
+func (c *mongoConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *mongoConn) authenticate(user, password, authDB string) error {
+	scram, err := newSCRAMClient(user, password)
+	if err != nil {
+		return err
+	}
+
+	reply, err := c.run(authDB, bsonDoc{
+		{"saslStart", 1},
+		{"mechanism", mongoSCRAMSHA256},
+		{"payload", []byte(scram.clientFirst())},
+		{"options", bsonDoc{{"skipEmptyExchange", true}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	serverFirst, _ := reply.get("payload").([]byte)
+	final, err := scram.clientFinal(string(serverFirst))
+	if err != nil {
+		return err
+	}
+
+	reply, err = c.run(authDB, bsonDoc{
+		{"saslContinue", 1},
+		{"conversationId", reply.get("conversationId")},
+		{"payload", []byte(final)},
+	})
+	if err != nil {
+		return err
+	}
+
+	serverFinal, _ := reply.get("payload").([]byte)
+	if err := scram.verifyServerFinal(string(serverFinal)); err != nil {
+		return err
+	}
+
+	// Servers which ignore skipEmptyExchange need an empty message to
+	// finish the conversation.
+	for done, _ := reply.get("done").(bool); !done; done, _ = reply.get("done").(bool) {
+		reply, err = c.run(authDB, bsonDoc{
+			{"saslContinue", 1},
+			{"conversationId", reply.get("conversationId")},
+			{"payload", []byte{}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// run runs the command in the database and returns its reply, or a
+// mongoError if the command failed.
+func (c *mongoConn) run(db string, cmd bsonDoc) (bsonDoc, error) {
+	cmd = append(cmd, bsonElement{Key: "$db", Value: db})
+
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, uint32(0))
+	body.WriteByte(0)
+	if err := cmd.encode(&body); err != nil {
+		return nil, err
+	}
+
+	c.requestID++
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.LittleEndian, []int32{int32(16 + body.Len()), c.requestID, 0, mongoOpMsg})
+	msg.Write(body.Bytes())
+
+	if _, err := c.conn.Write(msg.Bytes()); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return nil, err
+	}
+
+	length := int(binary.LittleEndian.Uint32(header))
+	if length < 16 || length > mongoMaxMessageSize {
+		return nil, fmt.Errorf("malformed message length %d", length)
+	}
+	if op := binary.LittleEndian.Uint32(header[12:]); op != mongoOpMsg {
+		return nil, fmt.Errorf("unexpected reply of opcode %d", op)
+	}
+
+	payload := make([]byte, length-16)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return nil, err
+	}
+
+	// The reply is made of the flags and a single document section.
+	if len(payload) < 5 || payload[4] != 0 {
+		return nil, errors.New("malformed reply")
+	}
+
+	r := &bsonReader{data: payload[5:]}
+	reply := r.document()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if ok, _ := mongoNumber(reply.get("ok")); ok != 1 {
+		code, _ := mongoNumber(reply.get("code"))
+		message, _ := reply.get("errmsg").(string)
+		return nil, &mongoError{Code: int32(code), Message: message}
+	}
+
+	return reply, nil
+}
+
+// mongoNumber returns the value of a number of any BSON type.
+func mongoNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestBSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  bsonDoc
+		want bsonDoc
+	}{
+		{
+			name: "empty",
+			doc:  bsonDoc{},
+		},
+		{
+			name: "scalars",
+			doc: bsonDoc{
+				{Key: "createUser", Value: "binding_1"},
+				{Key: "pwd", Value: ""},
+				{Key: "ok", Value: float64(1)},
+				{Key: "digestPassword", Value: true},
+				{Key: "readOnly", Value: false},
+				{Key: "n", Value: int32(-7)},
+				{Key: "opTime", Value: int64(1) << 40},
+				{Key: "comment", Value: nil},
+			},
+		},
+		{
+			name: "ints are encoded as int32s",
+			doc:  bsonDoc{{Key: "saslStart", Value: 1}},
+			want: bsonDoc{{Key: "saslStart", Value: int32(1)}},
+		},
+		{
+			name: "binary",
+			doc: bsonDoc{
+				{Key: "payload", Value: []byte("n,,n=user,r=abc")},
+				{Key: "empty", Value: []byte{}},
+			},
+		},
+		{
+			name: "nested",
+			doc: bsonDoc{
+				{Key: "grantRolesToUser", Value: "binding_1"},
+				{Key: "roles", Value: []interface{}{
+					bsonDoc{{Key: "role", Value: "readWrite"}, {Key: "db", Value: "binding_1"}},
+					"read",
+				}},
+				{Key: "writeConcern", Value: bsonDoc{{Key: "w", Value: "majority"}}},
+				{Key: "empty", Value: []interface{}{}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := tt.doc.encode(&buf); err != nil {
+			t.Errorf("%s: encode() error = %v", tt.name, err)
+			continue
+		}
+
+		r := &bsonReader{data: buf.Bytes()}
+		got := r.document()
+		if r.err != nil {
+			t.Errorf("%s: document() error = %v", tt.name, r.err)
+			continue
+		}
+		if len(r.data) != 0 {
+			t.Errorf("%s: document() left %d bytes", tt.name, len(r.data))
+		}
+
+		want := tt.want
+		if want == nil {
+			want = tt.doc
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: round trip = %#v, want %#v", tt.name, got, want)
+		}
+	}
+}
+
+func TestBSONEncode(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     bsonDoc
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			doc:  bsonDoc{},
+			want: []byte{5, 0, 0, 0, 0},
+		},
+		{
+			name: "string",
+			doc:  bsonDoc{{Key: "a", Value: "b"}},
+			want: []byte{14, 0, 0, 0, bsonString, 'a', 0, 2, 0, 0, 0, 'b', 0, 0},
+		},
+		{
+			name: "int32",
+			doc:  bsonDoc{{Key: "a", Value: int32(1)}},
+			want: []byte{12, 0, 0, 0, bsonInt32, 'a', 0, 1, 0, 0, 0, 0},
+		},
+		{
+			name: "binary of the generic subtype",
+			doc:  bsonDoc{{Key: "a", Value: []byte{9}}},
+			want: []byte{14, 0, 0, 0, bsonBinary, 'a', 0, 1, 0, 0, 0, 0, 9, 0},
+		},
+		{
+			name:    "unsupported type",
+			doc:     bsonDoc{{Key: "a", Value: uint8(1)}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		err := tt.doc.encode(&buf)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: encode() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !bytes.Equal(buf.Bytes(), tt.want) {
+			t.Errorf("%s: encode() = %v, want %v", tt.name, buf.Bytes(), tt.want)
+		}
+	}
+}
+
+func TestBSONDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    bsonDoc
+		wantErr bool
+	}{
+		{
+			name: "skipped types",
+			data: []byte{
+				50, 0, 0, 0,
+				bsonObjectID, '_', 'i', 'd', 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12,
+				bsonDateTime, 't', 0, 1, 2, 3, 4, 5, 6, 7, 8,
+				bsonRegex, 'r', 0, 'a', 0, 'i', 0,
+				bsonMinKey, 'm', 0,
+				bsonInt32, 'n', 0, 1, 0, 0, 0,
+				0,
+			},
+			want: bsonDoc{{Key: "n", Value: int32(1)}},
+		},
+		{
+			name:    "unsupported type",
+			data:    []byte{8, 0, 0, 0, 0x20, 'a', 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "truncated document",
+			data:    []byte{12, 0, 0, 0, bsonInt32, 'a', 0, 1},
+			wantErr: true,
+		},
+		{
+			name:    "missing terminator",
+			data:    []byte{5, 0, 0, 0, 1},
+			wantErr: true,
+		},
+		{
+			name:    "truncated value",
+			data:    []byte{9, 0, 0, 0, bsonInt32, 'a', 0, 1, 0},
+			wantErr: true,
+		},
+		{
+			name:    "unterminated key",
+			data:    []byte{8, 0, 0, 0, bsonNull, 'a', 'b', 0},
+			wantErr: true,
+		},
+		{
+			name:    "negative length",
+			data:    []byte{0xff, 0xff, 0xff, 0xff, 0},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		r := &bsonReader{data: tt.data}
+		got := r.document()
+		if (r.err != nil) != tt.wantErr {
+			t.Errorf("%s: document() error = %v, want error %v", tt.name, r.err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: document() = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMongoNumber(t *testing.T) {
+	tests := []struct {
+		v      interface{}
+		want   float64
+		wantOK bool
+	}{
+		{v: int32(1), want: 1, wantOK: true},
+		{v: int64(11000), want: 11000, wantOK: true},
+		{v: float64(0), want: 0, wantOK: true},
+		{v: "1"},
+		{v: nil},
+	}
+
+	for _, tt := range tests {
+		got, ok := mongoNumber(tt.v)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("mongoNumber(%#v) = %v, %v, want %v, %v", tt.v, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// nginxUpstream is the `upstream` binding parameter, a Service in the
+// namespace of the instance nginx proxies a path to.
+type nginxUpstream struct {
+	service string
+	port    int32
+	path    string
+}
+
+func getNginxUpstream(params map[string]interface{}) (*nginxUpstream, error) {
+	u, ok := params["upstream"]
+	if !ok {
+		return nil, nil
+	}
+
+	m, ok := u.(map[string]interface{})
+	if !ok {
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "upstream must be an object")
+	}
+
+	upstream := &nginxUpstream{path: "/"}
+
+	upstream.service, ok = m["service"].(string)
+	if !ok || upstream.service == "" {
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("upstream service %v is invalid", m["service"]))
+	}
+
+	if p, ok := m["port"]; ok {
+		f, ok := p.(float64)
+		if !ok || f < 1 || f > 65535 || f != float64(int32(f)) {
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("upstream port %v is invalid", p))
+		}
+		upstream.port = int32(f)
+	}
+
+	if p, ok := m["path"]; ok {
+		s, ok := p.(string)
+		if !ok || !strings.HasPrefix(s, "/") {
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("upstream path %v must start with a slash", p))
+		}
+		upstream.path = s
+	}
+
+	return upstream, nil
+}
+
+// resolveNginxUpstream returns the address of the upstream, which is the
+// port of its Service given by the parameter, or the first one.
+func (b *BrokerLogic) resolveNginxUpstream(upstream *nginxUpstream, namespace string) (string, error) {
+	svc, err := b.Clients.KubeClient.CoreV1().Services(namespace).Get(upstream.service, metav1.GetOptions{})
+	if k8sErrors.IsNotFound(err) {
+		msg := fmt.Sprintf("upstream service %s does not exist in namespace %s", upstream.service, namespace)
+		return "", newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error getting service %s: %v", upstream.service, err)
+	}
+
+	port := upstream.port
+	found := false
+	for _, p := range svc.Spec.Ports {
+		if port == 0 || p.Port == port {
+			port = p.Port
+			found = true
+			break
+		}
+	}
+	if !found {
+		msg := fmt.Sprintf("upstream service %s has no port %d", upstream.service, upstream.port)
+		return "", newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+	}
+
+	host := fmt.Sprintf("%s.%s.svc.cluster.local", svc.Name, namespace)
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// nginxUpstreamsLayer returns a copy of the upstreams of the credentials
+// layer of an nginx instance, keyed by binding ID.
+func nginxUpstreamsLayer(layer map[string]interface{}) map[string]interface{} {
+	upstreams := map[string]interface{}{}
+
+	current, _ := layer["upstreams"].(map[string]interface{})
+	for id, u := range current {
+		upstreams[id] = u
+	}
+
+	return upstreams
+}
+
+// nginxCredentialsLayer returns the credentials layer of an nginx instance
+// with the given upstreams, or nil if there are none.
+func nginxCredentialsLayer(upstreams map[string]interface{}) map[string]interface{} {
+	if len(upstreams) == 0 {
+		return nil
+	}
+
+	return map[string]interface{}{"upstreams": upstreams}
+}
+
+// registerNginxUpstream adds the upstream of a binding to the config of the
+// instance. Paths can only be proxied to one upstream.
+func (b *BrokerLogic) registerNginxUpstream(hab *habv1beta1.Habitat, namespace, bindingID string, upstream *nginxUpstream) (map[string]interface{}, error) {
+	addr, err := b.resolveNginxUpstream(upstream, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	layer, err := b.getConfigCredentials(hab, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreams := nginxUpstreamsLayer(layer)
+	for id, u := range upstreams {
+		location, _ := u.(map[string]interface{})["location"].(string)
+		if id != bindingID && location == upstream.path {
+			msg := fmt.Sprintf("path %s is already proxied to the upstream of binding %s", upstream.path, id)
+			return nil, newHTTPStatusCodeError(http.StatusConflict, msg)
+		}
+	}
+
+	upstreams[bindingID] = map[string]interface{}{
+		"servers":  []string{addr},
+		"location": upstream.path,
+	}
+
+	return nginxCredentialsLayer(upstreams), nil
+}
+
+// nginxCredentials returns the URLs an nginx instance is reached at. They're
+// only known if the user created a Service for the Habitat pods. The `uri`
+// is the one reachable from the farthest: the host of an Ingress, the
+// address of a load balancer, a node port, or the cluster DNS name of the
+// Service.
+func (b *BrokerLogic) nginxCredentials(name, namespace string, upstream *nginxUpstream) map[string]interface{} {
+	credentials := map[string]interface{}{}
+	if upstream != nil {
+		credentials["path"] = upstream.path
+	}
+
+	svc := b.findService(name, namespace)
+	if svc == nil || len(svc.Spec.Ports) == 0 {
+		return credentials
+	}
+	port := svc.Spec.Ports[0]
+
+	clusterURI := url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(fmt.Sprintf("%s.%s.svc.cluster.local", svc.Name, namespace), strconv.Itoa(int(port.Port))),
+	}
+	credentials["clusterUri"] = clusterURI.String()
+	uri := clusterURI.String()
+
+	if port.NodePort != 0 {
+		if addr := b.nodeAddress(); addr != "" {
+			nodePortURI := url.URL{
+				Scheme: "http",
+				Host:   net.JoinHostPort(addr, strconv.Itoa(int(port.NodePort))),
+			}
+			credentials["nodePortUri"] = nodePortURI.String()
+			uri = nodePortURI.String()
+		}
+	}
+
+	for _, i := range svc.Status.LoadBalancer.Ingress {
+		host := i.Hostname
+		if host == "" {
+			host = i.IP
+		}
+		if host != "" {
+			lbURI := url.URL{
+				Scheme: "http",
+				Host:   net.JoinHostPort(host, strconv.Itoa(int(port.Port))),
+			}
+			credentials["loadBalancerUri"] = lbURI.String()
+			uri = lbURI.String()
+			break
+		}
+	}
+
+	if ingressURI := b.ingressURI(svc.Name, namespace); ingressURI != "" {
+		credentials["ingressUri"] = ingressURI
+		uri = ingressURI
+	}
+
+	credentials["uri"] = uri
+	return credentials
+}
+
+// nodeAddress returns the external address of the first node which has one,
+// or else the internal address of the first node.
+func (b *BrokerLogic) nodeAddress() string {
+	nodes, err := b.Clients.KubeClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Warningf("error listing nodes: %v", err)
+		return ""
+	}
+
+	internal := ""
+	for _, node := range nodes.Items {
+		for _, a := range node.Status.Addresses {
+			switch a.Type {
+			case v1.NodeExternalIP:
+				return a.Address
+			case v1.NodeInternalIP:
+				if internal == "" {
+					internal = a.Address
+				}
+			}
+		}
+	}
+
+	return internal
+}
+
+// ingressURI returns the URL of the first Ingress rule with a host which
+// routes to the Service.
+func (b *BrokerLogic) ingressURI(serviceName, namespace string) string {
+	ingresses, err := b.Clients.KubeClient.ExtensionsV1beta1().Ingresses(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		glog.Warningf("error listing ingresses in namespace %s: %v", namespace, err)
+		return ""
+	}
+
+	for _, ing := range ingresses.Items {
+		for _, rule := range ing.Spec.Rules {
+			if rule.Host == "" || rule.HTTP == nil {
+				continue
+			}
+
+			for _, p := range rule.HTTP.Paths {
+				if p.Backend.ServiceName != serviceName {
+					continue
+				}
+
+				scheme := "http"
+				for _, tls := range ing.Spec.TLS {
+					for _, h := range tls.Hosts {
+						if h == rule.Host {
+							scheme = "https"
+						}
+					}
+				}
+
+				u := url.URL{Scheme: scheme, Host: rule.Host, Path: p.Path}
+				return u.String()
+			}
+		}
+	}
+
+	return ""
+}
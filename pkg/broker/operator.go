@@ -0,0 +1,211 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/habitat-sh/habitat-operator/pkg/apis/habitat"
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// HabitatSpecV1beta1 is the spec of habitat-operators before 0.6, which
+	// keeps all fields at the top level of the spec.
+	HabitatSpecV1beta1 = "v1beta1"
+	// HabitatSpecV1beta2 is the spec of later habitat-operators, which keep
+	// all fields in spec.v1beta2 and mark objects with customVersion.
+	HabitatSpecV1beta2 = "v1beta2"
+
+	habitatCRDName = habv1beta1.HabitatResourcePlural + "." + habitat.GroupName
+)
+
+var habitatSpecSet = map[string]struct{}{
+	HabitatSpecV1beta1: {},
+	HabitatSpecV1beta2: {},
+}
+
+// detectHabitatSpec returns the spec the installed habitat-operator
+// understands. It fails if there's no operator. The spec is read from the
+// validation schema the operator registers its CRD with, unless it's given
+// explicitly.
+func detectHabitatSpec(client kubernetes.Interface, spec string) (string, error) {
+	if spec != "" {
+		if _, ok := habitatSpecSet[spec]; !ok {
+			return "", fmt.Errorf("Habitat spec %q is invalid, it must be %q or %q", spec, HabitatSpecV1beta1, HabitatSpecV1beta2)
+		}
+	}
+
+	groupVersion := habv1beta1.SchemeGroupVersion.String()
+	resources, err := client.Discovery().ServerResourcesForGroupVersion(groupVersion)
+	if k8sErrors.IsNotFound(err) {
+		return "", fmt.Errorf("no habitat-operator is installed: the API %s is not served by the cluster", groupVersion)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error discovering the API %s: %v", groupVersion, err)
+	}
+
+	served := false
+	for _, r := range resources.APIResources {
+		if r.Name == habv1beta1.HabitatResourcePlural {
+			served = true
+		}
+	}
+	if !served {
+		return "", fmt.Errorf("no habitat-operator is installed: the API %s does not serve %s", groupVersion, habv1beta1.HabitatResourcePlural)
+	}
+
+	if spec != "" {
+		return spec, nil
+	}
+
+	data, err := client.Discovery().RESTClient().Get().
+		AbsPath("/apis/apiextensions.k8s.io/v1beta1/customresourcedefinitions", habitatCRDName).
+		DoRaw()
+	if err != nil {
+		return "", fmt.Errorf("error getting CustomResourceDefinition %s: %v", habitatCRDName, err)
+	}
+
+	var crd struct {
+		Spec struct {
+			Validation *struct {
+				OpenAPIV3Schema struct {
+					Properties map[string]struct {
+						Properties map[string]json.RawMessage `json:"properties"`
+					} `json:"properties"`
+				} `json:"openAPIV3Schema"`
+			} `json:"validation"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(data, &crd); err != nil {
+		return "", fmt.Errorf("error decoding CustomResourceDefinition %s: %v", habitatCRDName, err)
+	}
+
+	if crd.Spec.Validation == nil {
+		glog.Warningf("CustomResourceDefinition %s has no validation schema, assuming the habitat-operator understands the %s spec", habitatCRDName, HabitatSpecV1beta2)
+		return HabitatSpecV1beta2, nil
+	}
+
+	properties := crd.Spec.Validation.OpenAPIV3Schema.Properties["spec"].Properties
+	if _, ok := properties["v1beta2"]; ok {
+		return HabitatSpecV1beta2, nil
+	}
+	if _, ok := properties["service"]; ok {
+		return HabitatSpecV1beta1, nil
+	}
+
+	return "", fmt.Errorf("the habitat-operator is incompatible: CustomResourceDefinition %s validates neither the %s nor the %s spec", habitatCRDName, HabitatSpecV1beta1, HabitatSpecV1beta2)
+}
+
+// defaultHabitatChannel is the channel the Supervisors of Habitats which
+// don't set one follow.
+const defaultHabitatChannel = "stable"
+
+// verifyHabitatSpec returns an error if the spec the habitat-operator
+// understands can't express the persistent storage or the channel an instance
+// asks for. The v1beta1 spec lacks both.
+func (b *BrokerLogic) verifyHabitatSpec(storage *habv1beta1.PersistentStorage, channel string) error {
+	if b.habitatSpec != HabitatSpecV1beta1 {
+		return nil
+	}
+
+	if storage != nil {
+		msg := fmt.Sprintf("the habitat-operator understands the %s spec of Habitats, which lacks persistent storage", HabitatSpecV1beta1)
+		return newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+	}
+
+	if channel != "" && channel != defaultHabitatChannel {
+		msg := fmt.Sprintf("the habitat-operator understands the %s spec of Habitats, which lacks channels other than %q", HabitatSpecV1beta1, defaultHabitatChannel)
+		return newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+	}
+
+	return nil
+}
+
+// fromHabitatSpec converts Habitats of the v1beta1 spec to the v1beta2 one,
+// which the broker works with internally. Habitats of the v1beta2 spec are
+// returned unchanged.
+func fromHabitatSpec(hab *habv1beta1.Habitat) *habv1beta1.Habitat {
+	if hab.Spec.V1beta2 != nil {
+		return hab
+	}
+
+	service := hab.Spec.Service
+	v1beta2 := &habv1beta1.V1beta2{
+		Count: hab.Spec.Count,
+		Image: hab.Spec.Image,
+		Env:   hab.Spec.Env,
+		Service: habv1beta1.ServiceV1beta2{
+			Topology: service.Topology,
+			Bind:     service.Bind,
+			Name:     service.Name,
+		},
+	}
+	if service.Group != "" {
+		v1beta2.Service.Group = &service.Group
+	}
+	if service.ConfigSecretName != "" {
+		v1beta2.Service.ConfigSecretName = &service.ConfigSecretName
+	}
+	if service.RingSecretName != "" {
+		v1beta2.Service.RingSecretName = &service.RingSecretName
+	}
+
+	hab.Spec.V1beta2 = v1beta2
+	return hab
+}
+
+// toHabitatSpec returns a copy of the Habitat in the given spec.
+func toHabitatSpec(hab *habv1beta1.Habitat, spec string) *habv1beta1.Habitat {
+	h := hab.DeepCopy()
+	v1beta2 := h.Spec.V1beta2
+
+	if spec == HabitatSpecV1beta2 {
+		customVersion := HabitatSpecV1beta2
+		h.CustomVersion = &customVersion
+		h.Spec = habv1beta1.HabitatSpec{V1beta2: v1beta2}
+		return h
+	}
+
+	// Persistent storage and channels are dropped, verifyHabitatSpec turns
+	// down instances which need them.
+	h.CustomVersion = nil
+	h.Spec = habv1beta1.HabitatSpec{
+		Count: v1beta2.Count,
+		Image: v1beta2.Image,
+		Env:   v1beta2.Env,
+		Service: habv1beta1.Service{
+			Topology: v1beta2.Service.Topology,
+			Bind:     v1beta2.Service.Bind,
+			Name:     v1beta2.Service.Name,
+		},
+	}
+	if v1beta2.Service.Group != nil {
+		h.Spec.Service.Group = *v1beta2.Service.Group
+	}
+	if v1beta2.Service.ConfigSecretName != nil {
+		h.Spec.Service.ConfigSecretName = *v1beta2.Service.ConfigSecretName
+	}
+	if v1beta2.Service.RingSecretName != nil {
+		h.Spec.Service.RingSecretName = *v1beta2.Service.RingSecretName
+	}
+
+	return h
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+)
+
+func TestNewHabitatSpecs(t *testing.T) {
+	tests := []struct {
+		name        string
+		service     string
+		spec        string
+		wantStorage bool
+	}{
+		{
+			name:        "redis on v1beta2",
+			service:     "redis",
+			spec:        HabitatSpecV1beta2,
+			wantStorage: true,
+		},
+		{
+			name:    "redis on v1beta1",
+			service: "redis",
+			spec:    HabitatSpecV1beta1,
+		},
+		{
+			name:    "nginx on v1beta2",
+			service: "nginx",
+			spec:    HabitatSpecV1beta2,
+		},
+		{
+			name:    "nginx on v1beta1",
+			service: "nginx",
+			spec:    HabitatSpecV1beta1,
+		},
+	}
+
+	for _, tt := range tests {
+		params := habitatParameters{
+			group:      "default",
+			topology:   habv1beta1.TopologyStandalone,
+			count:      1,
+			persistent: tt.spec != HabitatSpecV1beta1,
+		}
+		hab := NewHabitat(tt.service, "kinvolk/osb-"+tt.service, params)
+
+		if got := hab.Spec.V1beta2.PersistentStorage != nil; got != tt.wantStorage {
+			t.Errorf("%s: NewHabitat() has persistent storage = %v, want %v", tt.name, got, tt.wantStorage)
+		}
+
+		b := &BrokerLogic{habitatSpec: tt.spec}
+		if err := b.verifyHabitatSpec(hab.Spec.V1beta2.PersistentStorage, ""); err != nil {
+			t.Errorf("%s: verifyHabitatSpec() error = %v", tt.name, err)
+		}
+
+		h := toHabitatSpec(hab, tt.spec)
+		switch tt.spec {
+		case HabitatSpecV1beta2:
+			if h.CustomVersion == nil || *h.CustomVersion != HabitatSpecV1beta2 {
+				t.Errorf("%s: toHabitatSpec() customVersion = %v, want %q", tt.name, h.CustomVersion, HabitatSpecV1beta2)
+			}
+			if h.Spec.V1beta2 == nil || h.Spec.V1beta2.Service.Name != tt.service {
+				t.Errorf("%s: toHabitatSpec() spec.v1beta2 = %+v, want service %q", tt.name, h.Spec.V1beta2, tt.service)
+			}
+		case HabitatSpecV1beta1:
+			if h.CustomVersion != nil {
+				t.Errorf("%s: toHabitatSpec() customVersion = %q, want none", tt.name, *h.CustomVersion)
+			}
+			if h.Spec.V1beta2 != nil || h.Spec.Service.Name != tt.service || h.Spec.Count != 1 {
+				t.Errorf("%s: toHabitatSpec() spec = %+v, want service %q at the top level", tt.name, h.Spec, tt.service)
+			}
+		}
+
+		if got := fromHabitatSpec(h); got.Spec.V1beta2.Service.Name != tt.service || got.Spec.V1beta2.Image != hab.Spec.V1beta2.Image {
+			t.Errorf("%s: fromHabitatSpec() spec.v1beta2 = %+v, want %+v", tt.name, got.Spec.V1beta2, hab.Spec.V1beta2)
+		}
+	}
+}
+
+func TestVerifyHabitatSpecStorage(t *testing.T) {
+	storage := &habv1beta1.PersistentStorage{Size: "1Gi", MountPath: "/hab/svc/my-app/data", StorageClassName: "standard"}
+
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{spec: HabitatSpecV1beta2},
+		{spec: HabitatSpecV1beta1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		b := &BrokerLogic{habitatSpec: tt.spec}
+		if err := b.verifyHabitatSpec(storage, ""); (err != nil) != tt.wantErr {
+			t.Errorf("%s: verifyHabitatSpec() error = %v, want error %v", tt.spec, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// habitatFinalizer keeps the Habitats of instances from being deleted
+	// behind the back of the broker. The broker removes it once it forgot
+	// the instance.
+	habitatFinalizer = "service-broker.habitat.sh/instance"
+
+	// instanceLabel and bindingLabel mark the resources the broker creates
+	// for an instance or a binding. Their values are derived from the IDs,
+	// which may be too long for label values.
+	instanceLabel = "habitat-osb-instance"
+	bindingLabel  = "habitat-osb-binding"
+
+	// ownershipCheckInterval is how often the Habitats of instances are
+	// checked for deletions, and their resources for their owner.
+	ownershipCheckInterval = time.Minute
+)
+
+func idLabelValue(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])[:idHashLength]
+}
+
+// instanceLabels returns the labels of the resources of an instance.
+func instanceLabels(instanceID string) map[string]string {
+	return map[string]string{
+		managedByLabel: managedByValue,
+		instanceLabel:  idLabelValue(instanceID),
+	}
+}
+
+// bindingLabels returns the labels of the resources of a binding.
+func bindingLabels(instanceID, bindingID string) map[string]string {
+	l := instanceLabels(instanceID)
+	l[bindingLabel] = idLabelValue(bindingID)
+	return l
+}
+
+func hasFinalizer(meta *metav1.ObjectMeta) bool {
+	for _, f := range meta.Finalizers {
+		if f == habitatFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// setOwner adds the owner to the owner references of the object, or removes
+// it if owned is false. It reports whether they changed.
+func setOwner(meta *metav1.ObjectMeta, owner metav1.OwnerReference, owned bool) bool {
+	for i, ref := range meta.OwnerReferences {
+		if ref.UID != owner.UID {
+			continue
+		}
+		if owned {
+			return false
+		}
+		meta.OwnerReferences = append(meta.OwnerReferences[:i], meta.OwnerReferences[i+1:]...)
+		return true
+	}
+
+	if !owned {
+		return false
+	}
+	meta.OwnerReferences = append(meta.OwnerReferences, owner)
+	return true
+}
+
+// markHabitat labels the Habitat of an instance and adds the finalizer of
+// the broker to it.
+func markHabitat(hab *habv1beta1.Habitat, instanceID string) {
+	if hab.Labels == nil {
+		hab.Labels = map[string]string{}
+	}
+	for k, v := range instanceLabels(instanceID) {
+		hab.Labels[k] = v
+	}
+
+	if !hasFinalizer(&hab.ObjectMeta) {
+		hab.Finalizers = append(hab.Finalizers, habitatFinalizer)
+	}
+}
+
+// releaseHabitat removes the finalizer of the broker from the Habitat, so
+// it can be deleted.
+func (b *BrokerLogic) releaseHabitat(name, namespace string) error {
+	habs := b.Clients.HabClient.Habitats(namespace)
+
+	hab, err := habs.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if !hasFinalizer(&hab.ObjectMeta) {
+		return nil
+	}
+
+	finalizers := hab.Finalizers[:0]
+	for _, f := range hab.Finalizers {
+		if f != habitatFinalizer {
+			finalizers = append(finalizers, f)
+		}
+	}
+	hab.Finalizers = finalizers
+
+	if _, err := habs.Update(hab); err != nil {
+		return fmt.Errorf("error removing finalizer of Habitat %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// adoptResources makes the Habitat of an instance the owner of the resources
+// the broker created for the instance, so that they're garbage collected
+// along with it. Errors are only logged, the resources are adopted again
+// periodically.
+func (b *BrokerLogic) adoptResources(instanceID string, state *instanceState) {
+	name, err := habitatName(state.PlanID, state.Parameters)
+	if err != nil {
+		glog.Warningf("error adopting resources of instance %s: %v", instanceID, err)
+		return
+	}
+
+	hab, err := b.Clients.HabClient.Habitats(state.Namespace).Get(name, metav1.GetOptions{})
+	if err == nil {
+		err = b.adopt(hab, instanceID, state)
+	}
+	if err != nil {
+		glog.Warningf("error adopting resources of instance %s: %v", instanceID, err)
+	}
+}
+
+// adopt marks the Habitat as the broker's, and makes it the owner of the
+// secrets, CronJobs and Jobs of the instance. Jobs of CronJobs are owned by
+// them already. Volumes are only owned if they're deleted along with the
+// instance anyway. Ring keys may be shared by several instances, they're
+// deleted with the last one of them. Snapshots are never owned, they're kept
+// on purpose.
+func (b *BrokerLogic) adopt(hab *habv1beta1.Habitat, instanceID string, state *instanceState) error {
+	if hab.DeletionTimestamp != nil {
+		return nil
+	}
+
+	ns := state.Namespace
+
+	marked := hasFinalizer(&hab.ObjectMeta)
+	for k, v := range instanceLabels(instanceID) {
+		marked = marked && hab.Labels[k] == v
+	}
+	if !marked {
+		markHabitat(hab, instanceID)
+
+		updated, err := b.Clients.HabClient.Habitats(ns).Update(hab)
+		if err != nil {
+			return fmt.Errorf("error marking Habitat %s: %v", hab.Name, err)
+		}
+		hab = updated
+	}
+
+	owner := metav1.OwnerReference{
+		APIVersion: habv1beta1.SchemeGroupVersion.String(),
+		Kind:       habv1beta1.HabitatKind,
+		Name:       hab.Name,
+		UID:        hab.UID,
+	}
+	opts := metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set(instanceLabels(instanceID))).String(),
+	}
+
+	secrets := b.Clients.KubeClient.CoreV1().Secrets(ns)
+	secretList, err := secrets.List(opts)
+	if err != nil {
+		return fmt.Errorf("error listing secrets: %v", err)
+	}
+	for i := range secretList.Items {
+		s := &secretList.Items[i]
+		if setOwner(&s.ObjectMeta, owner, true) {
+			if _, err := secrets.Update(s); err != nil {
+				return fmt.Errorf("error updating owner of secret %s: %v", s.Name, err)
+			}
+		}
+	}
+
+	cronJobs := b.Clients.KubeClient.BatchV1beta1().CronJobs(ns)
+	cronJobList, err := cronJobs.List(opts)
+	if err != nil {
+		return fmt.Errorf("error listing CronJobs: %v", err)
+	}
+	for i := range cronJobList.Items {
+		c := &cronJobList.Items[i]
+		if setOwner(&c.ObjectMeta, owner, true) {
+			if _, err := cronJobs.Update(c); err != nil {
+				return fmt.Errorf("error updating owner of CronJob %s: %v", c.Name, err)
+			}
+		}
+	}
+
+	jobs := b.Clients.KubeClient.BatchV1().Jobs(ns)
+	jobList, err := jobs.List(opts)
+	if err != nil {
+		return fmt.Errorf("error listing Jobs: %v", err)
+	}
+	for i := range jobList.Items {
+		j := &jobList.Items[i]
+		if metav1.GetControllerOf(j) != nil {
+			continue
+		}
+		if setOwner(&j.ObjectMeta, owner, true) {
+			if _, err := jobs.Update(j); err != nil {
+				return fmt.Errorf("error updating owner of Job %s: %v", j.Name, err)
+			}
+		}
+	}
+
+	policy, err := b.getReclaimPolicy(state.PlanID, state.Parameters)
+	if err != nil {
+		return err
+	}
+
+	claims := b.Clients.KubeClient.CoreV1().PersistentVolumeClaims(ns)
+	claimList, err := claims.List(metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{habv1beta1.HabitatNameLabel: hab.Name}).String(),
+	})
+	if err != nil {
+		return fmt.Errorf("error listing PersistentVolumeClaims: %v", err)
+	}
+	for i := range claimList.Items {
+		c := &claimList.Items[i]
+		if setOwner(&c.ObjectMeta, owner, policy == ReclaimPolicyDelete) {
+			if _, err := claims.Update(c); err != nil {
+				return fmt.Errorf("error updating owner of PersistentVolumeClaim %s: %v", c.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// forgetDeletedInstance forgets an instance whose Habitat was deleted out of
+// band, along with its bindings, and then lets the Habitat go. The resources
+// of the instance are deleted as if it was deprovisioned, but nobody waits
+// for its volumes.
+func (b *BrokerLogic) forgetDeletedInstance(instanceID string, state *instanceState) (err error) {
+	entry := newAuditEntry(operationForget, instanceID, state.ServiceID, state.PlanID, nil, nil)
+	defer b.recordAudit(entry, &err)
+
+	bindings, err := b.listBindingStates()
+	if err != nil {
+		return err
+	}
+	for bindingID, binding := range bindings {
+		if binding.InstanceID != instanceID {
+			continue
+		}
+		if err := b.removeBindingState(bindingID); err != nil {
+			return err
+		}
+	}
+
+	// The finalizer is removed along with the Habitat.
+	reclaiming, err := b.deleteResources(state.PlanID, instanceID, entry)
+	if err != nil {
+		return err
+	}
+
+	if reclaiming {
+		return b.forgetInstance(instanceID)
+	}
+
+	return nil
+}
+
+// RunOwnershipReconciliation periodically forgets instances whose Habitat
+// was deleted out of band, and adopts the resources of the others, until the
+// context is done.
+func (b *BrokerLogic) RunOwnershipReconciliation(ctx context.Context) {
+	ticker := time.NewTicker(ownershipCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.reconcileOwnership()
+		}
+	}
+}
+
+// reconcileOwnership works on a snapshot of the instances. The Habitats are
+// fetched and adopted without the lock, which is only taken to forget an
+// instance. Instances which change in the meantime are caught up with by the
+// next pass.
+func (b *BrokerLogic) reconcileOwnership() {
+	b.RLock()
+	states, err := b.listInstanceStates()
+	b.RUnlock()
+	if err != nil {
+		glog.Errorf("error listing instances: %v", err)
+		return
+	}
+
+	for instanceID, state := range states {
+		if !ownedByHabitat(state) {
+			continue
+		}
+
+		name, err := habitatName(state.PlanID, state.Parameters)
+		if err != nil {
+			glog.Errorf("error reconciling instance %s: %v", instanceID, err)
+			continue
+		}
+
+		hab, err := b.Clients.HabClient.Habitats(state.Namespace).Get(name, metav1.GetOptions{})
+		if k8sErrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			glog.Errorf("error getting Habitat %s of instance %s: %v", name, instanceID, err)
+			continue
+		}
+
+		if hab.DeletionTimestamp != nil && hasFinalizer(&hab.ObjectMeta) {
+			b.Lock()
+			if err := b.forgetDeletedHabitat(instanceID, hab); err != nil {
+				glog.Errorf("error forgetting instance %s: %v", instanceID, err)
+			}
+			b.Unlock()
+			continue
+		}
+
+		if err := b.adopt(hab, instanceID, state); err != nil {
+			glog.Warningf("error adopting resources of instance %s: %v", instanceID, err)
+		}
+	}
+}
+
+// ownedByHabitat returns whether the resources of an instance belong to its
+// Habitat. Instances which are restored have no Habitat yet, and those which
+// are deprovisioned are deleted by the broker already.
+func ownedByHabitat(state *instanceState) bool {
+	if state.Restore != nil || state.Reclaim {
+		return false
+	}
+	return state.Operation == nil || state.Operation.Type != operationDeprovision
+}
+
+// forgetDeletedHabitat forgets the instance of a Habitat which was deleted
+// out of band, unless the instance changed since the snapshot.
+func (b *BrokerLogic) forgetDeletedHabitat(instanceID string, hab *habv1beta1.Habitat) error {
+	// The instance may have been deprovisioned in the meantime.
+	state, err := b.getInstanceState(instanceID)
+	if err != nil || state == nil || !ownedByHabitat(state) {
+		return err
+	}
+
+	name, err := habitatName(state.PlanID, state.Parameters)
+	if err != nil || name != hab.Name || state.Namespace != hab.Namespace {
+		return err
+	}
+
+	glog.Warningf("Habitat %s of instance %s was deleted out of band, forgetting the instance", hab.Name, instanceID)
+	return b.forgetDeletedInstance(instanceID, state)
+}
@@ -0,0 +1,313 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// habitatPackagePlanID is the plan of the habitat-package service, whose
+	// instances run the package given by their parameters.
+	habitatPackagePlanID = "3c8e5a1d-7f24-4b96-a0e3-5d9b2c6f8e17"
+
+	// packageServiceName is the name the broker knows instances of the
+	// habitat-package service by. It manages no config keys of theirs.
+	packageServiceName = "habitat-package"
+
+	// DefaultPackageImageTemplate names images the way `hab pkg export
+	// docker` tags them.
+	DefaultPackageImageTemplate = "{{.Origin}}/{{.Name}}:{{.Tag}}"
+)
+
+var (
+	packageOriginRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	// Package names become the names of Habitats, which must be DNS labels.
+	packageNameRegexp    = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	packageVersionRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.+-]*$`)
+)
+
+// habitatPackage is the package an instance of the habitat-package service
+// runs. The fields are exported for the image template.
+type habitatPackage struct {
+	Origin  string
+	Name    string
+	Version string
+	Release string
+	// Image is the pre-exported image of the package, if one was given.
+	Image string
+}
+
+// Tag is the image tag of the package: its version and release, its
+// version, or latest.
+func (p *habitatPackage) Tag() string {
+	switch {
+	case p.Release != "":
+		return p.Version + "-" + p.Release
+	case p.Version != "":
+		return p.Version
+	}
+	return "latest"
+}
+
+// getPackage reads the `package` and `image` parameters. The package ident
+// is origin/name[/version[/release]]. An image alone is taken to be named
+// origin/name[:tag], optionally behind a registry.
+func getPackage(params map[string]interface{}) (*habitatPackage, error) {
+	pkg := &habitatPackage{}
+
+	if i, ok := params["image"]; ok {
+		s, ok := i.(string)
+		if !ok || s == "" || strings.ContainsAny(s, " \t\n") {
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("image %v is invalid", i))
+		}
+		pkg.Image = s
+	}
+
+	p, ok := params["package"]
+	if !ok {
+		if pkg.Image == "" {
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, "either a package or an image is required")
+		}
+
+		repository, _, _ := splitImage(pkg.Image)
+		parts := strings.Split(repository, "/")
+		if len(parts) < 2 {
+			msg := fmt.Sprintf("image %s is not named origin/name, so a package is required", pkg.Image)
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, msg)
+		}
+		pkg.Origin, pkg.Name = parts[len(parts)-2], parts[len(parts)-1]
+	} else {
+		ident, ok := p.(string)
+		if !ok {
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("package %v is invalid", p))
+		}
+
+		parts := strings.Split(ident, "/")
+		if len(parts) < 2 || len(parts) > 4 {
+			msg := fmt.Sprintf("package %s is no ident of the form origin/name[/version[/release]]", ident)
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, msg)
+		}
+		pkg.Origin, pkg.Name = parts[0], parts[1]
+		if len(parts) > 2 {
+			pkg.Version = parts[2]
+		}
+		if len(parts) > 3 {
+			pkg.Release = parts[3]
+		}
+	}
+
+	if !packageOriginRegexp.MatchString(pkg.Origin) {
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("package origin %q is invalid", pkg.Origin))
+	}
+
+	if len(pkg.Name) > 63 || !packageNameRegexp.MatchString(pkg.Name) {
+		msg := fmt.Sprintf("package name %q is invalid, it must be a DNS label", pkg.Name)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, msg)
+	}
+
+	for _, v := range []string{pkg.Version, pkg.Release} {
+		if v != "" && !packageVersionRegexp.MatchString(v) {
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("package version %q is invalid", v))
+		}
+	}
+
+	return pkg, nil
+}
+
+// getStorage reads the `storage` parameter, the persistent volume of an
+// instance of the habitat-package service. Its mount path defaults to the
+// data directory of the package.
+func getStorage(name string, params map[string]interface{}) (*habv1beta1.PersistentStorage, error) {
+	s, ok := params["storage"]
+	if !ok {
+		return nil, nil
+	}
+
+	m, ok := s.(map[string]interface{})
+	if !ok {
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "storage must be an object")
+	}
+
+	storage := &habv1beta1.PersistentStorage{
+		MountPath:        fmt.Sprintf("/hab/svc/%s/data", name),
+		StorageClassName: "standard",
+	}
+
+	size, ok := m["size"].(string)
+	if !ok {
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("storage size %v is invalid", m["size"]))
+	}
+	if q, err := resource.ParseQuantity(size); err != nil || q.Sign() <= 0 {
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("storage size %q is invalid", size))
+	}
+	storage.Size = size
+
+	if p, ok := m["mountPath"]; ok {
+		s, ok := p.(string)
+		if !ok || !path.IsAbs(s) {
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("storage mount path %v must be absolute", p))
+		}
+		storage.MountPath = s
+	}
+
+	if c, ok := m["storageClassName"]; ok {
+		s, ok := c.(string)
+		if !ok || s == "" {
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("storage class %v is invalid", c))
+		}
+		storage.StorageClassName = s
+	}
+
+	return storage, nil
+}
+
+// habitatName returns the name of the Habitat of an instance. Instances of
+// the habitat-package service are named after their package.
+func habitatName(planID string, params map[string]interface{}) (string, error) {
+	if planID != habitatPackagePlanID {
+		name, _, err := matchService(planID)
+		return name, err
+	}
+
+	pkg, err := getPackage(params)
+	if err != nil {
+		return "", err
+	}
+
+	return pkg.Name, nil
+}
+
+// configService returns the service whose managed config keys apply to the
+// config of an instance.
+func configService(planID, name string) string {
+	if planID == habitatPackagePlanID {
+		return packageServiceName
+	}
+	return name
+}
+
+// splitImage splits an image reference into its repository, including the
+// registry, and its tag and digest, which may be empty.
+func splitImage(image string) (repository, tag, digest string) {
+	repository = image
+	if i := strings.Index(repository, "@"); i >= 0 {
+		repository, digest = repository[:i], repository[i+1:]
+	}
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository, tag = repository[:i], repository[i+1:]
+	}
+
+	return repository, tag, digest
+}
+
+// packageImage returns the image of the package, after checking that its
+// origin is allowed. Images are named by the image template. Pre-exported
+// images must be of the repository the template names, so that they can't
+// be pulled from elsewhere, and only pick the tag or digest. If the package
+// has a version, their tag must be the one of the template too.
+func (b *BrokerLogic) packageImage(pkg *habitatPackage) (string, error) {
+	allowed := false
+	for _, o := range b.packageOrigins {
+		if o == pkg.Origin {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		msg := fmt.Sprintf("packages of origin %s may not be provisioned", pkg.Origin)
+		return "", newHTTPStatusCodeError(http.StatusForbidden, msg)
+	}
+
+	var buf bytes.Buffer
+	if err := b.packageImageTemplate.Execute(&buf, pkg); err != nil {
+		return "", fmt.Errorf("error naming the image of package %s/%s: %v", pkg.Origin, pkg.Name, err)
+	}
+	image := buf.String()
+
+	if pkg.Image == "" {
+		return image, nil
+	}
+
+	repository, tag, _ := splitImage(image)
+	givenRepository, givenTag, _ := splitImage(pkg.Image)
+
+	if givenRepository != repository {
+		msg := fmt.Sprintf("image %s is not of repository %s, which package %s/%s is pulled from", pkg.Image, repository, pkg.Origin, pkg.Name)
+		return "", newHTTPStatusCodeError(http.StatusForbidden, msg)
+	}
+
+	if pkg.Version != "" && givenTag != "" && givenTag != tag {
+		msg := fmt.Sprintf("image %s does not match the version of package %s/%s, whose image is tagged %s", pkg.Image, pkg.Origin, pkg.Name, tag)
+		return "", newHTTPStatusCodeError(http.StatusBadRequest, msg)
+	}
+
+	return pkg.Image, nil
+}
+
+// newPackageHabitat generates the Habitat of an instance of the
+// habitat-package service.
+func (b *BrokerLogic) newPackageHabitat(parameters map[string]interface{}, params habitatParameters) (*habv1beta1.Habitat, error) {
+	pkg, err := getPackage(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := b.packageImage(pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := getStorage(pkg.Name, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	hab := NewHabitat(pkg.Name, image, params)
+	// The volumes of the services of the broker are not applied to packages
+	// which happen to have the same name.
+	hab.Spec.V1beta2.PersistentStorage = storage
+
+	return hab, nil
+}
+
+// parsePackageImageTemplate parses the template images of packages are named
+// with.
+func parsePackageImageTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultPackageImageTemplate
+	}
+
+	t, err := template.New("image").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("package image template %q is invalid: %v", text, err)
+	}
+
+	// Typos in field names only show when the template is executed.
+	if err := t.Execute(&bytes.Buffer{}, &habitatPackage{Origin: "core", Name: "redis"}); err != nil {
+		return nil, fmt.Errorf("package image template %q is invalid: %v", text, err)
+	}
+
+	return t, nil
+}
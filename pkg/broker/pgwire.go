@@ -0,0 +1,298 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	pgProtocolVersion = 3 << 16
+	pgTimeout         = 30 * time.Second
+
+	pgAuthOK                = 0
+	pgAuthCleartextPassword = 3
+	pgAuthMD5Password       = 5
+	pgAuthSASL              = 10
+	pgAuthSASLContinue      = 11
+	pgAuthSASLFinal         = 12
+
+	pgSCRAMSHA256 = "SCRAM-SHA-256"
+)
+
+// pgError is an ErrorResponse of the server.
+type pgError struct {
+	Severity string
+	Code     string
+	Message  string
+}
+
+func (e *pgError) Error() string {
+	return fmt.Sprintf("%s: %s (SQLSTATE %s)", e.Severity, e.Message, e.Code)
+}
+
+// pgConn is a minimal client of the PostgreSQL frontend/backend protocol. It
+// only supports the simple query protocol, which is enough to manage roles
+// and databases, and password, MD5 and SCRAM-SHA-256 authentication.
+type pgConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// pgConnect opens a connection to the database and authenticates as the
+// user.
+func pgConnect(addr, user, password, database string) (*pgConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, pgTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(pgTimeout))
+
+	c := &pgConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+
+	if err := c.startup(user, password, database); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *pgConn) Close() error {
+	c.send('X', nil)
+	return c.conn.Close()
+}
+
+func (c *pgConn) startup(user, password, database string) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, int32(pgProtocolVersion))
+	for _, s := range []string{"user", user, "database", database} {
+		buf.WriteString(s)
+		buf.WriteByte(0)
+	}
+	buf.WriteByte(0)
+
+	// The startup message is the only one without a type.
+	msg := make([]byte, 4, 4+buf.Len())
+	binary.BigEndian.PutUint32(msg, uint32(4+buf.Len()))
+	if _, err := c.conn.Write(append(msg, buf.Bytes()...)); err != nil {
+		return err
+	}
+
+	var scram *scramClient
+
+	for {
+		t, payload, err := c.receive()
+		if err != nil {
+			return err
+		}
+
+		switch t {
+		case 'R':
+			if len(payload) < 4 {
+				return errors.New("malformed authentication request")
+			}
+			code := binary.BigEndian.Uint32(payload)
+			data := payload[4:]
+
+			switch code {
+			case pgAuthOK:
+			case pgAuthCleartextPassword:
+				err = c.send('p', cstring(password))
+			case pgAuthMD5Password:
+				err = c.send('p', cstring(pgMD5Password(user, password, data)))
+			case pgAuthSASL:
+				if !strings.Contains(string(data), pgSCRAMSHA256+"\x00") {
+					return fmt.Errorf("the server offers no supported SASL mechanism")
+				}
+				if scram, err = newSCRAMClient("", password); err != nil {
+					return err
+				}
+				first := scram.clientFirst()
+				var msg bytes.Buffer
+				msg.Write(cstring(pgSCRAMSHA256))
+				binary.Write(&msg, binary.BigEndian, int32(len(first)))
+				msg.WriteString(first)
+				err = c.send('p', msg.Bytes())
+			case pgAuthSASLContinue:
+				if scram == nil {
+					return errors.New("unexpected SASL continuation")
+				}
+				var final string
+				if final, err = scram.clientFinal(string(data)); err == nil {
+					err = c.send('p', []byte(final))
+				}
+			case pgAuthSASLFinal:
+				if scram == nil {
+					return errors.New("unexpected SASL completion")
+				}
+				err = scram.verifyServerFinal(string(data))
+			default:
+				return fmt.Errorf("authentication method %d is not supported", code)
+			}
+			if err != nil {
+				return err
+			}
+		case 'E':
+			return parsePGError(payload)
+		case 'Z':
+			return nil
+		}
+	}
+}
+
+// query runs the statements, which are separated by semicolons, and returns
+// the rows of the last result. Values are in text format, NULL is returned
+// as an empty string.
+func (c *pgConn) query(q string) ([][]string, error) {
+	if err := c.send('Q', cstring(q)); err != nil {
+		return nil, err
+	}
+
+	var rows [][]string
+	var queryErr error
+
+	for {
+		t, payload, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t {
+		case 'T':
+			rows = nil
+		case 'D':
+			row, err := parsePGDataRow(payload)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, row)
+		case 'E':
+			queryErr = parsePGError(payload)
+		case 'Z':
+			return rows, queryErr
+		}
+	}
+}
+
+func (c *pgConn) send(t byte, payload []byte) error {
+	msg := make([]byte, 5, 5+len(payload))
+	msg[0] = t
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(payload)))
+	_, err := c.conn.Write(append(msg, payload...))
+	return err
+}
+
+func (c *pgConn) receive() (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return 0, nil, err
+	}
+
+	n := int(binary.BigEndian.Uint32(header[1:])) - 4
+	if n < 0 {
+		return 0, nil, errors.New("malformed message length")
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], payload, nil
+}
+
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func parsePGError(payload []byte) error {
+	e := &pgError{}
+	for _, field := range bytes.Split(payload, []byte{0}) {
+		if len(field) < 2 {
+			continue
+		}
+		switch field[0] {
+		case 'S':
+			e.Severity = string(field[1:])
+		case 'C':
+			e.Code = string(field[1:])
+		case 'M':
+			e.Message = string(field[1:])
+		}
+	}
+
+	return e
+}
+
+func parsePGDataRow(payload []byte) ([]string, error) {
+	if len(payload) < 2 {
+		return nil, errors.New("malformed data row")
+	}
+
+	n := int(binary.BigEndian.Uint16(payload))
+	payload = payload[2:]
+	row := make([]string, 0, n)
+
+	for i := 0; i < n; i++ {
+		if len(payload) < 4 {
+			return nil, errors.New("malformed data row")
+		}
+		l := int(int32(binary.BigEndian.Uint32(payload)))
+		payload = payload[4:]
+
+		if l < 0 {
+			row = append(row, "")
+			continue
+		}
+		if len(payload) < l {
+			return nil, errors.New("malformed data row")
+		}
+		row = append(row, string(payload[:l]))
+		payload = payload[l:]
+	}
+
+	return row, nil
+}
+
+func pgMD5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// quoteIdentifier quotes a name for use in SQL.
+func quoteIdentifier(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+// quoteLiteral quotes a string for use in SQL. The server must have
+// standard_conforming_strings enabled, which is the default.
+func quoteLiteral(s string) string {
+	return `'` + strings.Replace(s, `'`, `''`, -1) + `'`
+}
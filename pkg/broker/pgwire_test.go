@@ -0,0 +1,251 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// newTestPGConn returns a connection whose server side is played by the
+// returned end of a pipe.
+func newTestPGConn() (*pgConn, net.Conn) {
+	client, server := net.Pipe()
+	return &pgConn{conn: client, r: bufio.NewReader(client)}, server
+}
+
+// pgMessage frames a message of the backend.
+func pgMessage(t byte, payload ...byte) []byte {
+	n := 4 + len(payload)
+	return append([]byte{t, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}, payload...)
+}
+
+func TestPGSend(t *testing.T) {
+	tests := []struct {
+		t       byte
+		payload []byte
+		want    []byte
+	}{
+		{t: 'X', want: []byte{'X', 0, 0, 0, 4}},
+		{t: 'Q', payload: cstring("SELECT 1"), want: append([]byte{'Q', 0, 0, 0, 13}, "SELECT 1\x00"...)},
+		{t: 'p', payload: []byte{1, 2, 3}, want: []byte{'p', 0, 0, 0, 7, 1, 2, 3}},
+	}
+
+	for _, tt := range tests {
+		c, server := newTestPGConn()
+
+		received := make(chan []byte)
+		go func() {
+			data, _ := ioutil.ReadAll(server)
+			received <- data
+		}()
+
+		if err := c.send(tt.t, tt.payload); err != nil {
+			t.Fatalf("send(%q) error = %v", tt.t, err)
+		}
+		c.conn.Close()
+
+		if got := <-received; !bytes.Equal(got, tt.want) {
+			t.Errorf("send(%q, %v) wrote %v, want %v", tt.t, tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestPGReceive(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		wantType    byte
+		wantPayload []byte
+		wantErr     bool
+	}{
+		{name: "empty", data: pgMessage('Z'), wantType: 'Z', wantPayload: []byte{}},
+		{name: "payload", data: pgMessage('Z', 'I'), wantType: 'Z', wantPayload: []byte{'I'}},
+		{name: "negative length", data: []byte{'Z', 0, 0, 0, 3}, wantErr: true},
+		{name: "truncated header", data: []byte{'Z', 0, 0}, wantErr: true},
+		{name: "truncated payload", data: []byte{'Z', 0, 0, 0, 6, 'I'}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		c, server := newTestPGConn()
+		go func(data []byte) {
+			server.Write(data)
+			server.Close()
+		}(tt.data)
+
+		gotType, gotPayload, err := c.receive()
+		c.conn.Close()
+
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: receive() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if gotType != tt.wantType || !bytes.Equal(gotPayload, tt.wantPayload) {
+			t.Errorf("%s: receive() = %q, %v, want %q, %v", tt.name, gotType, gotPayload, tt.wantType, tt.wantPayload)
+		}
+	}
+}
+
+func TestPGQuery(t *testing.T) {
+	rowDescription := pgMessage('T', 0, 1)
+	readyForQuery := pgMessage('Z', 'I')
+	errorResponse := pgMessage('E', []byte("SERROR\x00C42710\x00Mrole exists\x00\x00")...)
+
+	tests := []struct {
+		name     string
+		messages [][]byte
+		want     [][]string
+		wantErr  error
+	}{
+		{
+			name: "rows",
+			messages: [][]byte{
+				rowDescription,
+				pgMessage('D', 0, 1, 0, 0, 0, 1, 'a'),
+				pgMessage('D', 0, 1, 0xff, 0xff, 0xff, 0xff),
+				pgMessage('C', []byte("SELECT 2\x00")...),
+				readyForQuery,
+			},
+			want: [][]string{{"a"}, {""}},
+		},
+		{
+			name: "rows of the last result",
+			messages: [][]byte{
+				rowDescription,
+				pgMessage('D', 0, 1, 0, 0, 0, 1, 'a'),
+				rowDescription,
+				pgMessage('D', 0, 1, 0, 0, 0, 1, 'b'),
+				readyForQuery,
+			},
+			want: [][]string{{"b"}},
+		},
+		{
+			name:     "error",
+			messages: [][]byte{errorResponse, readyForQuery},
+			wantErr:  &pgError{Severity: "ERROR", Code: "42710", Message: "role exists"},
+		},
+	}
+
+	for _, tt := range tests {
+		c, server := newTestPGConn()
+		go func(messages [][]byte) {
+			r := bufio.NewReader(server)
+			if _, _, err := (&pgConn{conn: server, r: r}).receive(); err != nil {
+				return
+			}
+			for _, m := range messages {
+				server.Write(m)
+			}
+		}(tt.messages)
+
+		got, err := c.query("SELECT 1")
+		c.conn.Close()
+
+		if !reflect.DeepEqual(err, tt.wantErr) {
+			t.Errorf("%s: query() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: query() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParsePGError(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    *pgError
+	}{
+		{
+			payload: "SERROR\x00VERROR\x00C42P04\x00Mdatabase \"a\" already exists\x00Fdbcommands.c\x00\x00",
+			want:    &pgError{Severity: "ERROR", Code: "42P04", Message: `database "a" already exists`},
+		},
+		{
+			payload: "SFATAL\x00C28P01\x00Mpassword authentication failed for user \"b\"\x00\x00",
+			want:    &pgError{Severity: "FATAL", Code: "28P01", Message: `password authentication failed for user "b"`},
+		},
+		{
+			payload: "\x00",
+			want:    &pgError{},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := parsePGError([]byte(tt.payload)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePGError(%q) = %#v, want %#v", tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestParsePGDataRow(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    []string
+		wantErr bool
+	}{
+		{name: "no columns", payload: []byte{0, 0}, want: []string{}},
+		{name: "values", payload: []byte{0, 2, 0, 0, 0, 2, 'a', 'b', 0, 0, 0, 0}, want: []string{"ab", ""}},
+		{name: "null", payload: []byte{0, 1, 0xff, 0xff, 0xff, 0xff}, want: []string{""}},
+		{name: "no column count", payload: []byte{0}, wantErr: true},
+		{name: "missing column", payload: []byte{0, 2, 0, 0, 0, 1, 'a'}, wantErr: true},
+		{name: "truncated value", payload: []byte{0, 1, 0, 0, 0, 3, 'a'}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parsePGDataRow(tt.payload)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: parsePGDataRow() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parsePGDataRow() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPGMD5Password(t *testing.T) {
+	got := pgMD5Password("postgres", "secret", []byte{1, 2, 3, 4})
+	if want := "md5bb41a296aab6baccb36ff243a562abff"; got != want {
+		t.Errorf("pgMD5Password() = %s, want %s", got, want)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		s          string
+		identifier string
+		literal    string
+	}{
+		{s: "binding_1", identifier: `"binding_1"`, literal: `'binding_1'`},
+		{s: `a"b`, identifier: `"a""b"`, literal: `'a"b'`},
+		{s: "a'b", identifier: `"a'b"`, literal: `'a''b'`},
+	}
+
+	for _, tt := range tests {
+		if got := quoteIdentifier(tt.s); got != tt.identifier {
+			t.Errorf("quoteIdentifier(%q) = %s, want %s", tt.s, got, tt.identifier)
+		}
+		if got := quoteLiteral(tt.s); got != tt.literal {
+			t.Errorf("quoteLiteral(%q) = %s, want %s", tt.s, got, tt.literal)
+		}
+	}
+}
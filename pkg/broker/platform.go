@@ -0,0 +1,174 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"strings"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// NamespaceStrategySpace maps every Cloud Foundry space to its own
+	// namespace.
+	NamespaceStrategySpace = "space"
+	// NamespaceStrategyOrganization maps every Cloud Foundry organization
+	// to its own namespace.
+	NamespaceStrategyOrganization = "organization"
+	// NamespaceStrategyFixed maps all requests to the same namespace.
+	NamespaceStrategyFixed = "fixed"
+
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "habitat-service-broker"
+
+	cfOrganizationLabel = "cloudfoundry.org/org_guid"
+	cfSpaceLabel        = "cloudfoundry.org/space_guid"
+)
+
+var namespaceStrategySet = map[string]struct{}{
+	NamespaceStrategySpace:        {},
+	NamespaceStrategyOrganization: {},
+	NamespaceStrategyFixed:        {},
+}
+
+// PlatformOptions configures how requests from platforms other than
+// Kubernetes are mapped to a namespace.
+type PlatformOptions struct {
+	// NamespaceStrategy is one of NamespaceStrategySpace,
+	// NamespaceStrategyOrganization or NamespaceStrategyFixed.
+	NamespaceStrategy string
+	// Namespace is the namespace used by NamespaceStrategyFixed, and for
+	// contexts that carry neither a namespace nor Cloud Foundry GUIDs.
+	Namespace string
+	// NamespacePrefix is prepended to the GUID of the space or organization.
+	NamespacePrefix string
+	// CreateNamespaces indicates whether missing namespaces are created.
+	CreateNamespaces bool
+}
+
+func (o *PlatformOptions) validate() error {
+	if _, ok := namespaceStrategySet[o.NamespaceStrategy]; !ok {
+		return fmt.Errorf("namespace strategy %q is invalid", o.NamespaceStrategy)
+	}
+
+	if o.NamespaceStrategy == NamespaceStrategyFixed && o.Namespace == "" {
+		return fmt.Errorf("namespace strategy %q requires a namespace", o.NamespaceStrategy)
+	}
+
+	return nil
+}
+
+// resolveNamespace returns the namespace an instance is provisioned in,
+// based on the platform the request originates from. Requests from the
+// Kubernetes service-catalog name the namespace in their context, requests
+// from Cloud Foundry are mapped according to the configured strategy. If the
+// namespace doesn't exist yet and the broker is allowed to create it, the
+// namespace to create is returned too. It's only created once the request
+// has been authorized and checked against the policy, see
+// createPlatformNamespace.
+func (b *BrokerLogic) resolveNamespace(context map[string]interface{}, organizationGUID, spaceGUID string) (string, *v1.Namespace, error) {
+	platform, _ := context["platform"].(string)
+
+	if platform == osb.PlatformKubernetes || platform == "" {
+		if _, ok := context["namespace"]; ok {
+			ns, err := getNamespace(context)
+			return ns, nil, err
+		}
+	}
+
+	// Since OSB API 2.12 the GUIDs are part of the context, the fields of
+	// the request are deprecated.
+	if guid, ok := context["organization_guid"].(string); ok {
+		organizationGUID = guid
+	}
+	if guid, ok := context["space_guid"].(string); ok {
+		spaceGUID = guid
+	}
+
+	o := b.platform
+	if organizationGUID == "" && spaceGUID == "" {
+		if o.Namespace == "" {
+			return "", nil, fmt.Errorf("context of platform %q has neither a namespace nor Cloud Foundry GUIDs", platform)
+		}
+		return o.Namespace, nil, nil
+	}
+
+	var ns string
+	switch o.NamespaceStrategy {
+	case NamespaceStrategySpace:
+		if spaceGUID == "" {
+			return "", nil, fmt.Errorf("context of platform %q has no space GUID", platform)
+		}
+		ns = o.NamespacePrefix + strings.ToLower(spaceGUID)
+	case NamespaceStrategyOrganization:
+		if organizationGUID == "" {
+			return "", nil, fmt.Errorf("context of platform %q has no organization GUID", platform)
+		}
+		ns = o.NamespacePrefix + strings.ToLower(organizationGUID)
+	case NamespaceStrategyFixed:
+		ns = o.Namespace
+	}
+
+	missing, err := b.missingPlatformNamespace(ns, organizationGUID, spaceGUID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return ns, missing, nil
+}
+
+// missingPlatformNamespace returns the namespace to create if it doesn't
+// exist yet and the broker is allowed to, or nil if it exists.
+func (b *BrokerLogic) missingPlatformNamespace(name, organizationGUID, spaceGUID string) (*v1.Namespace, error) {
+	_, err := b.Clients.KubeClient.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
+	if err == nil {
+		return nil, nil
+	}
+
+	if !k8sErrors.IsNotFound(err) || !b.platform.CreateNamespaces {
+		return nil, fmt.Errorf("error getting namespace %q: %v", name, err)
+	}
+
+	l := map[string]string{
+		managedByLabel: managedByValue,
+	}
+	if organizationGUID != "" {
+		l[cfOrganizationLabel] = organizationGUID
+	}
+	if spaceGUID != "" && b.platform.NamespaceStrategy == NamespaceStrategySpace {
+		l[cfSpaceLabel] = spaceGUID
+	}
+
+	return &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: l,
+		},
+	}, nil
+}
+
+// createPlatformNamespace creates a namespace returned by resolveNamespace.
+func (b *BrokerLogic) createPlatformNamespace(namespace *v1.Namespace) error {
+	_, err := b.Clients.KubeClient.CoreV1().Namespaces().Create(namespace)
+	if err != nil && !k8sErrors.IsAlreadyExists(err) {
+		return fmt.Errorf("error creating namespace %q: %v", namespace.Name, err)
+	}
+
+	return nil
+}
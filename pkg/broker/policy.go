@@ -0,0 +1,168 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/ghodss/yaml"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Policy restricts where instances can be provisioned and how many of them.
+type Policy struct {
+	// AllowedNamespaces selects the namespaces instances can be provisioned
+	// in. All namespaces are allowed if nil.
+	AllowedNamespaces *metav1.LabelSelector `json:"allowedNamespaces,omitempty"`
+	// DeniedNamespaces selects the namespaces instances can never be
+	// provisioned in, even if they are allowed.
+	DeniedNamespaces *metav1.LabelSelector `json:"deniedNamespaces,omitempty"`
+	// InstanceQuotas limit the number of instances.
+	InstanceQuotas []InstanceQuota `json:"instanceQuotas,omitempty"`
+	// MaxReplicasPerNamespace limits the sum of the `count` of all
+	// instances in a namespace. There's no limit if it's 0.
+	MaxReplicasPerNamespace int `json:"maxReplicasPerNamespace,omitempty"`
+
+	allowed labels.Selector
+	denied  labels.Selector
+}
+
+// InstanceQuota limits the number of instances of a service and plan in
+// every namespace. Empty fields match everything.
+type InstanceQuota struct {
+	ServiceID    string `json:"serviceID,omitempty"`
+	PlanID       string `json:"planID,omitempty"`
+	Namespace    string `json:"namespace,omitempty"`
+	MaxInstances int    `json:"maxInstances"`
+}
+
+func (q *InstanceQuota) matches(serviceID, planID, namespace string) bool {
+	return (q.ServiceID == "" || q.ServiceID == serviceID) &&
+		(q.PlanID == "" || q.PlanID == planID) &&
+		(q.Namespace == "" || q.Namespace == namespace)
+}
+
+// LoadPolicy reads the policy from the YAML or JSON file at the given path.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading policy: %v", err)
+	}
+
+	p := &Policy{}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("error parsing policy: %v", err)
+	}
+
+	if p.AllowedNamespaces != nil {
+		if p.allowed, err = metav1.LabelSelectorAsSelector(p.AllowedNamespaces); err != nil {
+			return nil, fmt.Errorf("allowedNamespaces is invalid: %v", err)
+		}
+	}
+
+	if p.DeniedNamespaces != nil {
+		if p.denied, err = metav1.LabelSelectorAsSelector(p.DeniedNamespaces); err != nil {
+			return nil, fmt.Errorf("deniedNamespaces is invalid: %v", err)
+		}
+	}
+
+	return p, nil
+}
+
+// enforcePolicy checks whether an instance with the given service, plan and
+// count may exist in the namespace. The instance itself is left out of the
+// current usage, so that updates of existing instances can be checked too.
+// Namespaces which are yet to be created are passed as missing, and checked
+// by the labels they'll be created with.
+func (b *BrokerLogic) enforcePolicy(instanceID, serviceID, planID, namespace string, missing *v1.Namespace, count int) error {
+	if b.Policy == nil {
+		return nil
+	}
+
+	if err := b.enforceNamespacePolicy(namespace, missing); err != nil {
+		return err
+	}
+
+	states, err := b.listInstanceStates()
+	if err != nil {
+		return err
+	}
+
+	replicas := count
+	for id, s := range states {
+		if id == instanceID || s.Namespace != namespace {
+			continue
+		}
+		replicas += s.Count
+	}
+
+	if max := b.Policy.MaxReplicasPerNamespace; max > 0 && replicas > max {
+		msg := fmt.Sprintf("namespace %q would run %d replicas in total, which exceeds the maximum of %d", namespace, replicas, max)
+		return newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+	}
+
+	for _, q := range b.Policy.InstanceQuotas {
+		if !q.matches(serviceID, planID, namespace) {
+			continue
+		}
+
+		// The instance itself counts towards the quota.
+		instances := 1
+		for id, s := range states {
+			if id != instanceID && s.Namespace == namespace && q.matches(s.ServiceID, s.PlanID, s.Namespace) {
+				instances++
+			}
+		}
+
+		if instances > q.MaxInstances {
+			msg := fmt.Sprintf("namespace %q would have %d instances of service %q and plan %q, which exceeds the maximum of %d", namespace, instances, serviceID, planID, q.MaxInstances)
+			return newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+		}
+	}
+
+	return nil
+}
+
+func (b *BrokerLogic) enforceNamespacePolicy(namespace string, missing *v1.Namespace) error {
+	if b.Policy.allowed == nil && b.Policy.denied == nil {
+		return nil
+	}
+
+	ns := missing
+	if ns == nil {
+		var err error
+		if ns, err = b.Clients.KubeClient.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{}); err != nil {
+			return fmt.Errorf("error getting namespace %q: %v", namespace, err)
+		}
+	}
+
+	set := labels.Set(ns.Labels)
+
+	if b.Policy.allowed != nil && !b.Policy.allowed.Matches(set) {
+		msg := fmt.Sprintf("namespace %q does not match the allowed namespaces %q", namespace, b.Policy.allowed)
+		return newHTTPStatusCodeError(http.StatusForbidden, msg)
+	}
+
+	if b.Policy.denied != nil && b.Policy.denied.Matches(set) {
+		msg := fmt.Sprintf("namespace %q matches the denied namespaces %q", namespace, b.Policy.denied)
+		return newHTTPStatusCodeError(http.StatusForbidden, msg)
+	}
+
+	return nil
+}
@@ -0,0 +1,441 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	postgresqlPort = 5432
+
+	// postgresqlSuperuser is the name of the superuser the broker manages
+	// the roles and databases of bindings with.
+	postgresqlSuperuser   = "admin"
+	postgresqlReplication = "replication"
+	// postgresqlMaintenanceDB is the database the broker connects to when it
+	// doesn't work on the database of a binding.
+	postgresqlMaintenanceDB = "postgres"
+)
+
+// postgresqlCredentialsLayer returns the config layer with new passwords of
+// the superuser and the replication user of a PostgreSQL instance.
+func (b *BrokerLogic) postgresqlCredentialsLayer() (map[string]interface{}, error) {
+	superuser, err := b.generatePassword("postgresql")
+	if err != nil {
+		return nil, err
+	}
+
+	replication, err := b.generatePassword("postgresql")
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"superuser": map[string]interface{}{
+			"name":     postgresqlSuperuser,
+			"password": superuser,
+		},
+		"replication": map[string]interface{}{
+			"name":     postgresqlReplication,
+			"password": replication,
+		},
+	}, nil
+}
+
+// postgresqlBindingParameters are the parameters of a PostgreSQL binding. A
+// binding either gets a database of its own, or accesses the one of another
+// binding of the instance.
+type postgresqlBindingParameters struct {
+	database string
+	readOnly bool
+}
+
+func getPostgresqlBindingParameters(params map[string]interface{}) (*postgresqlBindingParameters, error) {
+	p := &postgresqlBindingParameters{}
+
+	if d, ok := params["database"]; ok {
+		s, ok := d.(string)
+		if !ok || s == "" {
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("database %v is invalid", d))
+		}
+		p.database = s
+	}
+
+	if r, ok := params["readOnly"]; ok {
+		readOnly, ok := r.(bool)
+		if !ok {
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("readOnly %v is invalid", r))
+		}
+		p.readOnly = readOnly
+	}
+
+	if p.readOnly && p.database == "" {
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "readOnly needs the database of another binding")
+	}
+
+	return p, nil
+}
+
+// postgresqlDatabase returns the database a binding accesses.
+func postgresqlDatabase(bindingID string, params *postgresqlBindingParameters) string {
+	if params.database != "" {
+		return params.database
+	}
+
+	return bindingIdentifier(bindingID)
+}
+
+// postgresqlDatabaseUsers returns the IDs of the other bindings of the
+// instance which access the database.
+func (b *BrokerLogic) postgresqlDatabaseUsers(instanceID, bindingID, database string) ([]string, error) {
+	states, err := b.listBindingStates()
+	if err != nil {
+		return nil, err
+	}
+
+	var users []string
+
+	for id, s := range states {
+		if id == bindingID || s.InstanceID != instanceID {
+			continue
+		}
+
+		params, err := getPostgresqlBindingParameters(s.Parameters)
+		if err != nil {
+			return nil, err
+		}
+
+		if postgresqlDatabase(id, params) == database {
+			users = append(users, id)
+		}
+	}
+
+	return users, nil
+}
+
+// postgresqlSuperuserPassword reads the password of the superuser from the
+// config secret of the instance.
+func (b *BrokerLogic) postgresqlSuperuserPassword(hab *habv1beta1.Habitat, namespace string) (string, error) {
+	layer, err := b.getConfigCredentials(hab, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	superuser, _ := layer["superuser"].(map[string]interface{})
+	password, _ := superuser["password"].(string)
+	if password == "" {
+		return "", fmt.Errorf("the config of Habitat %s has no superuser password", hab.Name)
+	}
+
+	return password, nil
+}
+
+// postgresqlPrimary returns the address of the PostgreSQL server of the
+// Habitat which accepts writes, which is the leader of a leader topology.
+func (b *BrokerLogic) postgresqlPrimary(name, namespace, password string) (string, error) {
+	selector := labels.SelectorFromSet(labels.Set{habv1beta1.HabitatNameLabel: name})
+	pods, err := b.Clients.KubeClient.CoreV1().Pods(namespace).List(metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error listing pods of Habitat %s: %v", name, err)
+	}
+
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != v1.PodRunning || pod.Status.PodIP == "" {
+			continue
+		}
+
+		addr := net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(postgresqlPort))
+		rows, err := b.postgresqlQuery(addr, password, postgresqlMaintenanceDB, "SELECT pg_is_in_recovery()")
+		if err != nil {
+			return "", fmt.Errorf("error querying PostgreSQL server of pod %s: %v", pod.Name, err)
+		}
+
+		if len(rows) == 1 && len(rows[0]) == 1 && rows[0][0] == "f" {
+			return addr, nil
+		}
+	}
+
+	return "", newHTTPStatusCodeError(http.StatusServiceUnavailable, fmt.Sprintf("no PostgreSQL server of Habitat %s accepts writes yet", name))
+}
+
+// postgresqlQuery runs the statements in the database as the superuser.
+func (b *BrokerLogic) postgresqlQuery(addr, password, database string, statements ...string) ([][]string, error) {
+	conn, err := pgConnect(addr, postgresqlSuperuser, password, database)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.query(strings.Join(statements, "; "))
+}
+
+// createPostgresqlBinding creates the role of a binding, and either a
+// database it owns or the grants on the database of another binding.
+func (b *BrokerLogic) createPostgresqlBinding(request *osb.BindRequest, state *bindingState, entry *AuditEntry) (map[string]interface{}, error) {
+	name := "postgresql"
+	ns := state.Namespace
+
+	params, err := getPostgresqlBindingParameters(request.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	database := postgresqlDatabase(request.BindingID, params)
+	if params.database != "" {
+		users, err := b.postgresqlDatabaseUsers(request.InstanceID, request.BindingID, database)
+		if err != nil {
+			return nil, err
+		}
+		if len(users) == 0 {
+			msg := fmt.Sprintf("database %q is no database of a binding of instance %s", database, request.InstanceID)
+			return nil, newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+		}
+	}
+
+	hab, err := b.GetHabitat(name, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	superuser, err := b.postgresqlSuperuserPassword(hab, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := b.postgresqlPrimary(name, ns, superuser)
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := b.generatePassword(name)
+	if err != nil {
+		return nil, err
+	}
+
+	role := bindingIdentifier(request.BindingID)
+	r, db := quoteIdentifier(role), quoteIdentifier(database)
+
+	// Roles and databases of failed binds are taken over by their retry.
+	rows, err := b.postgresqlQuery(addr, superuser, postgresqlMaintenanceDB,
+		fmt.Sprintf("SELECT 1 FROM pg_roles WHERE rolname = %s", quoteLiteral(role)))
+	if err != nil {
+		return nil, fmt.Errorf("error looking up role %s: %v", role, err)
+	}
+
+	createRole := fmt.Sprintf("CREATE ROLE %s LOGIN PASSWORD %s", r, quoteLiteral(password))
+	if len(rows) > 0 {
+		createRole = fmt.Sprintf("ALTER ROLE %s LOGIN PASSWORD %s", r, quoteLiteral(password))
+	}
+	if _, err := b.postgresqlQuery(addr, superuser, postgresqlMaintenanceDB, createRole); err != nil {
+		return nil, fmt.Errorf("error creating role %s: %v", role, err)
+	}
+
+	if params.database == "" {
+		rows, err := b.postgresqlQuery(addr, superuser, postgresqlMaintenanceDB,
+			fmt.Sprintf("SELECT 1 FROM pg_database WHERE datname = %s", quoteLiteral(database)))
+		if err != nil {
+			return nil, fmt.Errorf("error looking up database %s: %v", database, err)
+		}
+
+		// CREATE DATABASE can't run along with other statements.
+		if len(rows) == 0 {
+			if _, err := b.postgresqlQuery(addr, superuser, postgresqlMaintenanceDB, fmt.Sprintf("CREATE DATABASE %s OWNER %s", db, r)); err != nil {
+				return nil, fmt.Errorf("error creating database %s: %v", database, err)
+			}
+		}
+
+		if _, err := b.postgresqlQuery(addr, superuser, postgresqlMaintenanceDB, fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM PUBLIC", db)); err != nil {
+			return nil, fmt.Errorf("error revoking access to database %s: %v", database, err)
+		}
+	} else {
+		rows, err := b.postgresqlQuery(addr, superuser, postgresqlMaintenanceDB,
+			fmt.Sprintf("SELECT pg_get_userbyid(datdba) FROM pg_database WHERE datname = %s", quoteLiteral(database)))
+		if err != nil || len(rows) == 0 {
+			return nil, fmt.Errorf("error looking up owner of database %s: %v", database, err)
+		}
+		owner := quoteIdentifier(rows[0][0])
+
+		statements := []string{
+			fmt.Sprintf("GRANT CONNECT ON DATABASE %s TO %s", db, r),
+			fmt.Sprintf("GRANT USAGE ON SCHEMA public TO %s", r),
+		}
+		if params.readOnly {
+			statements = append(statements,
+				fmt.Sprintf("GRANT SELECT ON ALL TABLES IN SCHEMA public TO %s", r),
+				fmt.Sprintf("GRANT SELECT ON ALL SEQUENCES IN SCHEMA public TO %s", r),
+				fmt.Sprintf("ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA public GRANT SELECT ON TABLES TO %s", owner, r),
+				fmt.Sprintf("ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA public GRANT SELECT ON SEQUENCES TO %s", owner, r))
+		} else {
+			statements = append(statements,
+				fmt.Sprintf("GRANT TEMPORARY ON DATABASE %s TO %s", db, r),
+				fmt.Sprintf("GRANT CREATE ON SCHEMA public TO %s", r),
+				fmt.Sprintf("GRANT ALL ON ALL TABLES IN SCHEMA public TO %s", r),
+				fmt.Sprintf("GRANT ALL ON ALL SEQUENCES IN SCHEMA public TO %s", r),
+				fmt.Sprintf("ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA public GRANT ALL ON TABLES TO %s", owner, r),
+				fmt.Sprintf("ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA public GRANT ALL ON SEQUENCES TO %s", owner, r))
+		}
+
+		if _, err := b.postgresqlQuery(addr, superuser, database, statements...); err != nil {
+			return nil, fmt.Errorf("error granting role %s access to database %s: %v", role, database, err)
+		}
+	}
+
+	secretName := derivedSecretName("habitat-osb-postgresql-binding", request.BindingID)
+	if _, err := b.createSecret(secretName, ns, bindingLabels(request.InstanceID, request.BindingID), map[string][]byte{"password": []byte(password)}); err != nil {
+		return nil, err
+	}
+	entry.created("Secret", ns, secretName)
+
+	if err := b.storeCredential(request.InstanceID, request.BindingID, password); err != nil {
+		return nil, err
+	}
+
+	state.SecretName = secretName
+	return b.postgresqlCredentials(name, ns, role, password, database, params.readOnly), nil
+}
+
+// deletePostgresqlBinding drops the role of a binding along with its grants.
+// Objects it owns go to the superuser. A database lives on until the last
+// binding which accesses it is deleted.
+func (b *BrokerLogic) deletePostgresqlBinding(request *osb.UnbindRequest, state *bindingState, entry *AuditEntry) error {
+	name := "postgresql"
+	ns := state.Namespace
+
+	params, err := getPostgresqlBindingParameters(state.Parameters)
+	if err != nil {
+		return err
+	}
+
+	hab, err := b.GetHabitat(name, ns)
+	if err != nil {
+		return err
+	}
+
+	superuser, err := b.postgresqlSuperuserPassword(hab, ns)
+	if err != nil {
+		return err
+	}
+
+	addr, err := b.postgresqlPrimary(name, ns, superuser)
+	if err != nil {
+		return err
+	}
+
+	role := bindingIdentifier(request.BindingID)
+	database := postgresqlDatabase(request.BindingID, params)
+	r, db := quoteIdentifier(role), quoteIdentifier(database)
+	su := quoteIdentifier(postgresqlSuperuser)
+
+	users, err := b.postgresqlDatabaseUsers(request.InstanceID, request.BindingID, database)
+	if err != nil {
+		return err
+	}
+
+	rows, err := b.postgresqlQuery(addr, superuser, postgresqlMaintenanceDB,
+		fmt.Sprintf("SELECT 1 FROM pg_database WHERE datname = %s", quoteLiteral(database)))
+	if err != nil {
+		return fmt.Errorf("error looking up database %s: %v", database, err)
+	}
+	exists := len(rows) > 0
+
+	// The role's sessions end, so that its connections don't keep the
+	// database alive.
+	terminate := fmt.Sprintf("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE usename = %s", quoteLiteral(role))
+
+	switch {
+	case !exists:
+	case len(users) == 0:
+		statements := []string{
+			terminate,
+			fmt.Sprintf("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = %s", quoteLiteral(database)),
+		}
+		if _, err := b.postgresqlQuery(addr, superuser, postgresqlMaintenanceDB, statements...); err != nil {
+			return fmt.Errorf("error ending sessions of database %s: %v", database, err)
+		}
+
+		// DROP DATABASE can't run along with other statements.
+		if _, err := b.postgresqlQuery(addr, superuser, postgresqlMaintenanceDB, fmt.Sprintf("DROP DATABASE IF EXISTS %s", db)); err != nil {
+			return fmt.Errorf("error dropping database %s: %v", database, err)
+		}
+	default:
+		if params.database == "" {
+			if _, err := b.postgresqlQuery(addr, superuser, postgresqlMaintenanceDB, fmt.Sprintf("ALTER DATABASE %s OWNER TO %s", db, su)); err != nil {
+				return fmt.Errorf("error handing database %s over to %s: %v", database, postgresqlSuperuser, err)
+			}
+		}
+
+		statements := []string{
+			terminate,
+			fmt.Sprintf("REASSIGN OWNED BY %s TO %s", r, su),
+			fmt.Sprintf("DROP OWNED BY %s", r),
+		}
+		if _, err := b.postgresqlQuery(addr, superuser, database, statements...); err != nil {
+			return fmt.Errorf("error revoking grants of role %s: %v", role, err)
+		}
+	}
+
+	if _, err := b.postgresqlQuery(addr, superuser, postgresqlMaintenanceDB, terminate, fmt.Sprintf("DROP ROLE IF EXISTS %s", r)); err != nil {
+		return fmt.Errorf("error dropping role %s: %v", role, err)
+	}
+
+	if state.SecretName != "" {
+		if err := b.deleteSecret(state.SecretName, ns); err != nil && !k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("error deleting secret: %v", err)
+		}
+		entry.deleted("Secret", ns, state.SecretName)
+	}
+
+	return nil
+}
+
+// postgresqlCredentials returns the credentials of a PostgreSQL binding. The
+// host is only known if the user created a Service for the Habitat pods.
+func (b *BrokerLogic) postgresqlCredentials(name, namespace, role, password, database string, readOnly bool) map[string]interface{} {
+	credentials := map[string]interface{}{
+		"username": role,
+		"password": password,
+		"database": database,
+		"port":     postgresqlPort,
+		"readOnly": readOnly,
+	}
+
+	if host := b.findServiceHost(name, namespace); host != "" {
+		credentials["host"] = host
+		uri := url.URL{
+			Scheme: "postgres",
+			User:   url.UserPassword(role, password),
+			Host:   fmt.Sprintf("%s:%d", host, postgresqlPort),
+			Path:   "/" + database,
+		}
+		credentials["uri"] = uri.String()
+	}
+
+	return credentials
+}
@@ -0,0 +1,301 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	rabbitmqPort           = 5672
+	rabbitmqManagementPort = 15672
+
+	// rabbitmqAdmin is the name of the administrator the broker manages the
+	// vhosts and users of bindings with.
+	rabbitmqAdmin = "admin"
+
+	rabbitmqRequestTimeout = 30 * time.Second
+)
+
+// rabbitmqCredentialsLayer returns the config layer with a new password of
+// the administrator of a RabbitMQ instance, and the Erlang cookie its nodes
+// cluster with.
+func (b *BrokerLogic) rabbitmqCredentialsLayer() (map[string]interface{}, error) {
+	password, err := b.generatePassword("rabbitmq")
+	if err != nil {
+		return nil, err
+	}
+
+	cookie, err := b.generatePassword("rabbitmq")
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"rabbitmq": map[string]interface{}{
+			"default_user": rabbitmqAdmin,
+			"default_pass": password,
+		},
+		"erlang_cookie": cookie,
+	}, nil
+}
+
+// rabbitmqName returns the name of the vhost and user of a binding.
+func rabbitmqName(bindingID string) string {
+	return "binding-" + bindingID
+}
+
+// rabbitmqAdminPassword reads the password of the administrator from the
+// config secret of the instance.
+func (b *BrokerLogic) rabbitmqAdminPassword(hab *habv1beta1.Habitat, namespace string) (string, error) {
+	layer, err := b.getConfigCredentials(hab, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	rabbitmq, _ := layer["rabbitmq"].(map[string]interface{})
+	password, _ := rabbitmq["default_pass"].(string)
+	if password == "" {
+		return "", fmt.Errorf("the config of Habitat %s has no administrator password", hab.Name)
+	}
+
+	return password, nil
+}
+
+// rabbitmqManagementURL returns the management API of the Habitat. Vhosts,
+// users and permissions are shared by all nodes of a cluster, so any running
+// node will do.
+func (b *BrokerLogic) rabbitmqManagementURL(name, namespace string) (string, error) {
+	selector := labels.SelectorFromSet(labels.Set{habv1beta1.HabitatNameLabel: name})
+	pods, err := b.Clients.KubeClient.CoreV1().Pods(namespace).List(metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error listing pods of Habitat %s: %v", name, err)
+	}
+
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodRunning && pod.Status.PodIP != "" {
+			return "http://" + net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(rabbitmqManagementPort)), nil
+		}
+	}
+
+	return "", newHTTPStatusCodeError(http.StatusServiceUnavailable, fmt.Sprintf("no RabbitMQ node of Habitat %s is running yet", name))
+}
+
+// rabbitmqRequest sends a request to the management API as the
+// administrator. Deleting what does not exist succeeds.
+func rabbitmqRequest(method, base, path, password string, body interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, base+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(rabbitmqAdmin, password)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := http.Client{Timeout: rabbitmqRequestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if method == http.MethodDelete && resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+// createRabbitmqBinding creates the vhost of a binding, and a user with all
+// permissions on it.
+func (b *BrokerLogic) createRabbitmqBinding(request *osb.BindRequest, state *bindingState, entry *AuditEntry) (map[string]interface{}, error) {
+	name := "rabbitmq"
+	ns := state.Namespace
+
+	hab, err := b.GetHabitat(name, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	admin, err := b.rabbitmqAdminPassword(hab, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := b.rabbitmqManagementURL(name, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := b.generatePassword(name)
+	if err != nil {
+		return nil, err
+	}
+
+	user := rabbitmqName(request.BindingID)
+	if err := rabbitmqAddUser(base, admin, user, password); err != nil {
+		return nil, err
+	}
+
+	secretName := derivedSecretName("habitat-osb-rabbitmq-binding", request.BindingID)
+	if _, err := b.createSecret(secretName, ns, bindingLabels(request.InstanceID, request.BindingID), map[string][]byte{"password": []byte(password)}); err != nil {
+		return nil, err
+	}
+	entry.created("Secret", ns, secretName)
+
+	if err := b.storeCredential(request.InstanceID, request.BindingID, password); err != nil {
+		return nil, err
+	}
+
+	state.SecretName = secretName
+	return b.rabbitmqCredentials(name, ns, user, password), nil
+}
+
+// deleteRabbitmqBinding deletes the user and the vhost of a binding, which
+// closes their connections and drops their queues.
+func (b *BrokerLogic) deleteRabbitmqBinding(request *osb.UnbindRequest, state *bindingState, entry *AuditEntry) error {
+	name := "rabbitmq"
+	ns := state.Namespace
+
+	hab, err := b.GetHabitat(name, ns)
+	if err != nil {
+		return err
+	}
+
+	admin, err := b.rabbitmqAdminPassword(hab, ns)
+	if err != nil {
+		return err
+	}
+
+	base, err := b.rabbitmqManagementURL(name, ns)
+	if err != nil {
+		return err
+	}
+
+	if err := rabbitmqDeleteUser(base, admin, rabbitmqName(request.BindingID)); err != nil {
+		return err
+	}
+
+	if state.SecretName != "" {
+		if err := b.deleteSecret(state.SecretName, ns); err != nil && !k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("error deleting secret: %v", err)
+		}
+		entry.deleted("Secret", ns, state.SecretName)
+	}
+
+	return nil
+}
+
+// rabbitmqAddUser creates a user and a vhost of the same name, which the
+// user has all permissions on. The management tag lets the user log into the
+// management API and UI, where it only sees its vhost. Vhosts and users are
+// created with PUT, so the retry of a failed bind takes them over.
+func rabbitmqAddUser(base, admin, user, password string) error {
+	vhost := url.PathEscape(user)
+
+	if err := rabbitmqRequest(http.MethodPut, base, "/api/vhosts/"+vhost, admin, nil); err != nil {
+		return fmt.Errorf("error creating vhost %s: %v", user, err)
+	}
+
+	body := map[string]string{"password": password, "tags": "management"}
+	if err := rabbitmqRequest(http.MethodPut, base, "/api/users/"+vhost, admin, body); err != nil {
+		return fmt.Errorf("error creating user %s: %v", user, err)
+	}
+
+	permissions := map[string]string{"configure": ".*", "write": ".*", "read": ".*"}
+	if err := rabbitmqRequest(http.MethodPut, base, "/api/permissions/"+vhost+"/"+vhost, admin, permissions); err != nil {
+		return fmt.Errorf("error granting user %s access to vhost %s: %v", user, user, err)
+	}
+
+	return nil
+}
+
+// rabbitmqDeleteUser deletes a user and the vhost of the same name.
+func rabbitmqDeleteUser(base, admin, user string) error {
+	vhost := url.PathEscape(user)
+
+	if err := rabbitmqRequest(http.MethodDelete, base, "/api/users/"+vhost, admin, nil); err != nil {
+		return fmt.Errorf("error deleting user %s: %v", user, err)
+	}
+
+	if err := rabbitmqRequest(http.MethodDelete, base, "/api/vhosts/"+vhost, admin, nil); err != nil {
+		return fmt.Errorf("error deleting vhost %s: %v", user, err)
+	}
+
+	return nil
+}
+
+// rabbitmqCredentials returns the credentials of a RabbitMQ binding. The
+// host is only known if the user created a Service for the Habitat pods.
+func (b *BrokerLogic) rabbitmqCredentials(name, namespace, user, password string) map[string]interface{} {
+	credentials := map[string]interface{}{
+		"username":       user,
+		"password":       password,
+		"vhost":          user,
+		"port":           rabbitmqPort,
+		"managementPort": rabbitmqManagementPort,
+	}
+
+	if host := b.findServiceHost(name, namespace); host != "" {
+		credentials["host"] = host
+
+		uri := url.URL{
+			Scheme: "amqp",
+			User:   url.UserPassword(user, password),
+			Host:   fmt.Sprintf("%s:%d", host, rabbitmqPort),
+			Path:   "/" + user,
+		}
+		credentials["uri"] = uri.String()
+
+		management := url.URL{
+			Scheme: "http",
+			User:   url.UserPassword(user, password),
+			Host:   fmt.Sprintf("%s:%d", host, rabbitmqManagementPort),
+			Path:   "/api/",
+		}
+		credentials["managementUri"] = management.String()
+	}
+
+	return credentials
+}
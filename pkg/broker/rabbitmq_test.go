@@ -0,0 +1,130 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/habitat-sh/habitat-service-broker/test/standin/rabbitmq"
+)
+
+func TestRabbitmqUsers(t *testing.T) {
+	server := httptest.NewServer(rabbitmq.NewHandler(rabbitmqAdmin, "secret"))
+	defer server.Close()
+
+	base := server.URL
+
+	allPermissions := map[string]interface{}{"configure": ".*", "write": ".*", "read": ".*"}
+
+	tests := []struct {
+		name      string
+		add       []string
+		delete    []string
+		admin     string
+		wantErr   bool
+		wantUsers map[string]interface{}
+	}{
+		{
+			name:      "add",
+			add:       []string{"binding-a", "binding-b"},
+			admin:     "secret",
+			wantUsers: map[string]interface{}{"binding-a": map[string]interface{}{"binding-a": allPermissions}, "binding-b": map[string]interface{}{"binding-b": allPermissions}},
+		},
+		{
+			name:      "add again",
+			add:       []string{"binding-a"},
+			admin:     "secret",
+			wantUsers: map[string]interface{}{"binding-a": map[string]interface{}{"binding-a": allPermissions}, "binding-b": map[string]interface{}{"binding-b": allPermissions}},
+		},
+		{
+			name:      "delete",
+			delete:    []string{"binding-b"},
+			admin:     "secret",
+			wantUsers: map[string]interface{}{"binding-a": map[string]interface{}{"binding-a": allPermissions}},
+		},
+		{
+			name:      "delete missing",
+			delete:    []string{"binding-b"},
+			admin:     "secret",
+			wantUsers: map[string]interface{}{"binding-a": map[string]interface{}{"binding-a": allPermissions}},
+		},
+		{
+			name:      "wrong password",
+			add:       []string{"binding-c"},
+			admin:     "wrong",
+			wantErr:   true,
+			wantUsers: map[string]interface{}{"binding-a": map[string]interface{}{"binding-a": allPermissions}},
+		},
+	}
+
+	for _, tt := range tests {
+		var err error
+		for _, user := range tt.add {
+			if err = rabbitmqAddUser(base, tt.admin, user, "pw"); err != nil {
+				break
+			}
+		}
+		for _, user := range tt.delete {
+			if err = rabbitmqDeleteUser(base, tt.admin, user); err != nil {
+				break
+			}
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+
+		req, _ := http.NewRequest(http.MethodGet, base+"/api/users", nil)
+		req.SetBasicAuth(rabbitmqAdmin, "secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: error listing users: %v", tt.name, err)
+		}
+		users := map[string]interface{}{}
+		err = json.NewDecoder(resp.Body).Decode(&users)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: error decoding users: %v", tt.name, err)
+		}
+
+		if !reflect.DeepEqual(users, tt.wantUsers) {
+			t.Errorf("%s: users = %v, want %v", tt.name, users, tt.wantUsers)
+		}
+
+		for name := range users {
+			req, _ := http.NewRequest(http.MethodGet, base+"/api/users/"+name, nil)
+			req.SetBasicAuth(rabbitmqAdmin, "secret")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s: error getting user %s: %v", tt.name, name, err)
+			}
+			var u struct {
+				Tags string `json:"tags"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&u)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("%s: error decoding user %s: %v", tt.name, name, err)
+			}
+
+			if u.Tags != "management" {
+				t.Errorf("%s: tags of user %s = %q, want %q", tt.name, name, u.Tags, "management")
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/ghodss/yaml"
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// ReclaimPolicyRetain keeps the volumes and services of an instance
+	// when it's deprovisioned.
+	ReclaimPolicyRetain = "retain"
+	// ReclaimPolicyDelete deletes the volumes, secrets and services of an
+	// instance when it's deprovisioned.
+	ReclaimPolicyDelete = "delete"
+)
+
+var reclaimPolicySet = map[string]struct{}{
+	ReclaimPolicyRetain: {},
+	ReclaimPolicyDelete: {},
+}
+
+// LoadPlanReclaimPolicies reads the reclaim policy of every plan, keyed by
+// plan ID, from the YAML or JSON file at the given path. Plans missing from
+// the file retain their resources.
+func LoadPlanReclaimPolicies(filename string) (map[string]string, error) {
+	policies := map[string]string{}
+	if filename == "" {
+		return policies, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading plan reclaim policies: %v", err)
+	}
+
+	if err := yaml.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("error parsing plan reclaim policies: %v", err)
+	}
+
+	for planID, policy := range policies {
+		if _, _, err := matchService(planID); err != nil && planID != habitatPackagePlanID {
+			return nil, fmt.Errorf("reclaim policy of plan %q is invalid: %v", planID, err)
+		}
+
+		if _, ok := reclaimPolicySet[policy]; !ok {
+			return nil, fmt.Errorf("reclaim policy %q of plan %q is invalid, it must be %q or %q", policy, planID, ReclaimPolicyRetain, ReclaimPolicyDelete)
+		}
+	}
+
+	return policies, nil
+}
+
+// getReclaimPolicy reads the `reclaimPolicy` parameter, which defaults to the
+// policy of the plan.
+func (b *BrokerLogic) getReclaimPolicy(planID string, params map[string]interface{}) (string, error) {
+	p, ok := params["reclaimPolicy"]
+	if !ok {
+		if policy, ok := b.planReclaimPolicies[planID]; ok {
+			return policy, nil
+		}
+		return ReclaimPolicyRetain, nil
+	}
+
+	policy, ok := p.(string)
+	if _, valid := reclaimPolicySet[policy]; !ok || !valid {
+		msg := fmt.Sprintf("reclaimPolicy %v is invalid, it must be %q or %q", p, ReclaimPolicyRetain, ReclaimPolicyDelete)
+		return "", newHTTPStatusCodeError(http.StatusBadRequest, msg)
+	}
+
+	return policy, nil
+}
+
+// reclaimable is a resource of an instance which is deleted along with it.
+type reclaimable struct {
+	kind string
+	name string
+	// deleting is set once its deletion is under way.
+	deleting bool
+}
+
+// listReclaimable returns the volumes, secrets and services of an instance.
+// Volumes and services are found by the label of the Habitat, which the
+// StatefulSet gives the claims of its pods. Secrets are found by the label of
+// the instance.
+func (b *BrokerLogic) listReclaimable(name, namespace, instanceID string) ([]reclaimable, error) {
+	habitatSelector := labels.SelectorFromSet(labels.Set{habv1beta1.HabitatNameLabel: name}).String()
+	instanceSelector := labels.SelectorFromSet(labels.Set(instanceLabels(instanceID))).String()
+
+	var resources []reclaimable
+
+	claims, err := b.Clients.KubeClient.CoreV1().PersistentVolumeClaims(namespace).List(metav1.ListOptions{LabelSelector: habitatSelector})
+	if err != nil {
+		return nil, fmt.Errorf("error listing PersistentVolumeClaims of Habitat %s: %v", name, err)
+	}
+	for _, c := range claims.Items {
+		resources = append(resources, reclaimable{"PersistentVolumeClaim", c.Name, c.DeletionTimestamp != nil})
+	}
+
+	secrets, err := b.Clients.KubeClient.CoreV1().Secrets(namespace).List(metav1.ListOptions{LabelSelector: instanceSelector})
+	if err != nil {
+		return nil, fmt.Errorf("error listing secrets of instance %s: %v", instanceID, err)
+	}
+	for _, s := range secrets.Items {
+		resources = append(resources, reclaimable{"Secret", s.Name, s.DeletionTimestamp != nil})
+	}
+
+	services, err := b.Clients.KubeClient.CoreV1().Services(namespace).List(metav1.ListOptions{LabelSelector: habitatSelector})
+	if err != nil {
+		return nil, fmt.Errorf("error listing services of Habitat %s: %v", name, err)
+	}
+	for _, s := range services.Items {
+		resources = append(resources, reclaimable{"Service", s.Name, s.DeletionTimestamp != nil})
+	}
+
+	return resources, nil
+}
+
+// reclaim starts to delete the volumes, secrets and services of an instance.
+func (b *BrokerLogic) reclaim(name, namespace, instanceID string, entry *AuditEntry) error {
+	resources, err := b.listReclaimable(name, namespace, instanceID)
+	if err != nil {
+		return err
+	}
+
+	core := b.Clients.KubeClient.CoreV1()
+	for _, r := range resources {
+		if r.deleting {
+			continue
+		}
+
+		switch r.kind {
+		case "PersistentVolumeClaim":
+			err = core.PersistentVolumeClaims(namespace).Delete(r.name, &metav1.DeleteOptions{})
+		case "Secret":
+			err = b.deleteSecret(r.name, namespace)
+		case "Service":
+			err = core.Services(namespace).Delete(r.name, &metav1.DeleteOptions{})
+		}
+
+		if err == nil {
+			entry.deleted(r.kind, namespace, r.name)
+		} else if !k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("error deleting %s %s: %v", r.kind, r.name, err)
+		}
+	}
+
+	return nil
+}
+
+// reclaimLastOperation reports whether the volumes, secrets and services of
+// a deprovisioned instance are gone. Volumes are only deleted once no pod
+// uses them anymore. The instance is forgotten once they're all gone. If it
+// times out, the deprovision can be retried.
+func (b *BrokerLogic) reclaimLastOperation(request *osb.LastOperationRequest, state *instanceState) (_ *broker.LastOperationResponse, err error) {
+	response := &broker.LastOperationResponse{}
+	response.State = osb.StateInProgress
+
+	name, err := habitatName(state.PlanID, state.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	remaining, err := b.listReclaimable(name, state.Namespace, request.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(remaining) > 0 && time.Since(state.Operation.Started) < operationTimeout {
+		description := fmt.Sprintf("waiting for %d volumes, secrets and services to be deleted", len(remaining))
+		response.Description = &description
+		return response, nil
+	}
+
+	entry := newAuditEntry(operationDeprovision, request.InstanceID, state.ServiceID, state.PlanID, request.OriginatingIdentity, nil)
+	defer b.recordAudit(entry, &err)
+
+	if len(remaining) > 0 {
+		r := remaining[0]
+		description := fmt.Sprintf("timed out after %v waiting for %s %s to be deleted", operationTimeout, r.kind, r.name)
+		entry.Error = description
+		response.State = osb.StateFailed
+		response.Description = &description
+
+		state.Operation = nil
+		return response, b.setInstanceState(request.InstanceID, state)
+	}
+
+	if err := b.forgetInstance(request.InstanceID); err != nil {
+		return nil, err
+	}
+
+	response.State = osb.StateSucceeded
+	return response, nil
+}
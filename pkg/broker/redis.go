@@ -0,0 +1,397 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/go-redis/redis"
+	"github.com/golang/glog"
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// redisUserRules are the ACL rules of the users of bindings. They may use
+// all keys and commands, except the administrative ones, which the broker
+// keeps to the default user.
+var redisUserRules = []string{"on", "~*", "+@all", "-@admin"}
+
+// redisRestoreAttempts is how often the user of a binding is restored in a
+// row, if the binding keeps changing while it's restored.
+const redisRestoreAttempts = 3
+
+// redisBindingSecretName returns the name of the secret which holds the
+// password of the redis user of a binding.
+func redisBindingSecretName(bindingID string) string {
+	return derivedSecretName("habitat-osb-redis-binding", bindingID)
+}
+
+// hasRedisUser reports whether the binding has a redis user of its own.
+// Bindings created by older versions of the broker share the password of the
+// default user instead.
+func hasRedisUser(bindingID string, state *bindingState) bool {
+	return state != nil && state.SecretName == redisBindingSecretName(bindingID)
+}
+
+// redisAdminPassword reads the password of the default user, which the
+// broker manages the users of bindings with, from the config secret of the
+// instance. It's empty for instances of older versions of the broker which
+// were never bound.
+func (b *BrokerLogic) redisAdminPassword(hab *habv1beta1.Habitat, namespace string) (string, error) {
+	layer, err := b.getConfigCredentials(hab, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	password, _ := layer["requirepass"].(string)
+	return password, nil
+}
+
+// prepareRedisBinding gives instances which run without a password one
+// before their first binding, which older versions of the broker left them
+// without. Their pods restart with it, so the bind is asynchronous, and the
+// user is only created once they're ready again, see createPendingUser. It
+// returns whether the pods restart.
+func (b *BrokerLogic) prepareRedisBinding(request *osb.BindRequest, namespace string, async bool, entry *AuditEntry) (bool, error) {
+	name := "redis"
+
+	hab, err := b.GetHabitat(name, namespace)
+	if err != nil {
+		return false, err
+	}
+
+	admin, err := b.redisAdminPassword(hab, namespace)
+	if err != nil || admin != "" {
+		return false, err
+	}
+
+	if !async {
+		msg := osb.AsyncErrorMessage
+		description := "the pods of the instance restart with a password before its first binding, so it is bound asynchronously"
+		return false, osb.HTTPStatusCodeError{
+			StatusCode:   http.StatusUnprocessableEntity,
+			ErrorMessage: &msg,
+			Description:  &description,
+		}
+	}
+
+	if admin, err = b.generatePassword(name); err != nil {
+		return false, err
+	}
+
+	if _, err := b.applyBindingConfig(hab, namespace, request.InstanceID, request.PlanID, redisCredentialsLayer(hab, admin), false, entry); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// createRedisBinding creates the redis user of a binding, see
+// prepareRedisBinding for instances which run without a password.
+func (b *BrokerLogic) createRedisBinding(request *osb.BindRequest, state *bindingState, entry *AuditEntry) (map[string]interface{}, error) {
+	name := "redis"
+	ns := state.Namespace
+
+	hab, err := b.GetHabitat(name, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	admin, err := b.redisAdminPassword(hab, ns)
+	if err != nil {
+		return nil, err
+	}
+	if admin == "" {
+		return nil, fmt.Errorf("instance %s runs without a password, so no users can be created", request.InstanceID)
+	}
+
+	password, err := b.generatePassword(name)
+	if err != nil {
+		return nil, err
+	}
+
+	secretName := redisBindingSecretName(request.BindingID)
+	if _, err := b.createSecret(secretName, ns, bindingLabels(request.InstanceID, request.BindingID), map[string][]byte{"password": []byte(password)}); err != nil {
+		return nil, err
+	}
+	entry.created("Secret", ns, secretName)
+
+	user := bindingIdentifier(request.BindingID)
+	if err := b.setRedisUser(name, ns, admin, user, password); err != nil {
+		return nil, err
+	}
+
+	if err := b.storeCredential(request.InstanceID, request.BindingID, password); err != nil {
+		return nil, err
+	}
+
+	state.SecretName = secretName
+	return b.redisCredentials(name, ns, user, password), nil
+}
+
+// deleteRedisBinding deletes the redis user of a binding and disconnects its
+// clients.
+func (b *BrokerLogic) deleteRedisBinding(request *osb.UnbindRequest, state *bindingState, entry *AuditEntry) error {
+	name := "redis"
+	ns := state.Namespace
+
+	hab, err := b.GetHabitat(name, ns)
+	if err != nil {
+		return err
+	}
+
+	admin, err := b.redisAdminPassword(hab, ns)
+	if err != nil {
+		return err
+	}
+
+	if err := b.deleteRedisUser(name, ns, admin, bindingIdentifier(request.BindingID)); err != nil {
+		return err
+	}
+
+	if err := b.deleteSecret(state.SecretName, ns); err != nil && !k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting secret: %v", err)
+	}
+	entry.deleted("Secret", ns, state.SecretName)
+
+	return nil
+}
+
+// rekeyRedis replaces the password of the default user of an instance once
+// the last binding which shares it is deleted. The running servers only
+// accept the new password right away, the config makes it stick. It returns
+// whether an asynchronous unbinding was started, see releaseBindingConfig.
+func (b *BrokerLogic) rekeyRedis(request *osb.UnbindRequest, hab *habv1beta1.Habitat, namespace string, state *bindingState, async bool, entry *AuditEntry) (bool, error) {
+	old, err := b.redisAdminPassword(hab, namespace)
+	if err != nil {
+		return false, err
+	}
+
+	admin, err := b.generatePassword(hab.Name)
+	if err != nil {
+		return false, err
+	}
+
+	err = b.forEachRedisServer(hab.Name, namespace, old, func(c *redis.Client) error {
+		return aclSetUser(c, "default", "resetpass", ">"+admin)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return b.releaseBindingConfig(request, hab, namespace, state, redisCredentialsLayer(hab, admin), async, entry)
+}
+
+// sharesAdminPassword returns whether other bindings of the instance use the
+// password of the default user.
+func (b *BrokerLogic) sharesAdminPassword(instanceID, bindingID string) (bool, error) {
+	states, err := b.listBindingStates()
+	if err != nil {
+		return false, err
+	}
+
+	for id, s := range states {
+		if id == bindingID || s.InstanceID != instanceID || hasRedisUser(id, s) || pendingUser("redis", s) {
+			continue
+		}
+		if s.Operation != nil && s.Operation.Type == operationUnbind {
+			continue
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// setRedisUser creates or replaces the user on every redis server of the
+// Habitat, with the given passwords.
+func (b *BrokerLogic) setRedisUser(name, namespace, admin, user string, passwords ...string) error {
+	rules := []string{"resetpass"}
+	for _, p := range passwords {
+		rules = append(rules, ">"+p)
+	}
+	rules = append(rules, redisUserRules...)
+
+	return b.forEachRedisServer(name, namespace, admin, func(c *redis.Client) error {
+		return aclSetUser(c, user, rules...)
+	})
+}
+
+// reconcileRedisUsers restores the users of redis bindings on servers which
+// were restarted, as users only live as long as the server.
+func (b *BrokerLogic) reconcileRedisUsers() {
+	b.RLock()
+	states, err := b.listBindingStates()
+	b.RUnlock()
+	if err != nil {
+		glog.Errorf("error listing bindings: %v", err)
+		return
+	}
+
+	for bindingID := range states {
+		if err := b.restoreRedisUser(bindingID); err != nil {
+			glog.Warningf("error restoring redis user of binding %s: %v", bindingID, err)
+		}
+	}
+}
+
+// redisUser is what a redis user of a binding is restored from.
+type redisUser struct {
+	state     *bindingState
+	admin     string
+	passwords []string
+}
+
+// restoreRedisUser sets the user of a binding on every redis server. Its
+// passwords are read with the lock held, but the servers are changed
+// without it. The binding is checked again afterwards: the user is restored
+// once more if the binding changed in the meantime, or deleted if the
+// binding was deleted.
+func (b *BrokerLogic) restoreRedisUser(bindingID string) error {
+	name := "redis"
+	user := bindingIdentifier(bindingID)
+
+	for i := 0; i < redisRestoreAttempts; i++ {
+		b.RLock()
+		u, err := b.getRedisUser(bindingID)
+		b.RUnlock()
+		if err != nil || u == nil {
+			return err
+		}
+
+		if err := b.setRedisUser(name, u.state.Namespace, u.admin, user, u.passwords...); err != nil {
+			return err
+		}
+
+		b.RLock()
+		state, err := b.getBindingState(bindingID)
+		b.RUnlock()
+		if err != nil {
+			return err
+		}
+
+		if !hasRedisUser(bindingID, state) {
+			return b.deleteRedisUser(name, u.state.Namespace, u.admin, user)
+		}
+		if reflect.DeepEqual(state, u.state) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("binding %s changed during %d attempts", bindingID, redisRestoreAttempts)
+}
+
+// getRedisUser reads the passwords of the redis user of a binding. It's nil
+// for bindings without a user of their own, or busy with an operation.
+func (b *BrokerLogic) getRedisUser(bindingID string) (*redisUser, error) {
+	// The binding may have been deleted in the meantime.
+	state, err := b.getBindingState(bindingID)
+	if err != nil || state == nil || state.Operation != nil || !hasRedisUser(bindingID, state) {
+		return nil, err
+	}
+
+	hab, err := b.GetHabitat("redis", state.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	admin, err := b.redisAdminPassword(hab, state.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := b.getBindingPassword(state.SecretName, state.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	passwords := []string{password}
+	if state.Rotation != nil {
+		rotated, err := b.getRotationPassword(state)
+		if err != nil {
+			return nil, err
+		}
+		passwords = append(passwords, rotated)
+	}
+
+	return &redisUser{state: state, admin: admin, passwords: passwords}, nil
+}
+
+// deleteRedisUser deletes the user on every redis server of the Habitat and
+// disconnects its clients.
+func (b *BrokerLogic) deleteRedisUser(name, namespace, admin, user string) error {
+	return b.forEachRedisServer(name, namespace, admin, func(c *redis.Client) error {
+		if err := c.Process(redis.NewIntCmd("acl", "deluser", user)); err != nil {
+			return fmt.Errorf("error deleting redis user %s on %s: %v", user, c.Options().Addr, err)
+		}
+		if err := c.Process(redis.NewIntCmd("client", "kill", "user", user)); err != nil {
+			return fmt.Errorf("error disconnecting redis user %s on %s: %v", user, c.Options().Addr, err)
+		}
+		return nil
+	})
+}
+
+// aclSetUser applies the ACL rules to the user. It requires redis 6 or
+// newer.
+func aclSetUser(c *redis.Client, user string, rules ...string) error {
+	args := []interface{}{"acl", "setuser", user}
+	for _, r := range rules {
+		args = append(args, r)
+	}
+
+	cmd := redis.NewStatusCmd(args...)
+	if err := c.Process(cmd); err != nil {
+		return fmt.Errorf("error changing redis user %s on %s, users of bindings require redis ACLs: %v", user, c.Options().Addr, err)
+	}
+
+	return nil
+}
+
+// forEachRedisServer connects to every running pod of the Habitat with the
+// given password.
+func (b *BrokerLogic) forEachRedisServer(name, namespace, password string, fn func(*redis.Client) error) error {
+	selector := labels.SelectorFromSet(labels.Set{habv1beta1.HabitatNameLabel: name})
+	pods, err := b.Clients.KubeClient.CoreV1().Pods(namespace).List(metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return fmt.Errorf("error listing pods of Habitat %s: %v", name, err)
+	}
+
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != v1.PodRunning || pod.Status.PodIP == "" {
+			continue
+		}
+
+		c := redis.NewClient(&redis.Options{
+			Addr:     fmt.Sprintf("%s:%d", pod.Status.PodIP, redisPort),
+			Password: password,
+		})
+		err := fn(c)
+		c.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
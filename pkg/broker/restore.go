@@ -0,0 +1,447 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// restoreScript extracts a backup into the empty volume of the first member
+// of a new Habitat. Backup IDs are unique across instances, so the backup is
+// looked up by its ID alone, in the target of the namespace. Backups taken to clone an instance are deleted
+// once they're restored.
+const restoreScript = `set -eu
+file="$BACKUP_ID.tar.gz"
+case "$TARGET" in
+pvc)
+  path=$(find /backups -name "$file" | head -n 1)
+  [ -n "$path" ] || { echo "backup $BACKUP_ID does not exist" >&2; exit 1; }
+  tar -xzf "$path" -C /data
+  [ "$CLONE" = true ] && rm -f "$path"
+  ;;
+s3)
+  mc alias set target "$S3_ENDPOINT" "$S3_ACCESS_KEY" "$S3_SECRET_KEY" >/dev/null
+  path=$(mc find "target/$S3_BUCKET" --name "$file" | head -n 1)
+  [ -n "$path" ] || { echo "backup $BACKUP_ID does not exist" >&2; exit 1; }
+  mc cat "$path" | tar -xzf - -C /data
+  [ "$CLONE" = true ] && mc rm "$path"
+  ;;
+esac
+exit 0
+`
+
+// backupIDRegexp matches the IDs of scheduled, final and clone backups.
+var backupIDRegexp = regexp.MustCompile(`^habitat-osb-backup-[0-9a-f]{32}-([0-9]+|final|clone[0-9a-f]{6})$`)
+
+// restoreState tracks the restore of a new instance. The Habitat is only
+// created once its volume is seeded.
+type restoreState struct {
+	// BackupID is the backup the volume is seeded from.
+	BackupID string `json:"backupID"`
+	// CloneNamespace is the namespace of the instance which is cloned, whose
+	// Job takes the backup first. It's empty once the backup is taken, or
+	// if an existing backup is restored.
+	CloneNamespace string              `json:"cloneNamespace,omitempty"`
+	Clone          bool                `json:"clone,omitempty"`
+	Habitat        *habv1beta1.Habitat `json:"habitat"`
+}
+
+// restoreSource is the `restoreFrom` parameter, either the ID of a backup or
+// of an instance which is cloned.
+type restoreSource struct {
+	backupID string
+	// instanceID and instance are set if an instance is cloned.
+	instanceID string
+	instance   *instanceState
+}
+
+// getRestoreSource reads the `restoreFrom` parameter. Instances can only be
+// cloned from instances of the same service.
+func (b *BrokerLogic) getRestoreSource(serviceID string, params map[string]interface{}) (*restoreSource, error) {
+	r, ok := params["restoreFrom"]
+	if !ok {
+		return nil, nil
+	}
+
+	s, ok := r.(string)
+	if !ok || s == "" {
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("restoreFrom %v is invalid", r))
+	}
+
+	if b.backup.Target == "" {
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "backups are not enabled on this broker, so nothing can be restored")
+	}
+
+	if backupIDRegexp.MatchString(s) {
+		return &restoreSource{backupID: s}, nil
+	}
+
+	state, err := b.getInstanceState(s)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		msg := fmt.Sprintf("restoreFrom %s is neither a backup nor an instance", s)
+		return nil, newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+	}
+
+	if state.ServiceID != serviceID {
+		msg := fmt.Sprintf("instance %s is of another service, so it can't be cloned", s)
+		return nil, newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+	}
+
+	return &restoreSource{instanceID: s, instance: state}, nil
+}
+
+// verifyRestoreSource checks that the originating user may read the source
+// of a restore, and that it can be restored into the namespace as the Habitat
+// of the given name. Backups are kept in the volume or the bucket of their
+// namespace, so neither backups nor clones cross namespaces. Within the
+// namespace, the Habitat of the source, if it's still provisioned, has the
+// name of the new one, so only instances of Habitat packages can be cloned
+// into ones of other packages.
+func (b *BrokerLogic) verifyRestoreSource(identity *osb.OriginatingIdentity, source *restoreSource, namespace, name string) error {
+	id, sourceNamespace, live := source.backupID, namespace, source.instance
+	if source.instance != nil {
+		id, sourceNamespace = source.instanceID, source.instance.Namespace
+	} else {
+		state, err := b.getBackupInstanceState(source.backupID)
+		if err != nil {
+			return err
+		}
+		// Backups of deprovisioned instances are only looked up in the
+		// target of the namespace.
+		if state != nil {
+			sourceNamespace, live = state.Namespace, state
+		}
+	}
+
+	if err := b.authorizeNamespace(identity, sourceNamespace); err != nil {
+		return err
+	}
+
+	if sourceNamespace != namespace {
+		msg := fmt.Sprintf("restoreFrom %s is in namespace %s, it can only be restored into that namespace", id, sourceNamespace)
+		return newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+	}
+
+	if live != nil && !live.Reclaim {
+		if n, err := habitatName(live.PlanID, live.Parameters); err == nil && n == name {
+			msg := fmt.Sprintf("restoreFrom %s belongs to an instance which runs the Habitat %s in namespace %s, so it can only be restored once that instance is deprovisioned", id, name, namespace)
+			return newHTTPStatusCodeError(http.StatusConflict, msg)
+		}
+	}
+
+	return nil
+}
+
+// getBackupInstanceState returns the state of the instance a backup was
+// taken of, or nil if it's deprovisioned.
+func (b *BrokerLogic) getBackupInstanceState(backupID string) (*instanceState, error) {
+	states, err := b.listInstanceStates()
+	if err != nil {
+		return nil, err
+	}
+
+	for instanceID, state := range states {
+		if strings.HasPrefix(backupID, backupName(instanceID)+"-") {
+			return state, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// restoreJobName returns the name of the Job which seeds the volume of an
+// instance.
+func restoreJobName(instanceID string) string {
+	return backupName(instanceID) + "-restore"
+}
+
+// cloneBackupID returns the ID of the backup of an instance which is taken to
+// clone it into another one.
+func cloneBackupID(sourceID, instanceID string) string {
+	sum := sha256.Sum256([]byte(instanceID))
+	return backupName(sourceID) + "-clone" + hex.EncodeToString(sum[:])[:6]
+}
+
+// startRestore creates the volume of the first member of the Habitat of a new
+// instance, and starts to seed it. Clones first take a backup of their
+// source, restores of a backup start the restore right away.
+func (b *BrokerLogic) startRestore(hab *habv1beta1.Habitat, namespace, instanceID string, source *restoreSource, entry *AuditEntry) (*restoreState, error) {
+	storage := hab.Spec.V1beta2.PersistentStorage
+	if storage == nil {
+		msg := fmt.Sprintf("%s keeps no data on a persistent volume, which could be restored", hab.Name)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, msg)
+	}
+
+	size, err := resource.ParseQuantity(storage.Size)
+	if err != nil {
+		return nil, fmt.Errorf("storage size %q is invalid: %v", storage.Size, err)
+	}
+
+	claim := memberClaim(hab, 0, size)
+	claimName := claim.Name
+
+	_, err = b.Clients.KubeClient.CoreV1().PersistentVolumeClaims(namespace).Create(claim)
+	if k8sErrors.IsAlreadyExists(err) {
+		msg := fmt.Sprintf("volume %s already exists in namespace %s, so it can't be restored into", claimName, namespace)
+		return nil, newHTTPStatusCodeError(http.StatusConflict, msg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating PersistentVolumeClaim %s: %v", claimName, err)
+	}
+	entry.created("PersistentVolumeClaim", namespace, claimName)
+
+	if b.backup.Target == BackupTargetS3 {
+		if err := b.ensureS3Secret(namespace, instanceID, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	state := &restoreState{
+		BackupID: source.backupID,
+		Habitat:  hab,
+	}
+
+	if source.instance == nil {
+		return state, b.startRestoreJob(hab, namespace, instanceID, state, entry)
+	}
+
+	name, err := habitatName(source.instance.PlanID, source.instance.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceHab, err := b.GetHabitat(name, source.instance.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	retention := defaultBackupRetention
+	if backup, err := getBackup(source.instance.Parameters); err == nil && backup != nil {
+		retention = backup.retention
+	}
+
+	state.BackupID = cloneBackupID(source.instanceID, instanceID)
+	state.CloneNamespace = source.instance.Namespace
+	state.Clone = true
+
+	if b.backup.Target == BackupTargetS3 {
+		if err := b.ensureS3Secret(state.CloneNamespace, source.instanceID, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   state.BackupID,
+			Labels: instanceLabels(source.instanceID),
+		},
+		Spec: b.backupJobSpec(sourceHab, source.instanceID, backupModeSchedule, retention),
+	}
+
+	if _, err := b.Clients.KubeClient.BatchV1().Jobs(state.CloneNamespace).Create(job); err != nil {
+		return nil, fmt.Errorf("error creating Job %s: %v", job.Name, err)
+	}
+	entry.created("Job", state.CloneNamespace, job.Name)
+
+	return state, nil
+}
+
+// memberClaimName returns the name of the claim of a member of a Habitat.
+func memberClaimName(habName string, member int) string {
+	return fmt.Sprintf("%s-%s-%d", habitatVolumeName, habName, member)
+}
+
+// memberClaim returns the claim of a member of the Habitat, which is created
+// ahead of the Habitat to seed it. The StatefulSet adopts it, as it would
+// create a claim of that name. It's labelled like the Habitat, and with the
+// label the StatefulSet would give it.
+func memberClaim(hab *habv1beta1.Habitat, member int, size resource.Quantity) *v1.PersistentVolumeClaim {
+	labels := map[string]string{habv1beta1.HabitatNameLabel: hab.Name}
+	for k, v := range hab.Labels {
+		labels[k] = v
+	}
+
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   memberClaimName(hab.Name, member),
+			Labels: labels,
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			StorageClassName: &hab.Spec.V1beta2.PersistentStorage.StorageClassName,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: size},
+			},
+		},
+	}
+}
+
+// startRestoreJob starts the Job which extracts the backup into the volume of
+// the new instance.
+func (b *BrokerLogic) startRestoreJob(hab *habv1beta1.Habitat, namespace, instanceID string, state *restoreState, entry *AuditEntry) error {
+	spec := b.backupJobSpec(hab, instanceID, "", 0)
+	spec.Template.Labels = nil
+	// The volume has no pod to share a node with yet.
+	spec.Template.Spec.Affinity = nil
+
+	container := &spec.Template.Spec.Containers[0]
+	container.Name = "restore"
+	container.Command = []string{"/bin/sh", "-c", restoreScript}
+	container.VolumeMounts[0].ReadOnly = false
+	spec.Template.Spec.Volumes[0].PersistentVolumeClaim.ReadOnly = false
+
+	for i, env := range container.Env {
+		if env.Name == "BACKUP_ID" {
+			container.Env[i] = v1.EnvVar{Name: "BACKUP_ID", Value: state.BackupID}
+		}
+	}
+	container.Env = append(container.Env, v1.EnvVar{Name: "CLONE", Value: fmt.Sprintf("%t", state.Clone)})
+
+	name := restoreJobName(instanceID)
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: instanceLabels(instanceID),
+		},
+		Spec: spec,
+	}
+
+	if _, err := b.Clients.KubeClient.BatchV1().Jobs(namespace).Create(job); err != nil {
+		return fmt.Errorf("error creating Job %s: %v", name, err)
+	}
+	entry.created("Job", namespace, name)
+
+	return nil
+}
+
+// jobDone reports whether the Job finished and, if it failed, why. A Job
+// which is gone failed.
+func (b *BrokerLogic) jobDone(name, namespace string) (bool, string, error) {
+	job, err := b.Clients.KubeClient.BatchV1().Jobs(namespace).Get(name, metav1.GetOptions{})
+	if k8sErrors.IsNotFound(err) {
+		return true, fmt.Sprintf("Job %s was deleted", name), nil
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("error getting Job %s: %v", name, err)
+	}
+
+	if failed, reason := jobFailed(job); failed {
+		return true, reason, nil
+	}
+
+	return job.Status.Succeeded > 0, "", nil
+}
+
+func (b *BrokerLogic) deleteJob(name, namespace string, entry *AuditEntry) error {
+	propagation := metav1.DeletePropagationBackground
+
+	err := b.Clients.KubeClient.BatchV1().Jobs(namespace).Delete(name, &metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err == nil {
+		entry.deleted("Job", namespace, name)
+	} else if !k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting Job %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// restoreLastOperation reports the progress of the restore of a new
+// instance: the backup of the cloned instance, then the restore of the
+// backup. Once the volume is seeded, the Habitat is created.
+func (b *BrokerLogic) restoreLastOperation(request *osb.LastOperationRequest, state *instanceState) (_ *broker.LastOperationResponse, err error) {
+	response := &broker.LastOperationResponse{}
+	response.State = osb.StateInProgress
+	restore := state.Restore
+
+	jobName, jobNamespace := restoreJobName(request.InstanceID), state.Namespace
+	description := fmt.Sprintf("restoring backup %s", restore.BackupID)
+	if restore.CloneNamespace != "" {
+		jobName, jobNamespace = restore.BackupID, restore.CloneNamespace
+		description = fmt.Sprintf("taking backup %s of the cloned instance", restore.BackupID)
+	}
+
+	done, failure, err := b.jobDone(jobName, jobNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	timedOut := time.Since(state.Operation.Started) >= operationTimeout
+	if !done && !timedOut {
+		response.Description = &description
+		return response, nil
+	}
+
+	entry := newAuditEntry(operationProvision, request.InstanceID, state.ServiceID, state.PlanID, request.OriginatingIdentity, nil)
+	defer b.recordAudit(entry, &err)
+
+	if err := b.deleteJob(jobName, jobNamespace, entry); err != nil {
+		return nil, err
+	}
+
+	if !done || failure != "" {
+		if done {
+			description = fmt.Sprintf("%s failed: %s", description, failure)
+		} else {
+			description = fmt.Sprintf("%s timed out after %v", description, operationTimeout)
+		}
+		entry.Error = description
+		response.State = osb.StateFailed
+		response.Description = &description
+
+		state.Operation = nil
+		return response, b.setInstanceState(request.InstanceID, state)
+	}
+
+	if restore.CloneNamespace != "" {
+		// The backup is taken, so it's restored now.
+		restore.CloneNamespace = ""
+		if err := b.startRestoreJob(restore.Habitat, state.Namespace, request.InstanceID, restore, entry); err != nil {
+			return nil, err
+		}
+
+		description = fmt.Sprintf("restoring backup %s", restore.BackupID)
+		response.Description = &description
+		return response, b.setInstanceState(request.InstanceID, state)
+	}
+
+	if err := b.CreateHabitat(restore.Habitat, state.Namespace); err != nil {
+		return nil, err
+	}
+	entry.created(habv1beta1.HabitatKind, state.Namespace, restore.Habitat.Name)
+
+	state.Restore = nil
+	state.Operation = nil
+	b.adoptResources(request.InstanceID, state)
+	response.State = osb.StateSucceeded
+	return response, b.setInstanceState(request.InstanceID, state)
+}
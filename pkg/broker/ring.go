@@ -0,0 +1,290 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// RingShared makes an instance gossip in the ring shared by all
+	// instances of its namespace.
+	RingShared = "shared"
+	// RingInstance makes an instance gossip in a ring of its own.
+	RingInstance = "instance"
+
+	sharedRingName = "habitat-osb-ring"
+
+	// ringLabel holds the name of the ring a ring key belongs to.
+	ringLabel = "habitat-service-broker/ring"
+	// ringSecretKey is the key the habitat-operator reads the ring key from.
+	ringSecretKey = "ring-key"
+	// ringKeyRevisionFormat is the format of ring key revisions, which the
+	// habitat-operator expects at the end of the secret name.
+	ringKeyRevisionFormat = "20060102150405"
+	ringKeyLength         = 32
+	// ringKeyRevisionsKept is the number of revisions of a ring key which
+	// are kept, so that pods can still be restarted while a new revision is
+	// rolled out.
+	ringKeyRevisionsKept = 2
+)
+
+var ringSet = map[string]struct{}{
+	RingShared:   {},
+	RingInstance: {},
+}
+
+func getRing(params map[string]interface{}) (string, error) {
+	r, ok := params["ring"]
+	if !ok {
+		return RingShared, nil
+	}
+
+	s, ok := r.(string)
+	if !ok {
+		return "", newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("ring %v is invalid", r))
+	}
+
+	if _, ok := ringSet[s]; !ok {
+		msg := fmt.Sprintf("ring %q is invalid, it must be %q or %q", s, RingShared, RingInstance)
+		return "", newHTTPStatusCodeError(http.StatusBadRequest, msg)
+	}
+
+	return s, nil
+}
+
+func getRotateRingKey(params map[string]interface{}) (bool, error) {
+	r, ok := params["rotateRingKey"]
+	if !ok {
+		return false, nil
+	}
+
+	rotate, ok := r.(bool)
+	if !ok {
+		return false, newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("rotateRingKey %v is invalid", r))
+	}
+
+	return rotate, nil
+}
+
+// ringName returns the name of the ring an instance gossips in. The
+// habitat-operator lets all Supervisors of a namespace peer with each other,
+// so only instances which share a ring can bind to each other.
+func ringName(ring, instanceID string) string {
+	if ring == RingInstance {
+		return derivedSecretName(sharedRingName, instanceID)
+	}
+
+	return sharedRingName
+}
+
+// newRingKey returns a ring key in the SYM-SEC-1 format of Habitat, of the
+// given revision.
+func newRingKey(name, revision string) (string, error) {
+	key := make([]byte, ringKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("error generating ring key: %v", err)
+	}
+
+	return fmt.Sprintf("SYM-SEC-1\n%s-%s\n\n%s", name, revision, base64.StdEncoding.EncodeToString(key)), nil
+}
+
+// nextRingKeyRevision returns the revision of a new key of a ring. Revisions
+// only have a resolution of one second, so a key created within the same
+// second as the latest one, or after it was created in the future that way,
+// gets the second after the latest one.
+func nextRingKeyRevision(name string, keys []string) string {
+	revision := time.Now().UTC()
+
+	if len(keys) > 0 {
+		latest, err := time.Parse(ringKeyRevisionFormat, strings.TrimPrefix(keys[0], name+"-"))
+		if err == nil && !latest.Before(revision.Truncate(time.Second)) {
+			revision = latest.Add(time.Second)
+		}
+	}
+
+	return revision.Format(ringKeyRevisionFormat)
+}
+
+// listRingKeys returns the names of the secrets holding the revisions of a
+// ring key, the latest revision first.
+func (b *BrokerLogic) listRingKeys(name, namespace string) ([]string, error) {
+	selector := labels.SelectorFromSet(labels.Set{ringLabel: name})
+	secrets, err := b.Clients.KubeClient.CoreV1().Secrets(namespace).List(metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing keys of ring %s: %v", name, err)
+	}
+
+	var names []string
+	for _, s := range secrets.Items {
+		names = append(names, s.Name)
+	}
+
+	// Revisions are timestamps of a fixed length.
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+// createRingKey creates a new revision of the key of a ring and returns
+// the name of its secret.
+func (b *BrokerLogic) createRingKey(name, namespace string, entry *AuditEntry) (string, error) {
+	keys, err := b.listRingKeys(name, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	revision := nextRingKeyRevision(name, keys)
+	data, err := newRingKey(name, revision)
+	if err != nil {
+		return "", err
+	}
+
+	s := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: fmt.Sprintf("%s-%s", name, revision),
+			Labels: map[string]string{
+				habv1beta1.HabitatLabel: "true",
+				managedByLabel:          managedByValue,
+				ringLabel:               name,
+			},
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: map[string][]byte{ringSecretKey: []byte(data)},
+	}
+
+	secret, err := b.Clients.KubeClient.CoreV1().Secrets(namespace).Create(s)
+	if err != nil {
+		return "", fmt.Errorf("error creating key of ring %s: %v", name, err)
+	}
+	entry.created("Secret", namespace, secret.Name)
+
+	return secret.Name, nil
+}
+
+// ensureRingKey returns the secret with the latest key of a ring, which is
+// created if there's none yet.
+func (b *BrokerLogic) ensureRingKey(name, namespace string, entry *AuditEntry) (string, error) {
+	keys, err := b.listRingKeys(name, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	if len(keys) > 0 {
+		return keys[0], nil
+	}
+
+	return b.createRingKey(name, namespace, entry)
+}
+
+// rotateRingKey creates a new revision of the key of a ring and rolls it out
+// to all instances which gossip in it. Revisions older than the previous
+// one are deleted.
+func (b *BrokerLogic) rotateRingKey(name, namespace string, entry *AuditEntry) (string, error) {
+	secretName, err := b.createRingKey(name, namespace, entry)
+	if err != nil {
+		return "", err
+	}
+
+	states, err := b.listInstanceStates()
+	if err != nil {
+		return "", err
+	}
+
+	for _, s := range states {
+		if s.Namespace != namespace || s.Ring != name {
+			continue
+		}
+
+		service, err := habitatName(s.PlanID, s.Parameters)
+		if err != nil {
+			return "", err
+		}
+
+		hab, err := b.GetHabitat(service, namespace)
+		if err != nil {
+			return "", err
+		}
+
+		hab.Kind = habv1beta1.HabitatKind
+		hab.APIVersion = habv1beta1.SchemeGroupVersion.String()
+		hab.Spec.V1beta2.Service.RingSecretName = &secretName
+
+		if err := b.UpdateHabitat(hab, namespace); err != nil {
+			return "", err
+		}
+		entry.updated(habv1beta1.HabitatKind, namespace, hab.Name)
+	}
+
+	keys, err := b.listRingKeys(name, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	for i := ringKeyRevisionsKept; i < len(keys); i++ {
+		if err := b.deleteSecret(keys[i], namespace); err != nil && !k8sErrors.IsNotFound(err) {
+			return "", fmt.Errorf("error deleting secret %s: %v", keys[i], err)
+		}
+		entry.deleted("Secret", namespace, keys[i])
+	}
+
+	return secretName, nil
+}
+
+// deleteRingKeys deletes all revisions of the key of a ring, unless another
+// instance than the given one still gossips in it.
+func (b *BrokerLogic) deleteRingKeys(name, namespace, instanceID string, entry *AuditEntry) error {
+	if name == "" {
+		return nil
+	}
+
+	states, err := b.listInstanceStates()
+	if err != nil {
+		return err
+	}
+
+	for id, s := range states {
+		if id != instanceID && s.Namespace == namespace && s.Ring == name {
+			return nil
+		}
+	}
+
+	keys, err := b.listRingKeys(name, namespace)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := b.deleteSecret(key, namespace); err != nil && !k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("error deleting secret %s: %v", key, err)
+		}
+		entry.deleted("Secret", namespace, key)
+	}
+
+	return nil
+}
@@ -0,0 +1,501 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/golang/glog"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// rotationCheckInterval is how often scheduled rotations are started,
+	// and rotations in progress are checked.
+	rotationCheckInterval = time.Minute
+
+	rotationSecretKey = "password"
+)
+
+// rotationState tracks a credential rotation during its grace period. For
+// bindings, the new password is kept in a secret of its own until then, while
+// the secret of the binding keeps the current one. For instances, the secret
+// keeps the old password instead.
+type rotationState struct {
+	SecretName string    `json:"secretName"`
+	GraceEnds  time.Time `json:"graceEnds"`
+}
+
+// RotateCredentialsResponse is sent as the response to starting a
+// credential rotation. The binding ID is empty for the password of the
+// instance itself.
+type RotateCredentialsResponse struct {
+	BindingID string    `json:"binding_id,omitempty"`
+	GraceEnds time.Time `json:"grace_period_ends"`
+}
+
+// verifyRotatable checks that the credentials of instances of the plan can be
+// rotated, which is only implemented for redis.
+func verifyRotatable(planID string) error {
+	if name, _, err := matchService(planID); err == nil && name == "redis" {
+		return nil
+	}
+
+	return newHTTPStatusCodeError(http.StatusUnprocessableEntity, "credential rotation is only implemented for redis instances")
+}
+
+// RotateInstanceCredentials rotates the password of the default user of a
+// redis instance, and the credentials of every binding of the instance which
+// has a redis user of its own.
+func (b *BrokerLogic) RotateInstanceCredentials(instanceID string) ([]*RotateCredentialsResponse, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	instance, err := b.getInstanceState(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if instance == nil {
+		msg := fmt.Sprintf("could not find state of instance %s in configmap %s", instanceID, b.ConfigMap.Name)
+		return nil, newHTTPStatusCodeError(http.StatusNotFound, msg)
+	}
+
+	if err := verifyRotatable(instance.PlanID); err != nil {
+		return nil, err
+	}
+
+	states, err := b.listBindingStates()
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := b.rotateInstanceCredentials(instanceID, instance)
+	if err != nil {
+		return nil, err
+	}
+	responses := []*RotateCredentialsResponse{response}
+
+	for bindingID, state := range states {
+		if state.InstanceID != instanceID || !hasRedisUser(bindingID, state) {
+			continue
+		}
+
+		response, err := b.rotateCredentials(bindingID, state)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, response)
+	}
+
+	return responses, nil
+}
+
+// RotateBindingCredentials rotates the credentials of a binding.
+func (b *BrokerLogic) RotateBindingCredentials(instanceID, bindingID string) (*RotateCredentialsResponse, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	state, err := b.getBindingState(bindingID)
+	if err != nil {
+		return nil, err
+	}
+
+	if state == nil || state.InstanceID != instanceID {
+		msg := fmt.Sprintf("could not find state of binding %s of instance %s in configmap %s", bindingID, instanceID, b.ConfigMap.Name)
+		return nil, newHTTPStatusCodeError(http.StatusNotFound, msg)
+	}
+
+	return b.rotateCredentials(bindingID, state)
+}
+
+// rotateCredentials issues a new password and adds it to the redis user of
+// the binding next to the current one. Both stay valid until the grace
+// period ends, see finishRotation.
+func (b *BrokerLogic) rotateCredentials(bindingID string, state *bindingState) (_ *RotateCredentialsResponse, err error) {
+	entry := newAuditEntry(operationRotateCredentials, state.InstanceID, "", state.PlanID, nil, nil)
+	entry.BindingID = bindingID
+	defer b.recordAudit(entry, &err)
+
+	if state.Operation != nil {
+		msg := fmt.Sprintf("binding %s is busy with operation %q", bindingID, state.Operation.Type)
+		return nil, newHTTPStatusCodeError(http.StatusConflict, msg)
+	}
+
+	if state.Rotation != nil {
+		msg := fmt.Sprintf("credentials of binding %s are already being rotated until %v", bindingID, state.Rotation.GraceEnds)
+		return nil, newHTTPStatusCodeError(http.StatusConflict, msg)
+	}
+
+	if err := verifyRotatable(state.PlanID); err != nil {
+		return nil, err
+	}
+	name := "redis"
+
+	if !hasRedisUser(bindingID, state) {
+		msg := fmt.Sprintf("binding %s shares the password of instance %s, it must be bound again to get credentials which can be rotated", bindingID, state.InstanceID)
+		return nil, newHTTPStatusCodeError(http.StatusConflict, msg)
+	}
+
+	hab, err := b.GetHabitat(name, state.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	admin, err := b.redisAdminPassword(hab, state.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := b.getBindingPassword(state.SecretName, state.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := b.generatePassword(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string][]byte{rotationSecretKey: []byte(password)}
+	secret, err := b.createSecret(derivedSecretName("habitat-osb-redis-rotation", bindingID), state.Namespace, bindingLabels(state.InstanceID, bindingID), data)
+	if err != nil {
+		return nil, err
+	}
+	entry.created("Secret", state.Namespace, secret.Name)
+
+	if err := b.setRedisUser(name, state.Namespace, admin, bindingIdentifier(bindingID), current, password); err != nil {
+		if err := b.deleteSecret(secret.Name, state.Namespace); err != nil {
+			glog.Warningf("error deleting secret %s: %v", secret.Name, err)
+		} else {
+			entry.deleted("Secret", state.Namespace, secret.Name)
+		}
+		return nil, err
+	}
+
+	if err := b.storeCredential(state.InstanceID, bindingID, password); err != nil {
+		return nil, err
+	}
+
+	state.Rotation = &rotationState{
+		SecretName: secret.Name,
+		GraceEnds:  time.Now().UTC().Add(b.rotationGracePeriod),
+	}
+
+	if err := b.setBindingState(bindingID, state); err != nil {
+		return nil, err
+	}
+
+	return &RotateCredentialsResponse{
+		BindingID: bindingID,
+		GraceEnds: state.Rotation.GraceEnds,
+	}, nil
+}
+
+// finishRotation makes the new password the only one: the old one is
+// revoked from the redis user of the binding, and the new one replaces it in
+// the secret of the binding.
+func (b *BrokerLogic) finishRotation(bindingID string, state *bindingState) (err error) {
+	entry := newAuditEntry(operationRevokeCredentials, state.InstanceID, "", state.PlanID, nil, nil)
+	entry.BindingID = bindingID
+	defer b.recordAudit(entry, &err)
+
+	name, _, err := matchService(state.PlanID)
+	if err != nil {
+		return err
+	}
+
+	hab, err := b.GetHabitat(name, state.Namespace)
+	if err != nil {
+		return err
+	}
+
+	admin, err := b.redisAdminPassword(hab, state.Namespace)
+	if err != nil {
+		return err
+	}
+
+	password, err := b.getRotationPassword(state)
+	if err != nil {
+		return err
+	}
+
+	if err := b.setRedisUser(name, state.Namespace, admin, bindingIdentifier(bindingID), password); err != nil {
+		return err
+	}
+
+	data := map[string][]byte{"password": []byte(password)}
+	if _, err := b.createSecret(state.SecretName, state.Namespace, bindingLabels(state.InstanceID, bindingID), data); err != nil {
+		return err
+	}
+	entry.updated("Secret", state.Namespace, state.SecretName)
+
+	if err := b.deleteSecret(state.Rotation.SecretName, state.Namespace); err != nil && !k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting secret %s: %v", state.Rotation.SecretName, err)
+	}
+	entry.deleted("Secret", state.Namespace, state.Rotation.SecretName)
+
+	state.Rotation = nil
+	state.CredentialsIssued = time.Now().UTC()
+
+	return b.setBindingState(bindingID, state)
+}
+
+// rotateInstanceCredentials issues a new password for the default user of a
+// redis instance, which the broker and the replicas authenticate with. The
+// running servers accept both the old and the new one until the grace period
+// ends, while the config makes the new one stick across restarts. The old
+// password is kept in a secret until then, see finishInstanceRotation.
+func (b *BrokerLogic) rotateInstanceCredentials(instanceID string, state *instanceState) (_ *RotateCredentialsResponse, err error) {
+	entry := newAuditEntry(operationRotateCredentials, instanceID, state.ServiceID, state.PlanID, nil, nil)
+	defer b.recordAudit(entry, &err)
+
+	if state.Operation != nil || state.Restore != nil || state.Reclaim {
+		msg := fmt.Sprintf("instance %s is busy with another operation", instanceID)
+		return nil, newHTTPStatusCodeError(http.StatusConflict, msg)
+	}
+
+	if state.Rotation != nil {
+		msg := fmt.Sprintf("credentials of instance %s are already being rotated until %v", instanceID, state.Rotation.GraceEnds)
+		return nil, newHTTPStatusCodeError(http.StatusConflict, msg)
+	}
+
+	shared, err := b.sharesAdminPassword(instanceID, "")
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		msg := fmt.Sprintf("bindings of instance %s share its password, they must be bound again before it can be rotated", instanceID)
+		return nil, newHTTPStatusCodeError(http.StatusConflict, msg)
+	}
+
+	name := "redis"
+	hab, err := b.GetHabitat(name, state.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	old, err := b.redisAdminPassword(hab, state.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if old == "" {
+		msg := fmt.Sprintf("instance %s runs without a password until its first binding", instanceID)
+		return nil, newHTTPStatusCodeError(http.StatusConflict, msg)
+	}
+
+	password, err := b.generatePassword(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string][]byte{rotationSecretKey: []byte(old)}
+	secret, err := b.createSecret(derivedSecretName("habitat-osb-redis-rotation", instanceID), state.Namespace, instanceLabels(instanceID), data)
+	if err != nil {
+		return nil, err
+	}
+	entry.created("Secret", state.Namespace, secret.Name)
+
+	err = b.forEachRedisServer(name, state.Namespace, old, func(c *redis.Client) error {
+		return aclSetUser(c, "default", ">"+password)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := b.applyBindingConfig(hab, state.Namespace, instanceID, state.PlanID, redisCredentialsLayer(hab, password), false, entry); err != nil {
+		return nil, err
+	}
+
+	state.Rotation = &rotationState{
+		SecretName: secret.Name,
+		GraceEnds:  time.Now().UTC().Add(b.rotationGracePeriod),
+	}
+
+	if err := b.setInstanceState(instanceID, state); err != nil {
+		return nil, err
+	}
+
+	return &RotateCredentialsResponse{GraceEnds: state.Rotation.GraceEnds}, nil
+}
+
+// finishInstanceRotation revokes the old password of the default user of a
+// redis instance from the running servers.
+func (b *BrokerLogic) finishInstanceRotation(instanceID string, state *instanceState) (err error) {
+	entry := newAuditEntry(operationRevokeCredentials, instanceID, state.ServiceID, state.PlanID, nil, nil)
+	defer b.recordAudit(entry, &err)
+
+	name := "redis"
+	hab, err := b.GetHabitat(name, state.Namespace)
+	if err != nil {
+		return err
+	}
+
+	admin, err := b.redisAdminPassword(hab, state.Namespace)
+	if err != nil {
+		return err
+	}
+
+	// Servers which were restarted during the grace period only know the
+	// new password already.
+	err = b.forEachRedisServer(name, state.Namespace, admin, func(c *redis.Client) error {
+		return aclSetUser(c, "default", "resetpass", ">"+admin)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := b.deleteSecret(state.Rotation.SecretName, state.Namespace); err != nil && !k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting secret %s: %v", state.Rotation.SecretName, err)
+	}
+	entry.deleted("Secret", state.Namespace, state.Rotation.SecretName)
+
+	state.Rotation = nil
+	state.CredentialsIssued = time.Now().UTC()
+
+	return b.setInstanceState(instanceID, state)
+}
+
+// abortRotation deletes the new password of a rotation in progress, for
+// bindings which are deleted during the grace period.
+func (b *BrokerLogic) abortRotation(state *bindingState, entry *AuditEntry) error {
+	if state == nil || state.Rotation == nil {
+		return nil
+	}
+
+	if err := b.deleteSecret(state.Rotation.SecretName, state.Namespace); err != nil && !k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting secret %s: %v", state.Rotation.SecretName, err)
+	}
+	entry.deleted("Secret", state.Namespace, state.Rotation.SecretName)
+
+	state.Rotation = nil
+	return nil
+}
+
+func (b *BrokerLogic) getRotationPassword(state *bindingState) (string, error) {
+	secret, err := b.Clients.KubeClient.CoreV1().Secrets(state.Namespace).Get(state.Rotation.SecretName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	password, ok := secret.Data[rotationSecretKey]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no redis password", state.Rotation.SecretName)
+	}
+
+	return string(password), nil
+}
+
+// RunCredentialRotation periodically finishes rotations whose grace period
+// ended, and starts the scheduled ones, until the context is done. The redis
+// users of bindings are restored on servers which were restarted.
+func (b *BrokerLogic) RunCredentialRotation(ctx context.Context) {
+	ticker := time.NewTicker(rotationCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.Lock()
+			b.reconcileInstanceRotations()
+			b.reconcileRotations()
+			b.Unlock()
+
+			b.reconcileRedisUsers()
+		}
+	}
+}
+
+func (b *BrokerLogic) reconcileInstanceRotations() {
+	states, err := b.listInstanceStates()
+	if err != nil {
+		glog.Errorf("error listing instances: %v", err)
+		return
+	}
+
+	for instanceID, state := range states {
+		if state.Operation != nil || state.Restore != nil || state.Reclaim {
+			continue
+		}
+		if verifyRotatable(state.PlanID) != nil {
+			continue
+		}
+
+		switch {
+		case state.Rotation != nil && time.Now().After(state.Rotation.GraceEnds):
+			if err := b.finishInstanceRotation(instanceID, state); err != nil {
+				glog.Errorf("error finishing credential rotation of instance %s: %v", instanceID, err)
+			}
+		case state.Rotation != nil:
+		case b.rotationInterval > 0 && state.CredentialsIssued.IsZero():
+			// Instances are scheduled from the first check on.
+			state.CredentialsIssued = time.Now().UTC()
+			if err := b.setInstanceState(instanceID, state); err != nil {
+				glog.Errorf("error scheduling credential rotation of instance %s: %v", instanceID, err)
+			}
+		case b.rotationInterval > 0 && time.Since(state.CredentialsIssued) > b.rotationInterval:
+			if _, err := b.rotateInstanceCredentials(instanceID, state); err != nil {
+				glog.Errorf("error rotating credentials of instance %s: %v", instanceID, err)
+			}
+		}
+	}
+}
+
+func (b *BrokerLogic) reconcileRotations() {
+	states, err := b.listBindingStates()
+	if err != nil {
+		glog.Errorf("error listing bindings: %v", err)
+		return
+	}
+
+	for bindingID, state := range states {
+		if state.Operation != nil {
+			continue
+		}
+
+		// Only the users of redis bindings can be rotated, the users of
+		// other bindings are replaced by binding again.
+		if !hasRedisUser(bindingID, state) {
+			continue
+		}
+
+		switch {
+		case state.Rotation != nil && time.Now().After(state.Rotation.GraceEnds):
+			if err := b.finishRotation(bindingID, state); err != nil {
+				glog.Errorf("error finishing credential rotation of binding %s: %v", bindingID, err)
+			}
+		case state.Rotation != nil:
+			// Pods which were restarted during the grace period get both
+			// passwords from reconcileRedisUsers.
+		case b.rotationInterval > 0 && state.CredentialsIssued.IsZero():
+			// Bindings created by older versions of the broker are
+			// scheduled from now on.
+			state.CredentialsIssued = time.Now().UTC()
+			if err := b.setBindingState(bindingID, state); err != nil {
+				glog.Errorf("error scheduling credential rotation of binding %s: %v", bindingID, err)
+			}
+		case b.rotationInterval > 0 && time.Since(state.CredentialsIssued) > b.rotationInterval:
+			if _, err := b.rotateCredentials(bindingID, state); err != nil {
+				glog.Errorf("error rotating credentials of binding %s: %v", bindingID, err)
+			}
+		}
+	}
+}
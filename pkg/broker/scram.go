@@ -0,0 +1,146 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// scramClient implements the client side of SCRAM-SHA-256. PostgreSQL
+// ignores the user name of the exchange, MongoDB needs it. Passwords are not
+// normalized with SASLprep, which makes no difference for ASCII passwords.
+type scramClient struct {
+	user        string
+	password    string
+	nonce       string
+	authMessage string
+	saltedPass  []byte
+}
+
+func newSCRAMClient(user, password string) (*scramClient, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return &scramClient{
+		user:     user,
+		password: password,
+		nonce:    base64.StdEncoding.EncodeToString(nonce),
+	}, nil
+}
+
+func (s *scramClient) clientFirstBare() string {
+	// Names are escaped as required by RFC 5802.
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s.user)
+	return "n=" + user + ",r=" + s.nonce
+}
+
+func (s *scramClient) clientFirst() string {
+	return "n,," + s.clientFirstBare()
+}
+
+func (s *scramClient) clientFinal(serverFirst string) (string, error) {
+	attrs := scramAttributes(serverFirst)
+
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, s.nonce) || len(nonce) == len(s.nonce) {
+		return "", errors.New("SCRAM server nonce is invalid")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return "", fmt.Errorf("SCRAM salt is invalid: %v", err)
+	}
+
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < 1 {
+		return "", fmt.Errorf("SCRAM iteration count %q is invalid", attrs["i"])
+	}
+
+	s.saltedPass = pbkdf2SHA256([]byte(s.password), salt, iterations)
+	clientKey := hmacSHA256(s.saltedPass, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+
+	withoutProof := "c=biws,r=" + nonce
+	s.authMessage = s.clientFirstBare() + "," + serverFirst + "," + withoutProof
+
+	signature := hmacSHA256(storedKey[:], []byte(s.authMessage))
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+func (s *scramClient) verifyServerFinal(serverFinal string) error {
+	attrs := scramAttributes(serverFinal)
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("SCRAM authentication failed: %s", e)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil {
+		return fmt.Errorf("SCRAM server signature is invalid: %v", err)
+	}
+
+	serverKey := hmacSHA256(s.saltedPass, []byte("Server Key"))
+	if !hmac.Equal(signature, hmacSHA256(serverKey, []byte(s.authMessage))) {
+		return errors.New("SCRAM server signature does not match")
+	}
+
+	return nil
+}
+
+func scramAttributes(msg string) map[string]string {
+	attrs := map[string]string{}
+	for _, a := range strings.Split(msg, ",") {
+		if len(a) >= 2 && a[1] == '=' {
+			attrs[a[:1]] = a[2:]
+		}
+	}
+
+	return attrs
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2SHA256 derives a key of the length of a SHA-256 hash, which only
+// takes a single block of PBKDF2.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	u := hmacSHA256(password, append(append([]byte{}, salt...), 0, 0, 0, 1))
+	result := append([]byte{}, u...)
+
+	for i := 1; i < iterations; i++ {
+		u = hmacSHA256(password, u)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// The exchange of section 3 of RFC 7677.
+const (
+	rfc7677User        = "user"
+	rfc7677Password    = "pencil"
+	rfc7677Nonce       = "rOprNGfwEbeRWgbNEkqO"
+	rfc7677ServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	rfc7677ClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfc7677ServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+func newRFC7677Client() *scramClient {
+	return &scramClient{
+		user:     rfc7677User,
+		password: rfc7677Password,
+		nonce:    rfc7677Nonce,
+	}
+}
+
+func TestSCRAMClientFirst(t *testing.T) {
+	tests := []struct {
+		user string
+		want string
+	}{
+		{user: rfc7677User, want: "n,,n=user,r=" + rfc7677Nonce},
+		{user: "", want: "n,,n=,r=" + rfc7677Nonce},
+		{user: "a=b,c", want: "n,,n=a=3Db=2Cc,r=" + rfc7677Nonce},
+	}
+
+	for _, tt := range tests {
+		s := &scramClient{user: tt.user, nonce: rfc7677Nonce}
+		if got := s.clientFirst(); got != tt.want {
+			t.Errorf("clientFirst() of user %q = %q, want %q", tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestSCRAMClientFinal(t *testing.T) {
+	tests := []struct {
+		name        string
+		serverFirst string
+		want        string
+		wantErr     bool
+	}{
+		{
+			name:        "RFC 7677",
+			serverFirst: rfc7677ServerFirst,
+			want:        rfc7677ClientFinal,
+		},
+		{
+			name:        "foreign nonce",
+			serverFirst: "r=AAAAAAAAAAAAAAAAAAAA%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			wantErr:     true,
+		},
+		{
+			name:        "nonce without server part",
+			serverFirst: "r=" + rfc7677Nonce + ",s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			wantErr:     true,
+		},
+		{
+			name:        "invalid salt",
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=!!!,i=4096",
+			wantErr:     true,
+		},
+		{
+			name:        "missing iteration count",
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==",
+			wantErr:     true,
+		},
+		{
+			name:        "zero iteration count",
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=0",
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := newRFC7677Client().clientFinal(tt.serverFirst)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: clientFinal() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: clientFinal() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSCRAMVerifyServerFinal(t *testing.T) {
+	tests := []struct {
+		name        string
+		serverFinal string
+		wantErr     bool
+	}{
+		{name: "RFC 7677", serverFinal: rfc7677ServerFinal},
+		{name: "wrong signature", serverFinal: "v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", wantErr: true},
+		{name: "invalid signature", serverFinal: "v=!!!", wantErr: true},
+		{name: "server error", serverFinal: "e=invalid-proof", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		s := newRFC7677Client()
+		if _, err := s.clientFinal(rfc7677ServerFirst); err != nil {
+			t.Fatalf("clientFinal() error = %v", err)
+		}
+
+		err := s.verifyServerFinal(tt.serverFinal)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: verifyServerFinal() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPBKDF2SHA256(t *testing.T) {
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		want       string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+
+	for _, tt := range tests {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations))
+		if got != tt.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %s, want %s", tt.password, tt.salt, tt.iterations, got, tt.want)
+		}
+	}
+}
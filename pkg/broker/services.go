@@ -22,11 +22,12 @@ func boolPtr(b bool) *bool {
 
 func nginxService() osb.Service {
 	return osb.Service{
-		Name:          "nginx-habitat",
-		ID:            "1ac7de1d-d89a-41c7-b9a8-744f9256e375",
-		Description:   "Nginx packaged with Habitat",
-		Bindable:      false,
-		PlanUpdatable: boolPtr(false),
+		Name:                "nginx-habitat",
+		ID:                  "1ac7de1d-d89a-41c7-b9a8-744f9256e375",
+		Description:         "Nginx packaged with Habitat",
+		Bindable:            true,
+		BindingsRetrievable: true,
+		PlanUpdatable:       boolPtr(false),
 		Metadata: map[string]interface{}{
 			"displayName": "Habitat Nginx service",
 			"imageUrl":    "https://avatars2.githubusercontent.com/u/19862012?s=200&v=4",
@@ -84,6 +85,47 @@ func nginxService() osb.Service {
 							},
 						},
 					},
+					ServiceBinding: &osb.ServiceBindingSchema{
+						Create: nginxBindingSchema(),
+					},
+				},
+			},
+		},
+	}
+}
+
+// nginxBindingSchema is the bind schema of the nginx plan, which lets a
+// binding register its app as an upstream.
+func nginxBindingSchema() *osb.RequestResponseSchema {
+	return &osb.RequestResponseSchema{
+		InputParametersSchema: osb.InputParametersSchema{
+			Parameters: map[string]interface{}{
+				"$schema": "http://json-schema.org/draft-04/schema",
+				"type":    "object",
+				"title":   "Parameters",
+				"properties": map[string]interface{}{
+					"upstream": map[string]interface{}{
+						"title":    "Upstream",
+						"type":     "object",
+						"required": []string{"service"},
+						"properties": map[string]interface{}{
+							"service": map[string]interface{}{
+								"title":       "Service",
+								"type":        "string",
+								"description": "The Service of the app in the namespace of the instance",
+							},
+							"port": map[string]interface{}{
+								"title":       "Port",
+								"type":        "integer",
+								"description": "The port of the Service, the first one if not given",
+							},
+							"path": map[string]interface{}{
+								"title":   "Path",
+								"type":    "string",
+								"default": "/",
+							},
+						},
+					},
 				},
 			},
 		},
@@ -92,11 +134,12 @@ func nginxService() osb.Service {
 
 func redisService() osb.Service {
 	return osb.Service{
-		Name:          "redis-habitat",
-		ID:            "50e86479-4c66-4236-88fb-a1e61b4c9448",
-		Description:   "Redis packaged with Habitat",
-		Bindable:      true,
-		PlanUpdatable: boolPtr(false),
+		Name:                "redis-habitat",
+		ID:                  "50e86479-4c66-4236-88fb-a1e61b4c9448",
+		Description:         "Redis packaged with Habitat",
+		Bindable:            true,
+		BindingsRetrievable: true,
+		PlanUpdatable:       boolPtr(false),
 		Metadata: map[string]interface{}{
 			"displayName": "Habitat Redis service",
 			"imageUrl":    "https://avatars2.githubusercontent.com/u/19862012?s=200&v=4",
@@ -159,3 +202,251 @@ func redisService() osb.Service {
 		},
 	}
 }
+
+// fixedTopologyProvisionSchema is the provision schema of the plans whose
+// topology is fixed by the plan.
+func fixedTopologyProvisionSchema() *osb.InputParametersSchema {
+	return &osb.InputParametersSchema{
+		Parameters: map[string]interface{}{
+			"$schema": "http://json-schema.org/draft-04/schema",
+			"type":    "object",
+			"title":   "Parameters",
+			"properties": map[string]interface{}{
+				"group": map[string]interface{}{
+					"title":   "Group",
+					"type":    "string",
+					"default": "default",
+				},
+				"count": map[string]interface{}{
+					"title":   "Count",
+					"type":    "int",
+					"default": "1",
+				},
+			},
+		},
+	}
+}
+
+// postgresqlBindingSchema is the bind schema of the PostgreSQL plans.
+func postgresqlBindingSchema() *osb.RequestResponseSchema {
+	return &osb.RequestResponseSchema{
+		InputParametersSchema: osb.InputParametersSchema{
+			Parameters: map[string]interface{}{
+				"$schema": "http://json-schema.org/draft-04/schema",
+				"type":    "object",
+				"title":   "Parameters",
+				"properties": map[string]interface{}{
+					"database": map[string]interface{}{
+						"title":       "Database",
+						"type":        "string",
+						"description": "The database of another binding of the instance to access, instead of a new one",
+					},
+					"readOnly": map[string]interface{}{
+						"title":   "Read-only",
+						"type":    "boolean",
+						"default": false,
+					},
+				},
+			},
+		},
+	}
+}
+
+func postgresqlService() osb.Service {
+	return osb.Service{
+		Name:                "postgresql-habitat",
+		ID:                  "7f5784be-06d8-4750-9dde-1921f006cb67",
+		Description:         "PostgreSQL packaged with Habitat",
+		Bindable:            true,
+		BindingsRetrievable: true,
+		PlanUpdatable:       boolPtr(false),
+		Metadata: map[string]interface{}{
+			"displayName": "Habitat PostgreSQL service",
+			"imageUrl":    "https://avatars2.githubusercontent.com/u/19862012?s=200&v=4",
+		},
+		Plans: []osb.Plan{
+			{
+				Name:        "standalone",
+				ID:          "9d702792-2f55-4b45-83b7-f3ba0c689cd3",
+				Description: "A single PostgreSQL server",
+				Free:        boolPtr(true),
+				Schemas: &osb.Schemas{
+					ServiceInstance: &osb.ServiceInstanceSchema{
+						Create: fixedTopologyProvisionSchema(),
+					},
+					ServiceBinding: &osb.ServiceBindingSchema{
+						Create: postgresqlBindingSchema(),
+					},
+				},
+			},
+			{
+				Name:        "leader",
+				ID:          "6d537324-c8b6-489d-b6b9-f4495a87abbd",
+				Description: "A PostgreSQL leader with streaming replicas, which needs a count of at least 3",
+				Free:        boolPtr(true),
+				Schemas: &osb.Schemas{
+					ServiceInstance: &osb.ServiceInstanceSchema{
+						Create: fixedTopologyProvisionSchema(),
+					},
+					ServiceBinding: &osb.ServiceBindingSchema{
+						Create: postgresqlBindingSchema(),
+					},
+				},
+			},
+		},
+	}
+}
+
+func rabbitmqService() osb.Service {
+	return osb.Service{
+		Name:                "rabbitmq-habitat",
+		ID:                  "e3a7f6b2-5c18-4d0e-b9a4-8f1c2d7e5b36",
+		Description:         "RabbitMQ packaged with Habitat",
+		Bindable:            true,
+		BindingsRetrievable: true,
+		PlanUpdatable:       boolPtr(false),
+		Metadata: map[string]interface{}{
+			"displayName": "Habitat RabbitMQ service",
+			"imageUrl":    "https://avatars2.githubusercontent.com/u/19862012?s=200&v=4",
+		},
+		Plans: []osb.Plan{
+			{
+				Name:        "standalone",
+				ID:          "0a5b3c1e-43a2-4c55-9e3b-6f0d2b8e7a14",
+				Description: "A single RabbitMQ node",
+				Free:        boolPtr(true),
+				Schemas: &osb.Schemas{
+					ServiceInstance: &osb.ServiceInstanceSchema{
+						Create: fixedTopologyProvisionSchema(),
+					},
+				},
+			},
+			{
+				Name:        "cluster",
+				ID:          "c1d9e0f4-7b26-4f1a-a5d8-3e2b9c4f6d07",
+				Description: "A RabbitMQ cluster run in the leader topology, which needs a count of at least 3",
+				Free:        boolPtr(true),
+				Schemas: &osb.Schemas{
+					ServiceInstance: &osb.ServiceInstanceSchema{
+						Create: fixedTopologyProvisionSchema(),
+					},
+				},
+			},
+		},
+	}
+}
+
+func mongodbService() osb.Service {
+	return osb.Service{
+		Name:                "mongodb-habitat",
+		ID:                  "8d3f6a2c-4e7b-4a19-8c5e-1b9d0f7a3e62",
+		Description:         "MongoDB packaged with Habitat",
+		Bindable:            true,
+		BindingsRetrievable: true,
+		PlanUpdatable:       boolPtr(false),
+		Metadata: map[string]interface{}{
+			"displayName": "Habitat MongoDB service",
+			"imageUrl":    "https://avatars2.githubusercontent.com/u/19862012?s=200&v=4",
+		},
+		Plans: []osb.Plan{
+			{
+				Name:        "standalone",
+				ID:          "5e8b1f3a-9c47-4d2e-b6a1-7d0c3f9e2a58",
+				Description: "A single MongoDB server",
+				Free:        boolPtr(true),
+				Schemas: &osb.Schemas{
+					ServiceInstance: &osb.ServiceInstanceSchema{
+						Create: fixedTopologyProvisionSchema(),
+					},
+				},
+			},
+			{
+				Name:        "replica-set",
+				ID:          "b4c2d7e9-1a3f-4b8c-9e5d-2f6a8c0b1d43",
+				Description: "A MongoDB replica set run in the leader topology, which needs a count of at least 3",
+				Free:        boolPtr(true),
+				Schemas: &osb.Schemas{
+					ServiceInstance: &osb.ServiceInstanceSchema{
+						Create: fixedTopologyProvisionSchema(),
+					},
+				},
+			},
+		},
+	}
+}
+
+func habitatPackageService() osb.Service {
+	return osb.Service{
+		Name:          "habitat-package",
+		ID:            "a4f1c7e2-9b35-4d68-8e0a-6c2d5f9b3e71",
+		Description:   "Any package built with Habitat",
+		Bindable:      false,
+		PlanUpdatable: boolPtr(false),
+		Metadata: map[string]interface{}{
+			"displayName": "Habitat package",
+			"imageUrl":    "https://avatars2.githubusercontent.com/u/19862012?s=200&v=4",
+		},
+		Plans: []osb.Plan{
+			{
+				Name:        "default",
+				ID:          habitatPackagePlanID,
+				Description: "Runs the Habitat package or the pre-exported image given by the parameters",
+				Free:        boolPtr(true),
+				Schemas: &osb.Schemas{
+					ServiceInstance: &osb.ServiceInstanceSchema{
+						Create: &osb.InputParametersSchema{
+							Parameters: map[string]interface{}{
+								"$schema": "http://json-schema.org/draft-04/schema",
+								"type":    "object",
+								"title":   "Parameters",
+								"properties": map[string]interface{}{
+									"package": map[string]interface{}{
+										"title":       "Package",
+										"type":        "string",
+										"description": "The ident of the package, origin/name[/version[/release]]",
+									},
+									"image": map[string]interface{}{
+										"title":       "Image",
+										"type":        "string",
+										"description": "A pre-exported image of the package, used instead of the one named after the package",
+									},
+									"group": map[string]interface{}{
+										"title":   "Group",
+										"type":    "string",
+										"default": "default",
+									},
+									"topology": map[string]interface{}{
+										"title":   "Topology",
+										"type":    "string",
+										"default": "standalone",
+										"enum":    []string{"standalone", "leader"},
+									},
+									"count": map[string]interface{}{
+										"title":   "Count",
+										"type":    "int",
+										"default": "1",
+									},
+									"storage": map[string]interface{}{
+										"title": "Storage",
+										"type":  "object",
+										"properties": map[string]interface{}{
+											"size":             map[string]interface{}{"type": "string"},
+											"mountPath":        map[string]interface{}{"type": "string"},
+											"storageClassName": map[string]interface{}{"type": "string"},
+										},
+										"required": []string{"size"},
+									},
+									"config": map[string]interface{}{
+										"title":       "Config",
+										"type":        []string{"object", "string"},
+										"description": "The Habitat config of the package, as an object or a TOML string",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
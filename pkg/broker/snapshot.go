@@ -0,0 +1,509 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	snapshotGroup          = "snapshot.storage.k8s.io"
+	snapshotKind           = "VolumeSnapshot"
+	snapshotResourcePlural = "volumesnapshots"
+
+	// snapshotLabel marks the VolumeSnapshots of an instance, its value is
+	// the prefix of their names.
+	snapshotLabel = "habitat-osb-snapshot"
+)
+
+// snapshotVersions are the versions of the VolumeSnapshot API the broker
+// speaks, the preferred one first. Their snapshots are alike as far as the
+// broker is concerned.
+var snapshotVersions = []string{"v1", "v1beta1"}
+
+// snapshotIDRegexp matches the IDs of the snapshots of instances. A snapshot
+// consists of one VolumeSnapshot per member, named <ID>-<ordinal>.
+var snapshotIDRegexp = regexp.MustCompile(`^habitat-osb-snapshot-[0-9a-f]{32}-[0-9]+$`)
+
+// SnapshotOptions holds the options of the VolumeSnapshots of instances.
+type SnapshotOptions struct {
+	// Class is the VolumeSnapshotClass snapshots are taken with. The
+	// default class of the cluster is used if empty.
+	Class string
+	// BeforeChanges takes a snapshot of every instance before it's updated
+	// or deprovisioned.
+	BeforeChanges bool
+}
+
+// volumeSnapshot is the part of a VolumeSnapshot the broker reads and
+// writes. There's no client for them, they're sent as JSON.
+type volumeSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+
+	Spec   volumeSnapshotSpec    `json:"spec"`
+	Status *volumeSnapshotStatus `json:"status,omitempty"`
+}
+
+type volumeSnapshotSpec struct {
+	Source                  volumeSnapshotSource `json:"source"`
+	VolumeSnapshotClassName *string              `json:"volumeSnapshotClassName,omitempty"`
+}
+
+type volumeSnapshotSource struct {
+	PersistentVolumeClaimName *string `json:"persistentVolumeClaimName,omitempty"`
+}
+
+type volumeSnapshotStatus struct {
+	CreationTime *metav1.Time       `json:"creationTime,omitempty"`
+	ReadyToUse   *bool              `json:"readyToUse,omitempty"`
+	RestoreSize  *resource.Quantity `json:"restoreSize,omitempty"`
+	Error        *struct {
+		Message *string `json:"message,omitempty"`
+	} `json:"error,omitempty"`
+}
+
+type volumeSnapshotList struct {
+	Items []volumeSnapshot `json:"items"`
+}
+
+// ready reports whether volumes can be provisioned from the snapshot.
+func (s *volumeSnapshot) ready() bool {
+	return s.Status != nil && s.Status.ReadyToUse != nil && *s.Status.ReadyToUse
+}
+
+// detectSnapshotAPI returns the version of the VolumeSnapshot API the
+// cluster serves. Snapshots are disabled if it serves none, which is why
+// errors are only logged.
+func detectSnapshotAPI(client kubernetes.Interface) string {
+	for _, version := range snapshotVersions {
+		groupVersion := snapshotGroup + "/" + version
+		resources, err := client.Discovery().ServerResourcesForGroupVersion(groupVersion)
+		if k8sErrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			glog.Warningf("error discovering the API %s, VolumeSnapshots are disabled: %v", groupVersion, err)
+			return ""
+		}
+
+		for _, r := range resources.APIResources {
+			if r.Name == snapshotResourcePlural {
+				return groupVersion
+			}
+		}
+	}
+
+	return ""
+}
+
+// snapshotPrefix returns the prefix of the IDs of the snapshots of an
+// instance.
+func snapshotPrefix(instanceID string) string {
+	sum := sha256.Sum256([]byte(instanceID))
+	return "habitat-osb-snapshot-" + hex.EncodeToString(sum[:])[:idHashLength]
+}
+
+// verifySnapshots checks that the cluster can take snapshots.
+func (b *BrokerLogic) verifySnapshots() error {
+	if b.snapshotAPI == "" {
+		return newHTTPStatusCodeError(http.StatusBadRequest, "the cluster serves no VolumeSnapshot API, so no snapshots can be taken or restored")
+	}
+	return nil
+}
+
+func (b *BrokerLogic) createSnapshot(snapshot *volumeSnapshot, namespace string) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("error encoding VolumeSnapshot %s: %v", snapshot.Name, err)
+	}
+
+	_, err = b.Clients.KubeClient.Discovery().RESTClient().Post().
+		AbsPath("/apis", b.snapshotAPI, "namespaces", namespace, snapshotResourcePlural).
+		SetHeader("Content-Type", "application/json").
+		Body(data).
+		DoRaw()
+	return err
+}
+
+func (b *BrokerLogic) getSnapshot(name, namespace string) (*volumeSnapshot, error) {
+	data, err := b.Clients.KubeClient.Discovery().RESTClient().Get().
+		AbsPath("/apis", b.snapshotAPI, "namespaces", namespace, snapshotResourcePlural, name).
+		DoRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &volumeSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("error decoding VolumeSnapshot %s: %v", name, err)
+	}
+
+	return snapshot, nil
+}
+
+// takeSnapshot snapshots the volumes of all members of the Habitat and
+// returns the ID of the snapshot. Members which have no volume yet are
+// skipped. Snapshots taken within the same second are one and the same.
+func (b *BrokerLogic) takeSnapshot(hab *habv1beta1.Habitat, namespace, instanceID string, entry *AuditEntry) (string, error) {
+	if hab.Spec.V1beta2.PersistentStorage == nil {
+		msg := fmt.Sprintf("%s keeps no data on a persistent volume, which could be snapshotted", hab.Name)
+		return "", newHTTPStatusCodeError(http.StatusBadRequest, msg)
+	}
+
+	prefix := snapshotPrefix(instanceID)
+	id := fmt.Sprintf("%s-%d", prefix, time.Now().Unix())
+
+	// Snapshots are labelled like the other resources of the instance, but
+	// not owned by its Habitat, so they outlive it.
+	labels := instanceLabels(instanceID)
+	labels[snapshotLabel] = prefix
+
+	var class *string
+	if b.snapshot.Class != "" {
+		class = &b.snapshot.Class
+	}
+
+	taken := 0
+	for i := 0; i < hab.Spec.V1beta2.Count; i++ {
+		claimName := memberClaimName(hab.Name, i)
+		_, err := b.Clients.KubeClient.CoreV1().PersistentVolumeClaims(namespace).Get(claimName, metav1.GetOptions{})
+		if k8sErrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("error getting PersistentVolumeClaim %s: %v", claimName, err)
+		}
+
+		snapshot := &volumeSnapshot{
+			TypeMeta: metav1.TypeMeta{APIVersion: b.snapshotAPI, Kind: snapshotKind},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   fmt.Sprintf("%s-%d", id, i),
+				Labels: labels,
+			},
+			Spec: volumeSnapshotSpec{
+				Source:                  volumeSnapshotSource{PersistentVolumeClaimName: &claimName},
+				VolumeSnapshotClassName: class,
+			},
+		}
+
+		err = b.createSnapshot(snapshot, namespace)
+		if err != nil && !k8sErrors.IsAlreadyExists(err) {
+			return "", fmt.Errorf("error creating VolumeSnapshot %s: %v", snapshot.Name, err)
+		}
+		if err == nil {
+			entry.created(snapshotKind, namespace, snapshot.Name)
+		}
+		taken++
+	}
+
+	if taken == 0 {
+		msg := fmt.Sprintf("no member of %s has a volume yet", hab.Name)
+		return "", newHTTPStatusCodeError(http.StatusConflict, msg)
+	}
+
+	return id, nil
+}
+
+// snapshotBeforeChange takes a snapshot of an instance before it's updated or
+// deprovisioned, if the broker is told to. Instances without volumes, and
+// clusters without the VolumeSnapshot API, are passed over.
+func (b *BrokerLogic) snapshotBeforeChange(instanceID string, state *instanceState, entry *AuditEntry) error {
+	if !b.snapshot.BeforeChanges || state.Restore != nil {
+		return nil
+	}
+
+	if b.snapshotAPI == "" {
+		glog.Warningf("Not taking a snapshot of instance %s, the cluster serves no VolumeSnapshot API", instanceID)
+		return nil
+	}
+
+	name, err := habitatName(state.PlanID, state.Parameters)
+	if err != nil {
+		return err
+	}
+
+	hab, err := b.GetHabitat(name, state.Namespace)
+	if k8sErrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error getting Habitat %s: %v", name, err)
+	}
+
+	if hab.Spec.V1beta2.PersistentStorage == nil {
+		return nil
+	}
+
+	id, err := b.takeSnapshot(hab, state.Namespace, instanceID, entry)
+	if err != nil {
+		return fmt.Errorf("error taking a snapshot of instance %s before changing it: %v", instanceID, err)
+	}
+	glog.Infof("Took snapshot %s of instance %s", id, instanceID)
+
+	return nil
+}
+
+// SnapshotResponse is sent as the response to taking a snapshot.
+type SnapshotResponse struct {
+	ID string `json:"id"`
+}
+
+// SnapshotInstance takes a snapshot of the volumes of an instance.
+func (b *BrokerLogic) SnapshotInstance(instanceID string) (_ *SnapshotResponse, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	state, err := b.getInstanceState(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if state == nil {
+		msg := fmt.Sprintf("could not find state of instance %s in configmap %s", instanceID, b.ConfigMap.Name)
+		return nil, newHTTPStatusCodeError(http.StatusNotFound, msg)
+	}
+
+	entry := newAuditEntry(operationSnapshot, instanceID, state.ServiceID, state.PlanID, nil, nil)
+	defer b.recordAudit(entry, &err)
+
+	if err := b.verifySnapshots(); err != nil {
+		return nil, err
+	}
+
+	if state.Restore != nil {
+		msg := fmt.Sprintf("instance %s is still being restored", instanceID)
+		return nil, newHTTPStatusCodeError(http.StatusConflict, msg)
+	}
+
+	name, err := habitatName(state.PlanID, state.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	hab, err := b.GetHabitat(name, state.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error getting Habitat %s: %v", name, err)
+	}
+
+	id, err := b.takeSnapshot(hab, state.Namespace, instanceID, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SnapshotResponse{ID: id}, nil
+}
+
+// SnapshotStatus is the VolumeSnapshot of a member of an instance.
+type SnapshotStatus struct {
+	ID      string     `json:"id"`
+	Name    string     `json:"name"`
+	Volume  string     `json:"volume"`
+	Ready   bool       `json:"ready"`
+	Created *time.Time `json:"created,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// listSnapshots returns the VolumeSnapshots of an instance, the newest
+// first.
+func (b *BrokerLogic) listSnapshots(namespace, instanceID string) ([]SnapshotStatus, error) {
+	selector := labels.SelectorFromSet(labels.Set{snapshotLabel: snapshotPrefix(instanceID)})
+
+	data, err := b.Clients.KubeClient.Discovery().RESTClient().Get().
+		AbsPath("/apis", b.snapshotAPI, "namespaces", namespace, snapshotResourcePlural).
+		Param("labelSelector", selector.String()).
+		DoRaw()
+	if err != nil {
+		return nil, fmt.Errorf("error listing VolumeSnapshots: %v", err)
+	}
+
+	var list volumeSnapshotList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("error decoding VolumeSnapshots: %v", err)
+	}
+
+	snapshots := make([]SnapshotStatus, 0, len(list.Items))
+	for _, s := range list.Items {
+		status := SnapshotStatus{
+			ID:    s.Name[:strings.LastIndex(s.Name, "-")],
+			Name:  s.Name,
+			Ready: s.ready(),
+		}
+		if s.Spec.Source.PersistentVolumeClaimName != nil {
+			status.Volume = *s.Spec.Source.PersistentVolumeClaimName
+		}
+		if s.Status != nil {
+			if s.Status.CreationTime != nil {
+				created := s.Status.CreationTime.Time
+				status.Created = &created
+			}
+			if s.Status.Error != nil && s.Status.Error.Message != nil {
+				status.Error = *s.Status.Error.Message
+			}
+		}
+		snapshots = append(snapshots, status)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].ID != snapshots[j].ID {
+			return snapshots[i].ID > snapshots[j].ID
+		}
+		return snapshots[i].Name < snapshots[j].Name
+	})
+
+	return snapshots, nil
+}
+
+// getSnapshotSource reads the `snapshotFrom` parameter, the ID of the
+// snapshot a new instance starts from.
+func (b *BrokerLogic) getSnapshotSource(params map[string]interface{}) (string, error) {
+	s, ok := params["snapshotFrom"]
+	if !ok {
+		return "", nil
+	}
+
+	id, ok := s.(string)
+	if !ok || !snapshotIDRegexp.MatchString(id) {
+		return "", newHTTPStatusCodeError(http.StatusBadRequest, fmt.Sprintf("snapshotFrom %v is no snapshot ID", s))
+	}
+
+	if _, ok := params["restoreFrom"]; ok {
+		return "", newHTTPStatusCodeError(http.StatusBadRequest, "an instance can't start from both a backup and a snapshot")
+	}
+
+	if err := b.verifySnapshots(); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// provisionFromSnapshot creates the volumes of the members of a new Habitat
+// from the VolumeSnapshots of their counterparts. Members without one start
+// empty. The snapshot must be in the namespace of the new instance.
+func (b *BrokerLogic) provisionFromSnapshot(hab *habv1beta1.Habitat, namespace, id string, entry *AuditEntry) error {
+	storage := hab.Spec.V1beta2.PersistentStorage
+	if storage == nil {
+		msg := fmt.Sprintf("%s keeps no data on a persistent volume, which could be provisioned from a snapshot", hab.Name)
+		return newHTTPStatusCodeError(http.StatusBadRequest, msg)
+	}
+
+	size, err := resource.ParseQuantity(storage.Size)
+	if err != nil {
+		return fmt.Errorf("storage size %q is invalid: %v", storage.Size, err)
+	}
+
+	snapshots := make([]*volumeSnapshot, hab.Spec.V1beta2.Count)
+	for i := range snapshots {
+		name := fmt.Sprintf("%s-%d", id, i)
+		snapshot, err := b.getSnapshot(name, namespace)
+		if k8sErrors.IsNotFound(err) && i > 0 {
+			continue
+		}
+		if k8sErrors.IsNotFound(err) {
+			msg := fmt.Sprintf("snapshot %s does not exist in namespace %s", id, namespace)
+			return newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+		}
+		if err != nil {
+			return fmt.Errorf("error getting VolumeSnapshot %s: %v", name, err)
+		}
+
+		if !snapshot.ready() {
+			msg := fmt.Sprintf("VolumeSnapshot %s is not ready to use yet", name)
+			return newHTTPStatusCodeError(http.StatusUnprocessableEntity, msg)
+		}
+		snapshots[i] = snapshot
+	}
+
+	for i, snapshot := range snapshots {
+		if snapshot == nil {
+			continue
+		}
+
+		// Volumes can't be smaller than the snapshot they're provisioned
+		// from.
+		claimSize := size
+		if restoreSize := snapshot.Status.RestoreSize; restoreSize != nil && restoreSize.Cmp(size) > 0 {
+			claimSize = *restoreSize
+		}
+
+		claim := memberClaim(hab, i, claimSize)
+		if err := b.createClaimFromSnapshot(claim, snapshot.Name, namespace); err != nil {
+			return err
+		}
+		entry.created("PersistentVolumeClaim", namespace, claim.Name)
+	}
+
+	return nil
+}
+
+// createClaimFromSnapshot creates the claim with the snapshot as its data
+// source. The claim is sent as JSON, as the client predates data sources.
+func (b *BrokerLogic) createClaimFromSnapshot(claim *v1.PersistentVolumeClaim, snapshotName, namespace string) error {
+	claim.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"}
+
+	data, err := json.Marshal(claim)
+	if err != nil {
+		return fmt.Errorf("error encoding PersistentVolumeClaim %s: %v", claim.Name, err)
+	}
+
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return fmt.Errorf("error encoding PersistentVolumeClaim %s: %v", claim.Name, err)
+	}
+
+	spec := object["spec"].(map[string]interface{})
+	spec["dataSource"] = map[string]interface{}{
+		"apiGroup": snapshotGroup,
+		"kind":     snapshotKind,
+		"name":     snapshotName,
+	}
+
+	if data, err = json.Marshal(object); err != nil {
+		return fmt.Errorf("error encoding PersistentVolumeClaim %s: %v", claim.Name, err)
+	}
+
+	_, err = b.Clients.KubeClient.Discovery().RESTClient().Post().
+		AbsPath("/api/v1/namespaces", namespace, "persistentvolumeclaims").
+		SetHeader("Content-Type", "application/json").
+		Body(data).
+		DoRaw()
+	if k8sErrors.IsAlreadyExists(err) {
+		msg := fmt.Sprintf("volume %s already exists in namespace %s, so it can't be provisioned from a snapshot", claim.Name, namespace)
+		return newHTTPStatusCodeError(http.StatusConflict, msg)
+	}
+	if err != nil {
+		return fmt.Errorf("error creating PersistentVolumeClaim %s: %v", claim.Name, err)
+	}
+
+	return nil
+}
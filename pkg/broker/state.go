@@ -0,0 +1,239 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+const instanceConfigMapKeySuffix = ".instance"
+
+// instanceState is the record the broker keeps in its configmap for every
+// provisioned instance.
+type instanceState struct {
+	ServiceID  string                 `json:"serviceID"`
+	PlanID     string                 `json:"planID"`
+	Namespace  string                 `json:"namespace"`
+	Count      int                    `json:"count"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	// Ring is the name of the ring the Supervisors gossip in. Instances
+	// provisioned by older versions of the broker gossip in cleartext.
+	Ring string `json:"ring,omitempty"`
+	// Operation is the asynchronous operation in progress, if any.
+	Operation *operationState `json:"operation,omitempty"`
+	// Restore is the restore of the volume of a new instance in progress,
+	// if any.
+	Restore *restoreState `json:"restore,omitempty"`
+	// Reclaim is set once the instance is deleted, while its volumes,
+	// secrets and services are.
+	Reclaim bool `json:"reclaim,omitempty"`
+	// CredentialsIssued is when the password of the default user of a
+	// redis instance was last rotated, zero if it never was.
+	CredentialsIssued time.Time `json:"credentialsIssued,omitempty"`
+	// Rotation is the rotation of the password of the default user of a
+	// redis instance in progress, if any.
+	Rotation *rotationState `json:"rotation,omitempty"`
+}
+
+func getInstanceConfigMapKey(instanceID string) string {
+	return instanceID + instanceConfigMapKeySuffix
+}
+
+// getInstanceState returns the record of the given instance, or nil if the
+// broker has none. Instances provisioned by older versions of the broker only
+// have their namespace recorded and thus no record either.
+func (b *BrokerLogic) getInstanceState(instanceID string) (*instanceState, error) {
+	value, ok := b.ConfigMap.Data[getInstanceConfigMapKey(instanceID)]
+	if !ok {
+		return nil, nil
+	}
+
+	s := &instanceState{}
+	if err := json.Unmarshal([]byte(value), s); err != nil {
+		return nil, fmt.Errorf("error decoding state of instance %s: %v", instanceID, err)
+	}
+
+	return s, nil
+}
+
+// legacyInstanceState builds the record of an instance provisioned by an
+// older version of the broker, which only recorded its namespace, from the
+// plan of the update and the Habitat of the instance. It returns nil if the
+// broker doesn't know the instance at all. The record is stored by the
+// update, so this happens only once.
+func (b *BrokerLogic) legacyInstanceState(request *osb.UpdateInstanceRequest) (*instanceState, error) {
+	ns, ok := b.ConfigMap.Data[getNamespaceConfigMapKey(request.InstanceID)]
+	if !ok {
+		return nil, nil
+	}
+
+	planID := ""
+	if request.PlanID != nil {
+		planID = *request.PlanID
+	} else if request.PreviousValues != nil {
+		planID = request.PreviousValues.PlanID
+	}
+	if planID == "" {
+		msg := fmt.Sprintf("the plan of instance %s is unknown to the broker, the update must name it", request.InstanceID)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, msg)
+	}
+
+	name, _, err := matchService(planID)
+	if err != nil {
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, err.Error())
+	}
+
+	hab, err := b.GetHabitat(name, ns)
+	if err != nil {
+		return nil, fmt.Errorf("error getting Habitat %s of instance %s: %v", name, request.InstanceID, err)
+	}
+
+	return &instanceState{
+		ServiceID: request.ServiceID,
+		PlanID:    planID,
+		Namespace: ns,
+		Count:     hab.Spec.V1beta2.Count,
+	}, nil
+}
+
+func (b *BrokerLogic) setInstanceState(instanceID string, s *instanceState) error {
+	value, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return b.addToConfigMap(getInstanceConfigMapKey(instanceID), string(value))
+}
+
+// listInstanceStates returns the records of all instances, keyed by the
+// instance ID.
+func (b *BrokerLogic) listInstanceStates() (map[string]*instanceState, error) {
+	states := map[string]*instanceState{}
+
+	for key := range b.ConfigMap.Data {
+		if !strings.HasSuffix(key, instanceConfigMapKeySuffix) {
+			continue
+		}
+
+		instanceID := strings.TrimSuffix(key, instanceConfigMapKeySuffix)
+		s, err := b.getInstanceState(instanceID)
+		if err != nil {
+			return nil, err
+		}
+
+		states[instanceID] = s
+	}
+
+	return states, nil
+}
+
+const bindingConfigMapKeySuffix = ".binding"
+
+// bindingState is the record the broker keeps in its configmap for every
+// binding. Credentials are never part of it, they are read from the
+// binding's secret instead.
+type bindingState struct {
+	InstanceID string                 `json:"instanceID"`
+	PlanID     string                 `json:"planID"`
+	Namespace  string                 `json:"namespace"`
+	SecretName string                 `json:"secretName,omitempty"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	// Operation is the asynchronous operation in progress, if any.
+	Operation *operationState `json:"operation,omitempty"`
+	// CredentialsIssued is when the current credentials were issued, which
+	// scheduled rotations are based on.
+	CredentialsIssued time.Time `json:"credentialsIssued,omitempty"`
+	// Rotation is the credential rotation in progress, if any.
+	Rotation *rotationState `json:"rotation,omitempty"`
+}
+
+// operationState tracks an asynchronous operation until the platform polls
+// it to completion.
+type operationState struct {
+	Type    string    `json:"type"`
+	Started time.Time `json:"started"`
+}
+
+func newOperationState(operation string) *operationState {
+	return &operationState{
+		Type:    operation,
+		Started: time.Now().UTC(),
+	}
+}
+
+func getBindingConfigMapKey(bindingID string) string {
+	return bindingID + bindingConfigMapKeySuffix
+}
+
+// getBindingState returns the record of the given binding, or nil if the
+// broker has none.
+func (b *BrokerLogic) getBindingState(bindingID string) (*bindingState, error) {
+	value, ok := b.ConfigMap.Data[getBindingConfigMapKey(bindingID)]
+	if !ok {
+		return nil, nil
+	}
+
+	s := &bindingState{}
+	if err := json.Unmarshal([]byte(value), s); err != nil {
+		return nil, fmt.Errorf("error decoding state of binding %s: %v", bindingID, err)
+	}
+
+	return s, nil
+}
+
+func (b *BrokerLogic) setBindingState(bindingID string, s *bindingState) error {
+	value, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return b.addToConfigMap(getBindingConfigMapKey(bindingID), string(value))
+}
+
+func (b *BrokerLogic) removeBindingState(bindingID string) error {
+	if _, ok := b.ConfigMap.Data[getBindingConfigMapKey(bindingID)]; !ok {
+		return nil
+	}
+
+	return b.removeFromConfigMap(getBindingConfigMapKey(bindingID))
+}
+
+// listBindingStates returns the records of all bindings, keyed by the
+// binding ID.
+func (b *BrokerLogic) listBindingStates() (map[string]*bindingState, error) {
+	states := map[string]*bindingState{}
+
+	for key := range b.ConfigMap.Data {
+		if !strings.HasSuffix(key, bindingConfigMapKeySuffix) {
+			continue
+		}
+
+		bindingID := strings.TrimSuffix(key, bindingConfigMapKeySuffix)
+		s, err := b.getBindingState(bindingID)
+		if err != nil {
+			return nil, err
+		}
+
+		states[bindingID] = s
+	}
+
+	return states, nil
+}
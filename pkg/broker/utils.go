@@ -15,29 +15,86 @@
 package broker
 
 import (
+	"fmt"
+	"net/http"
+
 	habv1beta1 "github.com/habitat-sh/habitat-operator/pkg/apis/habitat/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// GetHabitat returns a Habitat resource, converted to the v1beta2 spec if the
+// habitat-operator uses the v1beta1 one.
 func (b *BrokerLogic) GetHabitat(name, namespace string) (*habv1beta1.Habitat, error) {
-	return b.Clients.HabClient.Habitats(namespace).Get(name, metav1.GetOptions{})
+	hab, err := b.Clients.HabClient.Habitats(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return fromHabitatSpec(hab), nil
+}
+
+// verifyHabitatNameFree returns 409 Conflict if the namespace already has a
+// Habitat of the name, like the one of another instance of the service, or of
+// a package of the same name. Instances which are being restored only get
+// their Habitat later, so their names are taken too. It's checked before any
+// resource of an instance is created, so that a conflicting provision leaves
+// nothing behind.
+func (b *BrokerLogic) verifyHabitatNameFree(name, namespace string) error {
+	msg := fmt.Sprintf("namespace %s already has a Habitat named %s", namespace, name)
+
+	_, err := b.Clients.HabClient.Habitats(namespace).Get(name, metav1.GetOptions{})
+	if err == nil {
+		return newHTTPStatusCodeError(http.StatusConflict, msg)
+	}
+	if !k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("error getting Habitat %s: %v", name, err)
+	}
+
+	states, err := b.listInstanceStates()
+	if err != nil {
+		return err
+	}
+
+	for _, state := range states {
+		if state.Restore == nil || state.Namespace != namespace {
+			continue
+		}
+		if n, err := habitatName(state.PlanID, state.Parameters); err == nil && n == name {
+			return newHTTPStatusCodeError(http.StatusConflict, msg)
+		}
+	}
+
+	return nil
 }
 
 // CreateHabitat creates a Habitat resource through the Kuberentes client,
-// based on the passed Habitat object.
+// based on the passed Habitat object. It's created in the spec the
+// habitat-operator understands.
 func (b *BrokerLogic) CreateHabitat(habitat *habv1beta1.Habitat, namespace string) error {
-	_, err := b.Clients.HabClient.Habitats(namespace).Create(habitat)
+	_, err := b.Clients.HabClient.Habitats(namespace).Create(toHabitatSpec(habitat, b.habitatSpec))
 	return err
 }
 
 func (b *BrokerLogic) UpdateHabitat(habitat *habv1beta1.Habitat, namespace string) error {
-	_, err := b.Clients.HabClient.Habitats(namespace).Update(habitat)
+	_, err := b.Clients.HabClient.Habitats(namespace).Update(toHabitatSpec(habitat, b.habitatSpec))
 	return err
 }
 
-// NewHabitat generates a Habitat object based on the passed params.
+// dataMountPaths are the data directories of the services which keep their
+// data on a persistent volume.
+var dataMountPaths = map[string]string{
+	"redis":      "/hab/svc/redis/data",
+	"postgresql": "/hab/svc/postgresql/data",
+	"rabbitmq":   "/hab/svc/rabbitmq/data",
+	"mongodb":    "/hab/svc/mongodb/data",
+}
+
+// NewHabitat generates a Habitat object based on the passed params. Services
+// which keep data get a persistent volume for it if params.persistent is set.
 func NewHabitat(name, image string, params habitatParameters) *habv1beta1.Habitat {
-	customVersion := "v1beta2"
+	customVersion := HabitatSpecV1beta2
 
 	h := habv1beta1.Habitat{
 		TypeMeta: metav1.TypeMeta{
@@ -61,13 +118,13 @@ func NewHabitat(name, image string, params habitatParameters) *habv1beta1.Habita
 		CustomVersion: &customVersion,
 	}
 
-	if name == "redis" {
+	if mountPath, ok := dataMountPaths[name]; ok && params.persistent {
 		// TODO: The StorageClassName is hardcoded to work with minikube at the
 		// moment but should be a passed as an argument to make it work across
 		// other providers.
 		h.Spec.V1beta2.PersistentStorage = &habv1beta1.PersistentStorage{
 			Size:             "128Mi",
-			MountPath:        "/hab/svc/redis/data",
+			MountPath:        mountPath,
 			StorageClassName: "standard",
 		}
 	}
@@ -75,7 +132,76 @@ func NewHabitat(name, image string, params habitatParameters) *habv1beta1.Habita
 	return &h
 }
 
-// DeleteHabitat sends a request to delete a Habitat resource.
+// DeleteHabitat sends a request to delete a Habitat resource. The finalizer
+// of the broker is removed first.
 func (b *BrokerLogic) DeleteHabitat(habitatName, namespace string) error {
+	if err := b.releaseHabitat(habitatName, namespace); err != nil {
+		return err
+	}
 	return b.Clients.HabClient.Habitats(namespace).Delete(habitatName, nil)
 }
+
+// HabitatRolledOut checks whether all pods of a Habitat run with the given
+// config secret mounted, or not mounted if mounted is false. The
+// habitat-operator names the StatefulSet after the Habitat object. If the
+// rollout is not finished, a description of its progress is returned.
+func (b *BrokerLogic) HabitatRolledOut(name, namespace, secretName string, mounted bool) (bool, string, error) {
+	return b.habitatRolledOut(name, namespace, func(sts *appsv1.StatefulSet) bool {
+		return mountsSecret(sts, secretName) == mounted
+	})
+}
+
+// habitatReady checks whether all pods of a Habitat are ready and run with
+// its current config, so that the users of bindings can be created on them.
+func (b *BrokerLogic) habitatReady(hab *habv1beta1.Habitat, namespace string) (bool, string, error) {
+	secretName := hab.Spec.V1beta2.Service.ConfigSecretName
+	ready, description, err := b.habitatRolledOut(hab.Name, namespace, func(sts *appsv1.StatefulSet) bool {
+		return secretName == nil || mountsSecret(sts, *secretName)
+	})
+	if k8sErrors.IsNotFound(err) {
+		return false, "waiting for the habitat-operator to create the StatefulSet", nil
+	}
+
+	return ready, description, err
+}
+
+// habitatRolledOut checks whether the habitat-operator updated the
+// StatefulSet of a Habitat, as told by updated, and all its pods run with the
+// update.
+func (b *BrokerLogic) habitatRolledOut(name, namespace string, updated func(*appsv1.StatefulSet) bool) (bool, string, error) {
+	sts, err := b.Clients.KubeClient.AppsV1().StatefulSets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return false, "", err
+	}
+
+	if !updated(sts) {
+		return false, "waiting for the habitat-operator to update the StatefulSet", nil
+	}
+
+	if sts.Status.ObservedGeneration < sts.Generation {
+		return false, "waiting for the StatefulSet controller to observe the update", nil
+	}
+
+	replicas := int32(1)
+	if sts.Spec.Replicas != nil {
+		replicas = *sts.Spec.Replicas
+	}
+
+	if sts.Status.UpdatedReplicas < replicas ||
+		sts.Status.ReadyReplicas < replicas ||
+		sts.Status.CurrentRevision != sts.Status.UpdateRevision {
+		return false, fmt.Sprintf("%d of %d pods updated, %d ready", sts.Status.UpdatedReplicas, replicas, sts.Status.ReadyReplicas), nil
+	}
+
+	return true, "", nil
+}
+
+func mountsSecret(sts *appsv1.StatefulSet, secretName string) bool {
+	for _, v := range sts.Spec.Template.Spec.Volumes {
+		if v.Secret != nil && v.Secret.SecretName == secretName {
+			return true
+		}
+	}
+
+	return false
+}
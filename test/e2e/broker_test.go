@@ -32,6 +32,10 @@ import (
 var expectedClusterServiceClasses = []string{
 	"1ac7de1d-d89a-41c7-b9a8-744f9256e375", // nginx
 	"50e86479-4c66-4236-88fb-a1e61b4c9448", // redis
+	"7f5784be-06d8-4750-9dde-1921f006cb67", // postgresql
+	"e3a7f6b2-5c18-4d0e-b9a4-8f1c2d7e5b36", // rabbitmq
+	"8d3f6a2c-4e7b-4a19-8c5e-1b9d0f7a3e62", // mongodb
+	"a4f1c7e2-9b35-4d68-8e0a-6c2d5f9b3e71", // habitat-package
 }
 
 func in(l []catalogv1beta1.ClusterServiceClass, s string) bool {
@@ -309,7 +313,9 @@ func TestRedisStatefulset(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := framework.WaitForNoSecrets(utils.TestNs); err != nil {
+	// The config secret of the instance holds the password of its default
+	// user, which outlives the bindings.
+	if err := framework.WaitForNoBindingSecrets(utils.TestNs); err != nil {
 		t.Fatal(err)
 	}
 
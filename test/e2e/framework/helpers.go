@@ -123,10 +123,13 @@ func (f *Framework) WaitForServiceBindingDeleted(name, namespace string) error {
 }
 
 // WaitForNoSecrets waits until there is no secrets except the default token
-// and the habitat-service-broker token.
+// and the habitat-service-broker token. The ring keys of provisioned
+// instances are not taken into account.
 func (f *Framework) WaitForNoSecrets(namespace string) error {
 	return wait.Poll(time.Second, time.Minute*1, func() (bool, error) {
-		sl, err := f.KubeClient.Core().Secrets(namespace).List(metav1.ListOptions{})
+		sl, err := f.KubeClient.Core().Secrets(namespace).List(metav1.ListOptions{
+			LabelSelector: "!habitat-service-broker/ring",
+		})
 		if err != nil {
 			return false, err
 		}
@@ -146,6 +149,21 @@ func (f *Framework) WaitForNoSecrets(namespace string) error {
 	})
 }
 
+// WaitForNoBindingSecrets waits until the secrets the broker created for
+// bindings are deleted.
+func (f *Framework) WaitForNoBindingSecrets(namespace string) error {
+	return wait.Poll(time.Second, time.Minute*1, func() (bool, error) {
+		sl, err := f.KubeClient.Core().Secrets(namespace).List(metav1.ListOptions{
+			LabelSelector: "habitat-osb-binding",
+		})
+		if err != nil {
+			return false, err
+		}
+
+		return len(sl.Items) == 0, nil
+	})
+}
+
 // WaitForPodReady waits until the pod is in a Ready state.
 func (f *Framework) WaitForPodReady(name, namespace string) error {
 	return wait.Poll(time.Second, time.Minute*1, func() (bool, error) {
@@ -0,0 +1,85 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package builder serves the part of the Builder API the broker uses to look
+// up the latest build of a package in a channel. Tests of package update
+// tracking run against it, without access to Builder.
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+type packageIdent struct {
+	Origin  string `json:"origin"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Release string `json:"release"`
+}
+
+// NewHandler returns a handler of the Builder API which serves the fully
+// qualified package idents of every channel.
+func NewHandler(channels map[string][]string) (http.Handler, error) {
+	packages := map[string][]packageIdent{}
+	for channel, idents := range channels {
+		for _, s := range idents {
+			parts := strings.Split(s, "/")
+			if len(parts) != 4 {
+				return nil, fmt.Errorf("package ident %q of channel %s is not fully qualified", s, channel)
+			}
+
+			packages[channel] = append(packages[channel], packageIdent{
+				Origin:  parts[0],
+				Name:    parts[1],
+				Version: parts[2],
+				Release: parts[3],
+			})
+		}
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/depot/channels/{origin}/{channel}/pkgs/{name}/latest", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		var latest *packageIdent
+		for i, p := range packages[vars["channel"]] {
+			if p.Origin != vars["origin"] || p.Name != vars["name"] {
+				continue
+			}
+
+			// Releases are timestamps of a fixed length.
+			if latest == nil || p.Release > latest.Release {
+				latest = &packages[vars["channel"]][i]
+			}
+		}
+
+		if latest == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"ident": latest}); err != nil {
+			glog.Errorf("error writing response: %v", err)
+		}
+	}).Methods("GET")
+
+	return router, nil
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rabbitmq serves the part of the RabbitMQ management API the broker
+// uses to manage the vhosts and users of bindings, keeping them in memory.
+// Tests of RabbitMQ bindings run against it.
+package rabbitmq
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+type permissions struct {
+	Configure string `json:"configure"`
+	Write     string `json:"write"`
+	Read      string `json:"read"`
+}
+
+type user struct {
+	Password string `json:"password"`
+	Tags     string `json:"tags"`
+}
+
+type store struct {
+	sync.Mutex
+	admin         string
+	adminPassword string
+	vhosts        map[string]struct{}
+	users         map[string]user
+	permissions   map[string]map[string]permissions
+}
+
+// NewHandler returns a handler of the management API which requests must
+// authenticate to as the administrator. Any password is accepted if it's
+// empty.
+func NewHandler(admin, adminPassword string) http.Handler {
+	s := &store{
+		admin:         admin,
+		adminPassword: adminPassword,
+		vhosts:        map[string]struct{}{},
+		users:         map[string]user{},
+		permissions:   map[string]map[string]permissions{},
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/vhosts", s.authenticate(s.listVhosts)).Methods("GET")
+	router.HandleFunc("/api/vhosts/{vhost}", s.authenticate(s.putVhost)).Methods("PUT")
+	router.HandleFunc("/api/vhosts/{vhost}", s.authenticate(s.deleteVhost)).Methods("DELETE")
+	router.HandleFunc("/api/users", s.authenticate(s.listUsers)).Methods("GET")
+	router.HandleFunc("/api/users/{user}", s.authenticate(s.getUser)).Methods("GET")
+	router.HandleFunc("/api/users/{user}", s.authenticate(s.putUser)).Methods("PUT")
+	router.HandleFunc("/api/users/{user}", s.authenticate(s.deleteUser)).Methods("DELETE")
+	router.HandleFunc("/api/permissions/{vhost}/{user}", s.authenticate(s.putPermissions)).Methods("PUT")
+
+	return router
+}
+
+func (s *store) authenticate(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || u != s.admin || (s.adminPassword != "" && p != s.adminPassword) {
+			http.Error(w, "not authorised", http.StatusUnauthorized)
+			return
+		}
+
+		s.Lock()
+		defer s.Unlock()
+		h(w, r)
+	}
+}
+
+func (s *store) listVhosts(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	for name := range s.vhosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writeJSON(w, names)
+}
+
+func (s *store) putVhost(w http.ResponseWriter, r *http.Request) {
+	vhost := mux.Vars(r)["vhost"]
+	s.vhosts[vhost] = struct{}{}
+	glog.Infof("Created vhost %s", vhost)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *store) deleteVhost(w http.ResponseWriter, r *http.Request) {
+	vhost := mux.Vars(r)["vhost"]
+	if _, ok := s.vhosts[vhost]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	delete(s.vhosts, vhost)
+	delete(s.permissions, vhost)
+	glog.Infof("Deleted vhost %s", vhost)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *store) listUsers(w http.ResponseWriter, r *http.Request) {
+	result := map[string]interface{}{}
+	for name := range s.users {
+		granted := map[string]permissions{}
+		for vhost, p := range s.permissions {
+			if perms, ok := p[name]; ok {
+				granted[vhost] = perms
+			}
+		}
+		result[name] = granted
+	}
+
+	writeJSON(w, result)
+}
+
+func (s *store) getUser(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["user"]
+	u, ok := s.users[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSON(w, map[string]string{"name": name, "tags": u.Tags})
+}
+
+func (s *store) putUser(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["user"]
+
+	var u user
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.users[name] = u
+	glog.Infof("Created user %s", name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *store) deleteUser(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["user"]
+	if _, ok := s.users[name]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	delete(s.users, name)
+	for _, p := range s.permissions {
+		delete(p, name)
+	}
+	glog.Infof("Deleted user %s", name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *store) putPermissions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vhost, name := vars["vhost"], vars["user"]
+
+	if _, ok := s.vhosts[vhost]; !ok {
+		http.Error(w, fmt.Sprintf("vhost %s does not exist", vhost), http.StatusBadRequest)
+		return
+	}
+	if _, ok := s.users[name]; !ok {
+		http.Error(w, fmt.Sprintf("user %s does not exist", name), http.StatusBadRequest)
+		return
+	}
+
+	var p permissions
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s.permissions[vhost] == nil {
+		s.permissions[vhost] = map[string]permissions{}
+	}
+	s.permissions[vhost][name] = p
+	glog.Infof("Granted user %s permissions on vhost %s", name, vhost)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Errorf("error writing response: %v", err)
+	}
+}